@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	auditEventKind = "AuditEvent"
+
+	maxAuditEvents = 128
+
+	// The actor of actions by requests without users, like the app admin configuring the app.
+	AppAdminActor = "app-admin"
+)
+
+// AuditEvent records an administrative action. Audit events are only ever created, never updated or deleted.
+type AuditEvent struct {
+	Actor string
+	// ImpersonatedUser is the user the actor acted as, if the actor used `fake-id`.
+	ImpersonatedUser string
+	Action           string
+	TargetKeys       []string
+	// PayloadDigest is the hex encoded SHA-256 of the payload of the action, to identify it without storing secrets.
+	PayloadDigest string `datastore:",noindex"`
+	RemoteAddr    string `datastore:",noindex"`
+	CreatedAt     time.Time
+}
+
+func (a *AuditEvent) Item(r Request) *Item {
+	return NewItem(a).SetName(a.Action)
+}
+
+type AuditEvents []AuditEvent
+
+func (a AuditEvents) Item(r Request, cursor *datastore.Cursor, limit int) *Item {
+	eventItems := make(List, len(a))
+	for i := range a {
+		eventItems[i] = a[i].Item(r)
+	}
+	eventsItem := NewItem(eventItems).SetName("audit-events").AddLink(r.NewLink(Link{
+		Rel:   "self",
+		Route: ListAuditEventsRoute,
+	})).SetDesc([][]string{
+		[]string{
+			"Audit log",
+			"Administrative actions, newest first.",
+			"`actor=X` shows only actions by X, and `action=X` only actions of type X.",
+			fmt.Sprintf("The list contains at most %d events, and if there are more a 'next' link will be available with a 'cursor' query parameter.", maxAuditEvents),
+		},
+	})
+	if cursor != nil {
+		q := r.Req().URL.Query()
+		q.Set("cursor", cursor.String())
+		q.Set("limit", fmt.Sprint(limit))
+		eventsItem.AddLink(r.NewLink(Link{
+			Rel:         "next",
+			Route:       ListAuditEventsRoute,
+			QueryParams: q,
+		}))
+	}
+	return eventsItem
+}
+
+// Audit records that the user of r, or the app admin if there is none, performed action on targets.
+// Users of scoped tokens are recorded even if the handler doesn't accept their scopes, since they still made the request.
+// Payload is JSON encoded, or used as is if it's a byte slice, and only its digest is stored.
+func Audit(ctx context.Context, r Request, action string, payload interface{}, targets ...*datastore.Key) error {
+	event := &AuditEvent{
+		Actor:      AppAdminActor,
+		Action:     action,
+		RemoteAddr: r.Req().RemoteAddr,
+		CreatedAt:  time.Now(),
+	}
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		user, ok = r.Values()[scopedUserKey].(*User)
+	}
+	if ok {
+		event.Actor = user.Id
+		if impersonator, ok := r.Values()["impersonator"].(string); ok {
+			event.Actor = impersonator
+			event.ImpersonatedUser = user.Id
+		}
+	}
+	for _, target := range targets {
+		event.TargetKeys = append(event.TargetKeys, target.String())
+	}
+	if payload != nil {
+		b, ok := payload.([]byte)
+		if !ok {
+			var err error
+			if b, err = json.Marshal(payload); err != nil {
+				return err
+			}
+		}
+		digest := sha256.Sum256(b)
+		event.PayloadDigest = hex.EncodeToString(digest[:])
+	}
+	if _, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, auditEventKind, nil), event); err != nil {
+		log.Errorf(ctx, "Unable to audit %+v: %v", event, err)
+		return err
+	}
+	return nil
+}
+
+func listAuditEvents(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	superusers, err := GetSuperusers(ctx)
+	if err == datastore.ErrNoSuchEntity {
+		return HTTPErr{"unauthorized", 403}
+	} else if err != nil {
+		return err
+	}
+	if !superusers.Includes(user.Id) {
+		return HTTPErr{"unauthorized", 403}
+	}
+
+	limit, err := strconv.ParseInt(r.Req().URL.Query().Get("limit"), 10, 64)
+	if err != nil || limit < 1 || limit > maxAuditEvents {
+		limit = maxAuditEvents
+		err = nil
+	}
+
+	query := datastore.NewQuery(auditEventKind)
+	if actor := r.Req().URL.Query().Get("actor"); actor != "" {
+		query = query.Filter("Actor=", actor)
+	}
+	if action := r.Req().URL.Query().Get("action"); action != "" {
+		query = query.Filter("Action=", action)
+	}
+	query = query.Order("-CreatedAt")
+
+	if cursor := r.Req().URL.Query().Get("cursor"); cursor != "" {
+		decoded, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return err
+		}
+		query = query.Start(decoded)
+	}
+
+	iter := query.Run(ctx)
+
+	events := AuditEvents{}
+	for err == nil && len(events) < int(limit) {
+		event := &AuditEvent{}
+		_, err = iter.Next(event)
+		if err == nil {
+			events = append(events, *event)
+		}
+	}
+
+	var cursP *datastore.Cursor
+	if err == nil {
+		curs, err := iter.Cursor()
+		if err != nil {
+			return err
+		}
+		cursP = &curs
+	} else if err != datastore.Done {
+		return err
+	}
+
+	w.SetContent(events.Item(r, cursP, int(limit)))
+	return nil
+}
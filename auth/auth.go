@@ -29,14 +29,28 @@ import (
 var TestMode = false
 
 const (
-	LoginRoute            = "Login"
-	LogoutRoute           = "Logout"
-	RedirectRoute         = "Redirect"
-	OAuth2CallbackRoute   = "OAuth2Callback"
-	UnsubscribeRoute      = "Unsubscribe"
-	ApproveRedirectRoute  = "ApproveRedirect"
-	ListRedirectURLsRoute = "ListRedirectURLs"
-	ReplaceFCMRoute       = "ReplaceFCM"
+	LoginRoute              = "Login"
+	LogoutRoute             = "Logout"
+	RedirectRoute           = "Redirect"
+	OAuth2CallbackRoute     = "OAuth2Callback"
+	UnsubscribeRoute        = "Unsubscribe"
+	ApproveRedirectRoute    = "ApproveRedirect"
+	ListRedirectURLsRoute   = "ListRedirectURLs"
+	ReplaceFCMRoute         = "ReplaceFCM"
+	ListLoginProvidersRoute = "ListLoginProviders"
+	ListIdentitiesRoute     = "ListIdentities"
+	PasswordRegisterRoute   = "PasswordRegister"
+	PasswordVerifyRoute     = "PasswordVerify"
+	PasswordLoginRoute      = "PasswordLogin"
+	ListSessionsRoute       = "ListSessions"
+	RevokeSessionsRoute     = "RevokeSessions"
+	ListOAuthClientsRoute   = "ListOAuthClients"
+	ListOAuthGrantsRoute    = "ListOAuthGrants"
+	OAuthAuthorizeRoute     = "OAuthAuthorize"
+	OAuthConsentRoute       = "OAuthConsent"
+	OAuthTokenRoute         = "OAuthToken"
+	ListThrottlesRoute      = "ListThrottles"
+	ListAuditEventsRoute    = "ListAuditEvents"
 )
 
 const (
@@ -196,6 +210,10 @@ type User struct {
 	Picture       string
 	VerifiedEmail bool
 	ValidUntil    time.Time
+	// SessionId is only set in tokens, and identifies the session the token belongs to.
+	SessionId string `datastore:"-" json:",omitempty"`
+	// Scopes is only set in tokens, and limits what the token can be used for. Tokens without scopes have full access.
+	Scopes []string `datastore:"-" json:",omitempty"`
 }
 
 func UserID(ctx context.Context, userID string) *datastore.Key {
@@ -362,16 +380,10 @@ func getOAuth(ctx context.Context) (*OAuth, error) {
 }
 
 func getOAuth2Config(ctx context.Context, r *http.Request) (*oauth2.Config, error) {
-	redirectURL, err := router.Get(OAuth2CallbackRoute).URL()
+	redirectURL, err := getCallbackURL(r)
 	if err != nil {
 		return nil, err
 	}
-	if r.TLS == nil {
-		redirectURL.Scheme = "http"
-	} else {
-		redirectURL.Scheme = "https"
-	}
-	redirectURL.Host = r.Host
 
 	oauth, err := getOAuth(ctx)
 	if err != nil {
@@ -381,7 +393,7 @@ func getOAuth2Config(ctx context.Context, r *http.Request) (*oauth2.Config, erro
 	return &oauth2.Config{
 		ClientID:     oauth.ClientID,
 		ClientSecret: oauth.Secret,
-		RedirectURL:  redirectURL.String(),
+		RedirectURL:  redirectURL,
 		Scopes: []string{
 			"openid",
 			"profile",
@@ -394,12 +406,32 @@ func getOAuth2Config(ctx context.Context, r *http.Request) (*oauth2.Config, erro
 func handleLogin(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
-	conf, err := getOAuth2Config(ctx, r.Req())
+	state := &loginState{
+		RedirectTo: r.Req().URL.Query().Get("redirect-to"),
+		Provider:   r.Req().URL.Query().Get("provider"),
+	}
+	if r.Req().URL.Query().Get("link") == "true" {
+		user, ok := r.Values()["user"].(*User)
+		if !ok {
+			return HTTPErr{"unauthorized", 401}
+		}
+		state.LinkUserId = user.Id
+	}
+
+	provider, err := getLoginProvider(ctx, state.Provider)
+	if err != nil {
+		return err
+	}
+
+	encodedState, err := state.encode(ctx)
 	if err != nil {
 		return err
 	}
 
-	loginURL := conf.AuthCodeURL(r.Req().URL.Query().Get("redirect-to"))
+	loginURL, err := provider.AuthCodeURL(ctx, r.Req(), encodedState)
+	if err != nil {
+		return err
+	}
 
 	http.Redirect(w, r.Req(), loginURL, 307)
 	return nil
@@ -468,37 +500,31 @@ func EncodeToken(ctx context.Context, user *User) (string, error) {
 func handleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 
-	conf, err := getOAuth2Config(ctx, r)
+	state, err := decodeLoginState(ctx, r.URL.Query().Get("state"))
 	if err != nil {
 		HTTPError(w, r, err)
 		return
 	}
 
-	token, err := conf.Exchange(ctx, r.URL.Query().Get("code"))
+	provider, err := getLoginProvider(ctx, state.Provider)
 	if err != nil {
 		HTTPError(w, r, err)
 		return
 	}
 
-	client := oauth2.NewClient(ctx, oauth2.StaticTokenSource(token))
-	service, err := oauth2service.New(client)
+	identity, err := provider.Identify(ctx, r)
 	if err != nil {
 		HTTPError(w, r, err)
 		return
 	}
-	userInfo, err := oauth2service.NewUserinfoService(service).Get().Context(ctx).Do()
+
+	user, err := resolveIdentity(ctx, identity, state.LinkUserId)
 	if err != nil {
 		HTTPError(w, r, err)
 		return
 	}
-	user := infoToUser(userInfo)
-	user.ValidUntil = time.Now().Add(time.Hour * 24)
-	if _, err := datastore.Put(ctx, UserID(ctx, user.Id), user); err != nil {
-		HTTPError(w, r, err)
-		return
-	}
 
-	redirectURL, err := url.Parse(r.URL.Query().Get("state"))
+	redirectURL, err := url.Parse(state.RedirectTo)
 	if err != nil {
 		HTTPError(w, r, err)
 		return
@@ -524,7 +550,7 @@ func handleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 			requestedURL.RawQuery = ""
 			requestedURL.Path = ""
 
-			cipher, err := EncodeString(ctx, fmt.Sprintf("%s,%s", redirectURL.String(), user.Id))
+			cipher, err := EncodeString(ctx, fmt.Sprintf("%s,%s,%s", state.Provider, user.Id, redirectURL.String()))
 			if err != nil {
 				HTTPError(w, r, err)
 				return
@@ -545,20 +571,32 @@ func handleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	userToken, err := EncodeToken(ctx, user)
+	provider := state.Provider
+	if provider == "" {
+		provider = GoogleProvider
+	}
+	session, err := newSession(ctx, r, user, fmt.Sprintf("%s login", provider), false, loginSessionValidity, nil)
 	if err != nil {
 		HTTPError(w, r, err)
 		return
 	}
 
 	query := url.Values{}
-	query.Set("token", userToken)
+	query.Set("token", session.Token)
 	redirectURL.RawQuery = query.Encode()
 
 	http.Redirect(w, r, redirectURL.String(), 307)
 }
 
 func handleLogout(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if user, ok := r.Values()["user"].(*User); ok && user.SessionId != "" {
+		if err := datastore.Delete(ctx, SessionID(ctx, user.Id, user.SessionId)); err != nil {
+			return err
+		}
+	}
+
 	http.Redirect(w, r.Req(), r.Req().URL.Query().Get("redirect-to"), 307)
 	return nil
 }
@@ -618,10 +656,17 @@ func tokenFilter(w ResponseWriter, r Request) (bool, error) {
 			if len(parts) != 2 {
 				return false, HTTPErr{"Authorization header not two parts joined by space", 400}
 			}
-			if strings.ToLower(parts[0]) != "bearer" {
-				return false, HTTPErr{"Authorization header part 1 not 'bearer'", 400}
+			switch strings.ToLower(parts[0]) {
+			case "bearer":
+				token = parts[1]
+			case "basic":
+				// OAuth2 clients authenticate using basic auth at the token route, and nowhere else.
+				if route := mux.CurrentRoute(r.Req()); route == nil || route.GetName() != OAuthTokenRoute {
+					return false, HTTPErr{"Authorization header part 1 not 'bearer'", 400}
+				}
+			default:
+				return false, HTTPErr{"Authorization header part 1 not 'bearer' or 'basic'", 400}
 			}
-			token = parts[1]
 		}
 	}
 
@@ -638,9 +683,12 @@ func tokenFilter(w ResponseWriter, r Request) (bool, error) {
 		if user.ValidUntil.Before(time.Now()) {
 			return false, HTTPErr{"token timed out", 401}
 		}
-
+		if err := checkSession(ctx, user); err != nil {
+			return false, err
+		}
 		log.Infof(ctx, "Request by %+v", user)
 
+		impersonator := ""
 		if fakeID := r.Req().URL.Query().Get("fake-id"); fakeID != "" {
 			superusers, err := GetSuperusers(ctx)
 			if err != nil {
@@ -652,10 +700,23 @@ func tokenFilter(w ResponseWriter, r Request) (bool, error) {
 			}
 
 			log.Infof(ctx, "Faking user Id %q", fakeID)
+			impersonator = user.Id
 			user.Id = fakeID
 		}
 
-		r.Values()["user"] = user
+		if len(user.Scopes) > 0 {
+			// Scoped tokens only act as their users for handlers accepting their scopes.
+			r.Values()[scopedUserKey] = user
+		} else {
+			r.Values()["user"] = user
+		}
+
+		if impersonator != "" {
+			r.Values()["impersonator"] = impersonator
+			if err := Audit(ctx, r, "impersonate", fmt.Sprintf("%s %s", r.Req().Method, r.Req().URL.Path), UserID(ctx, user.Id)); err != nil {
+				return false, err
+			}
+		}
 
 		if queryToken {
 			r.DecorateLinks(func(l *Link, u *url.URL) error {
@@ -715,12 +776,12 @@ func handleApproveRedirect(w ResponseWriter, r Request) error {
 		return err
 	}
 
-	parts := strings.Split(plain, ",")
-	if len(parts) != 2 {
-		return fmt.Errorf("plain text token is not two strings joined by ','")
+	parts := strings.SplitN(plain, ",", 3)
+	if len(parts) != 3 {
+		return fmt.Errorf("plain text token is not three strings joined by ','")
 	}
 
-	toApproveURL, err := url.Parse(parts[0])
+	toApproveURL, err := url.Parse(parts[2])
 	if err != nil {
 		return err
 	}
@@ -729,6 +790,7 @@ func handleApproveRedirect(w ResponseWriter, r Request) error {
 	strippedToApproveURL.RawQuery = ""
 	strippedToApproveURL.Path = ""
 
+	provider := parts[0]
 	userId := parts[1]
 
 	approvedURL := &RedirectURL{
@@ -743,6 +805,9 @@ func handleApproveRedirect(w ResponseWriter, r Request) error {
 	loginURL, err := router.Get(LoginRoute).URL()
 	q := loginURL.Query()
 	q.Set("redirect-to", toApproveURL.String())
+	if provider != "" {
+		q.Set("provider", provider)
+	}
 	loginURL.RawQuery = q.Encode()
 
 	http.Redirect(w, r.Req(), loginURL.String(), 307)
@@ -920,14 +985,30 @@ func replaceFCM(w ResponseWriter, r Request) error {
 func SetupRouter(r *mux.Router) {
 	router = r
 	HandleResource(router, UserConfigResource)
+	HandleResource(router, ProfileResource)
 	HandleResource(router, RedirectURLResource)
+	HandleResource(router, IdentityResource)
+	HandleResource(router, SessionResource)
+	HandleResource(router, OAuthClientResource)
+	HandleResource(router, OAuthGrantResource)
 	Handle(router, "/Auth/Login", []string{"GET"}, LoginRoute, handleLogin)
-	Handle(router, "/Auth/Logout", []string{"GET"}, LogoutRoute, handleLogout)
+	Handle(router, "/Auth/Logout", []string{"GET"}, LogoutRoute, ScopedHandler(AnyScope, handleLogout))
+	Handle(router, "/Auth/Providers", []string{"GET"}, ListLoginProvidersRoute, listLoginProviders)
+	Handle(router, "/Auth/Password/Register", []string{"POST"}, PasswordRegisterRoute, handlePasswordRegister)
+	Handle(router, "/Auth/Password/Verify", []string{"GET"}, PasswordVerifyRoute, handlePasswordVerify)
+	Handle(router, "/Auth/Password/Login", []string{"POST"}, PasswordLoginRoute, handlePasswordLogin)
 	// Don't use `Handle` here, because we don't want CORS support for this particular route.
 	router.Path("/Auth/OAuth2Callback").Methods("GET").Name(OAuth2CallbackRoute).HandlerFunc(handleOAuth2Callback)
+	Handle(router, "/OAuth/Authorize", []string{"GET"}, OAuthAuthorizeRoute, handleOAuthAuthorize)
+	Handle(router, "/OAuth/Consent", []string{"POST"}, OAuthConsentRoute, handleOAuthConsent)
+	Handle(router, "/OAuth/Token", []string{"POST"}, OAuthTokenRoute, handleOAuthToken)
 	Handle(router, "/Auth/ApproveRedirect", []string{"GET"}, ApproveRedirectRoute, handleApproveRedirect)
+	Handle(router, "/User/{user_id}/Sessions/Revoke", []string{"POST"}, RevokeSessionsRoute, revokeSessions)
+	Handle(router, "/Admin/Audit", []string{"GET"}, ListAuditEventsRoute, listAuditEvents)
+	Handle(router, "/Admin/Throttles", []string{"GET"}, ListThrottlesRoute, listThrottles)
 	Handle(router, "/User/{user_id}/Unsubscribe", []string{"GET"}, UnsubscribeRoute, unsubscribe)
-	Handle(router, "/User/{user_id}/FCMToken/{replace_token}/Replace", []string{"PUT"}, ReplaceFCMRoute, replaceFCM)
+	Handle(router, "/User/{user_id}/FCMToken/{replace_token}/Replace", []string{"PUT"}, ReplaceFCMRoute, ScopedHandler(ManageConfigScope, replaceFCM))
 	AddFilter(tokenFilter)
+	AddFilter(rateLimitFilter)
 	AddPostProc(loginRedirect)
 }
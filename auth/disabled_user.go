@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	disabledUserKind = "DisabledUser"
+)
+
+// DisabledUser marks a user that isn't allowed to log in.
+type DisabledUser struct {
+	UserId     string
+	Reason     string `methods:"PUT" datastore:",noindex"`
+	DisabledBy string
+	DisabledAt time.Time
+}
+
+func DisabledUserID(ctx context.Context, userId string) *datastore.Key {
+	return datastore.NewKey(ctx, disabledUserKind, userId, 0, nil)
+}
+
+func (d *DisabledUser) ID(ctx context.Context) *datastore.Key {
+	return DisabledUserID(ctx, d.UserId)
+}
+
+func (d *DisabledUser) Item(r Request) *Item {
+	return NewItem(d).SetName(d.UserId)
+}
+
+func IsDisabled(ctx context.Context, userId string) (bool, error) {
+	if err := datastore.Get(ctx, DisabledUserID(ctx, userId), &DisabledUser{}); err == datastore.ErrNoSuchEntity {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DisableUser stops the user from logging in, and revokes all sessions of the user.
+// Legacy tokens without sessions are refused by checkSession, and expire within a day anyway.
+func DisableUser(ctx context.Context, disabled *DisabledUser) error {
+	disabled.DisabledAt = time.Now()
+	if _, err := datastore.Put(ctx, disabled.ID(ctx), disabled); err != nil {
+		return err
+	}
+	ids, err := datastore.NewQuery(sessionKind).Ancestor(UserID(ctx, disabled.UserId)).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	return datastore.DeleteMulti(ctx, ids)
+}
+
+func EnableUser(ctx context.Context, userId string) error {
+	return datastore.Delete(ctx, DisabledUserID(ctx, userId))
+}
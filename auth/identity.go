@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	identityKind = "Identity"
+)
+
+var IdentityResource *Resource
+
+func init() {
+	IdentityResource = &Resource{
+		Delete:   deleteIdentity,
+		FullPath: "/User/{user_id}/Identity/{provider}/{subject}",
+		Listers: []Lister{
+			{
+				Path:    "/User/{user_id}/Identities",
+				Route:   ListIdentitiesRoute,
+				Handler: listIdentities,
+			},
+		},
+	}
+}
+
+// Identity connects an account at a login provider with a user.
+// Users created before identities existed have their Google user ID as user ID, and get their Google identity the next time they log in.
+type Identity struct {
+	Provider  string
+	Subject   string
+	UserId    string
+	Email     string
+	CreatedAt time.Time
+}
+
+func IdentityID(ctx context.Context, provider, subject string) *datastore.Key {
+	return datastore.NewKey(ctx, identityKind, fmt.Sprintf("%s/%s", provider, subject), 0, nil)
+}
+
+func (i *Identity) ID(ctx context.Context) *datastore.Key {
+	return IdentityID(ctx, i.Provider, i.Subject)
+}
+
+func (i *Identity) Item(r Request) *Item {
+	return NewItem(i).SetName(fmt.Sprintf("%s/%s", i.Provider, i.Subject)).
+		AddLink(r.NewLink(IdentityResource.Link("unlink", Delete, []string{"user_id", i.UserId, "provider", i.Provider, "subject", i.Subject})))
+}
+
+type Identities []Identity
+
+func (i Identities) Item(r Request, userId string) *Item {
+	identityItems := make(List, len(i))
+	for j := range i {
+		identityItems[j] = i[j].Item(r)
+	}
+	return NewItem(identityItems).SetName("identities").AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ListIdentitiesRoute,
+		RouteParams: []string{"user_id", userId},
+	})).SetDesc([][]string{
+		[]string{
+			"Identities",
+			"Identities are the login provider accounts you can log in as this user with.",
+			"Link more identities using the `login` links of the login providers with `link=true`, and unlink them using the `unlink` links here.",
+			"The last identity of a user can't be unlinked.",
+		},
+	})
+}
+
+func newUserId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// loginState is carried through the login provider as OAuth2 state.
+type loginState struct {
+	RedirectTo string
+	Provider   string
+	LinkUserId string
+}
+
+func (l *loginState) encode(ctx context.Context) (string, error) {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return "", err
+	}
+	return EncodeString(ctx, string(b))
+}
+
+func decodeLoginState(ctx context.Context, s string) (*loginState, error) {
+	plain, err := DecodeString(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	state := &loginState{}
+	if err := json.Unmarshal([]byte(plain), state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// resolveIdentity returns the user owning identity, creating the user or the identity if necessary.
+// If linkUserId isn't empty, the identity is linked to that user instead, unless it already belongs to someone else.
+func resolveIdentity(ctx context.Context, identity *ExternalIdentity, linkUserId string) (*User, error) {
+	newId, err := newUserId()
+	if err != nil {
+		return nil, err
+	}
+
+	user := &User{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		found := &Identity{}
+		userId := ""
+		err := datastore.Get(ctx, IdentityID(ctx, identity.Provider, identity.Subject), found)
+		if err == nil && found.UserId != "" {
+			if linkUserId != "" && found.UserId != linkUserId {
+				return HTTPErr{fmt.Sprintf("%s/%s is already linked to another user", identity.Provider, identity.Subject), 409}
+			}
+			userId = found.UserId
+		} else if err == nil || err == datastore.ErrNoSuchEntity {
+			switch {
+			case linkUserId != "":
+				userId = linkUserId
+			case identity.Provider == GoogleProvider && err == datastore.ErrNoSuchEntity:
+				// Unlinked identities are kept without user, so only Google accounts that never had an identity get the user named after them.
+				userId = identity.Subject
+			default:
+				userId = newId
+			}
+			found = &Identity{
+				Provider:  identity.Provider,
+				Subject:   identity.Subject,
+				UserId:    userId,
+				Email:     identity.Email,
+				CreatedAt: time.Now(),
+			}
+			if _, err := datastore.Put(ctx, found.ID(ctx), found); err != nil {
+				return err
+			}
+		} else {
+			return err
+		}
+
+		if disabled, err := IsDisabled(ctx, userId); err != nil {
+			return err
+		} else if disabled {
+			return HTTPErr{"account disabled", 403}
+		}
+
+		if err := datastore.Get(ctx, UserID(ctx, userId), user); err == datastore.ErrNoSuchEntity {
+			user = identity.toUser(userId)
+		} else if err != nil {
+			return err
+		} else if identity.Provider == GoogleProvider && identity.Subject == userId {
+			// Users created by Google logins keep getting their details from Google.
+			user = identity.toUser(userId)
+		}
+		user.ValidUntil = time.Now().Add(time.Hour * 24)
+		_, err = datastore.Put(ctx, UserID(ctx, userId), user)
+		return err
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		return nil, err
+	}
+
+	log.Infof(ctx, "%s/%s logged in as %q", identity.Provider, identity.Subject, user.Id)
+
+	return user, nil
+}
+
+func listIdentities(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only list your own identities", 403}
+	}
+
+	identities := Identities{}
+	if _, err := datastore.NewQuery(identityKind).Filter("UserId=", user.Id).GetAll(ctx, &identities); err != nil {
+		return err
+	}
+
+	w.SetContent(identities.Item(r, user.Id))
+	return nil
+}
+
+func deleteIdentity(w ResponseWriter, r Request) (*Identity, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return nil, HTTPErr{"unauthorized", 401}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return nil, HTTPErr{"can only unlink your own identities", 403}
+	}
+
+	// Queries can't run in cross group transactions, so a concurrent unlink might leave a user without identities.
+	count, err := datastore.NewQuery(identityKind).Filter("UserId=", user.Id).Count(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if count < 2 {
+		return nil, HTTPErr{"can't unlink the last identity", 412}
+	}
+
+	identity := &Identity{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		identityID := IdentityID(ctx, r.Vars()["provider"], r.Vars()["subject"])
+		if err := datastore.Get(ctx, identityID, identity); err != nil {
+			return err
+		}
+		if identity.UserId != user.Id {
+			return HTTPErr{"can only unlink your own identities", 403}
+		}
+		if identity.Provider == GoogleProvider && identity.Subject == user.Id {
+			// Keep the identity without user, to stop the next login from falling back to the user named after it.
+			_, err := datastore.Put(ctx, identityID, &Identity{
+				Provider:  identity.Provider,
+				Subject:   identity.Subject,
+				CreatedAt: time.Now(),
+			})
+			return err
+		}
+		return datastore.Delete(ctx, identityID)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+
+	return identity, nil
+}
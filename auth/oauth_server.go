@@ -0,0 +1,836 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	oAuthClientKind = "OAuthClient"
+	oAuthGrantKind  = "OAuthGrant"
+	oAuthCodeKind   = "OAuthCode"
+
+	oAuthCodeValidity     = time.Minute * 10
+	oAuthConsentValidity  = time.Minute * 30
+	oAuthAccessValidity   = time.Hour
+	oAuthRefreshValidity  = time.Hour * 24 * 90
+	pkceS256ChallengeType = "S256"
+	oAuthCSRFCookie       = "oauth-consent-csrf"
+
+	// How many expired authorization codes are deleted each time a new code is created.
+	maxExpiredOAuthCodes = 100
+)
+
+var (
+	OAuthClientResource *Resource
+	OAuthGrantResource  *Resource
+
+	scopeDescriptions = map[string]string{
+		ReadGamesScope:    "See your games, phases, orders and statistics",
+		ReadPressScope:    "Read your game press",
+		WriteGamesScope:   "Create, join and leave games on your behalf",
+		WriteOrdersScope:  "Submit orders and mark you ready",
+		WritePressScope:   "Send press on your behalf",
+		ManageConfigScope: "Change your settings, profile and bans, and download your personal data",
+	}
+)
+
+func init() {
+	OAuthClientResource = &Resource{
+		Load:       loadOAuthClient,
+		Create:     createOAuthClient,
+		Delete:     deleteOAuthClient,
+		CreatePath: "/OAuthClient",
+		FullPath:   "/OAuthClient/{client_id}",
+		Listers: []Lister{
+			{
+				Path:    "/User/{user_id}/OAuthClients",
+				Route:   ListOAuthClientsRoute,
+				Handler: listOAuthClients,
+			},
+		},
+	}
+	OAuthGrantResource = &Resource{
+		Delete:   deleteOAuthGrant,
+		FullPath: "/User/{user_id}/OAuthGrant/{client_id}",
+		Listers: []Lister{
+			{
+				Path:    "/User/{user_id}/OAuthGrants",
+				Route:   ListOAuthGrantsRoute,
+				Handler: listOAuthGrants,
+			},
+		},
+	}
+}
+
+// OAuthClient is a third party frontend registered to use diplicity as OAuth2 provider.
+type OAuthClient struct {
+	Id           string
+	OwnerId      string
+	Name         string   `methods:"POST"`
+	RedirectURIs []string `methods:"POST"`
+	// Public clients, like single page apps, can't keep secrets and authenticate using PKCE only.
+	Public     bool   `methods:"POST"`
+	SecretHash []byte `datastore:",noindex" json:"-"`
+	CreatedAt  time.Time
+
+	// Secret is only populated when a confidential client is created.
+	Secret string `datastore:"-" json:",omitempty"`
+}
+
+func OAuthClientID(ctx context.Context, clientId string) *datastore.Key {
+	return datastore.NewKey(ctx, oAuthClientKind, clientId, 0, nil)
+}
+
+func (c *OAuthClient) ID(ctx context.Context) *datastore.Key {
+	return OAuthClientID(ctx, c.Id)
+}
+
+func (c *OAuthClient) Item(r Request) *Item {
+	clientItem := NewItem(c).SetName(c.Name).
+		AddLink(r.NewLink(OAuthClientResource.Link("self", Load, []string{"client_id", c.Id})))
+	if user, ok := r.Values()["user"].(*User); ok && user.Id == c.OwnerId {
+		clientItem.AddLink(r.NewLink(OAuthClientResource.Link("delete", Delete, []string{"client_id", c.Id})))
+	}
+	return clientItem
+}
+
+func (c *OAuthClient) allowsRedirect(redirectURI string) bool {
+	for _, allowed := range c.RedirectURIs {
+		if allowed == redirectURI {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns an error unless secret is the secret of the client, or the client is public and got no secret.
+func (c *OAuthClient) authenticate(secret string) error {
+	if c.Public {
+		if secret != "" {
+			return oAuthErr{"invalid_client", "public clients have no secret", 401}
+		}
+		return nil
+	}
+	hash := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(hash[:], c.SecretHash) != 1 {
+		return oAuthErr{"invalid_client", "wrong client secret", 401}
+	}
+	return nil
+}
+
+type OAuthClients []OAuthClient
+
+func (c OAuthClients) Item(r Request, userId string) *Item {
+	clientItems := make(List, len(c))
+	for i := range c {
+		clientItems[i] = c[i].Item(r)
+	}
+	return NewItem(clientItems).SetName("oauth-clients").AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ListOAuthClientsRoute,
+		RouteParams: []string{"user_id", userId},
+	})).AddLink(r.NewLink(OAuthClientResource.Link("create", Create, nil))).
+		SetDesc([][]string{
+			[]string{
+				"OAuth2 clients",
+				"Frontends integrate with diplicity using the OAuth2 authorization code flow with PKCE (S256), at `/OAuth/Authorize` and `/OAuth/Token`.",
+				"Registering a client requires a `Name` and the exact `RedirectURIs` it will use. The client secret is only returned when the client is created.",
+				"Public clients, like single page apps, get no secret and authenticate using PKCE only.",
+				"Access tokens are valid for an hour, and refresh tokens for 90 days after their last use.",
+			},
+		})
+}
+
+// OAuthGrant is the consent of a user to let a client act with some scopes on their behalf.
+type OAuthGrant struct {
+	UserId     string
+	ClientId   string
+	ClientName string
+	Scopes     []string
+	CreatedAt  time.Time
+}
+
+func OAuthGrantID(ctx context.Context, userId, clientId string) *datastore.Key {
+	return datastore.NewKey(ctx, oAuthGrantKind, clientId, 0, UserID(ctx, userId))
+}
+
+func (g *OAuthGrant) ID(ctx context.Context) *datastore.Key {
+	return OAuthGrantID(ctx, g.UserId, g.ClientId)
+}
+
+func (g *OAuthGrant) Item(r Request) *Item {
+	return NewItem(g).SetName(g.ClientName).
+		AddLink(r.NewLink(OAuthGrantResource.Link("revoke", Delete, []string{"user_id", g.UserId, "client_id", g.ClientId})))
+}
+
+func (g *OAuthGrant) covers(scopes []string) bool {
+	for _, scope := range scopes {
+		found := false
+		for _, granted := range g.Scopes {
+			found = found || scope == granted
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type OAuthGrants []OAuthGrant
+
+func (g OAuthGrants) Item(r Request, userId string) *Item {
+	grantItems := make(List, len(g))
+	for i := range g {
+		grantItems[i] = g[i].Item(r)
+	}
+	return NewItem(grantItems).SetName("oauth-grants").AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ListOAuthGrantsRoute,
+		RouteParams: []string{"user_id", userId},
+	})).SetDesc([][]string{
+		[]string{
+			"Authorized frontends",
+			"These frontends are allowed to act on your behalf. Revoking one logs it out everywhere, and makes it ask for consent again.",
+		},
+	})
+}
+
+// OAuthCode is a single use authorization code, exchanged for tokens at the token route.
+type OAuthCode struct {
+	ClientId      string
+	UserId        string
+	RedirectURI   string `datastore:",noindex"`
+	Scopes        []string
+	CodeChallenge string `datastore:",noindex"`
+	ExpiresAt     time.Time
+}
+
+func OAuthCodeID(ctx context.Context, code string) *datastore.Key {
+	return datastore.NewKey(ctx, oAuthCodeKind, code, 0, nil)
+}
+
+// oAuthRequest is a validated authorization request, carried encrypted through the consent screen.
+type oAuthRequest struct {
+	ClientId      string
+	UserId        string
+	RedirectURI   string
+	Scopes        []string
+	State         string
+	CodeChallenge string
+	// Must match the consent cookie, to stop other sites from posting consent for the user.
+	CSRFToken string
+	ExpiresAt time.Time
+}
+
+// oAuthErr is an error as defined by RFC 6749.
+type oAuthErr struct {
+	Code        string
+	Description string
+	Status      int
+}
+
+func (o oAuthErr) Error() string {
+	return fmt.Sprintf("%s: %s", o.Code, o.Description)
+}
+
+func writeOAuthJSON(w ResponseWriter, status int, body interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(body)
+}
+
+func writeOAuthErr(w ResponseWriter, err error) error {
+	oErr, ok := err.(oAuthErr)
+	if !ok {
+		return err
+	}
+	return writeOAuthJSON(w, oErr.Status, map[string]string{
+		"error":             oErr.Code,
+		"error_description": oErr.Description,
+	})
+}
+
+func hashSecret(secret string) []byte {
+	hash := sha256.Sum256([]byte(secret))
+	return hash[:]
+}
+
+func getOAuthClient(ctx context.Context, clientId string) (*OAuthClient, error) {
+	client := &OAuthClient{}
+	if err := datastore.Get(ctx, OAuthClientID(ctx, clientId), client); err == datastore.ErrNoSuchEntity {
+		return nil, oAuthErr{"invalid_client", fmt.Sprintf("unknown client %q", clientId), 401}
+	} else if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func createOAuthClient(w ResponseWriter, r Request) (*OAuthClient, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return nil, HTTPErr{"unauthorized", 401}
+	}
+
+	client := &OAuthClient{}
+	if err := Copy(client, r, "POST"); err != nil {
+		return nil, err
+	}
+	if client.Name == "" {
+		return nil, HTTPErr{"clients must have names", 400}
+	}
+	if len(client.RedirectURIs) == 0 {
+		return nil, HTTPErr{"clients must have redirect URIs", 400}
+	}
+	for _, redirectURI := range client.RedirectURIs {
+		parsed, err := url.Parse(redirectURI)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" || parsed.Fragment != "" {
+			return nil, HTTPErr{fmt.Sprintf("%q is not an absolute URI without fragment", redirectURI), 400}
+		}
+	}
+
+	var err error
+	if client.Id, err = newUserId(); err != nil {
+		return nil, err
+	}
+	// Public clients can't keep secrets, so giving them one would only make them look authenticated.
+	if !client.Public {
+		if client.Secret, err = newUserId(); err != nil {
+			return nil, err
+		}
+		client.SecretHash = hashSecret(client.Secret)
+	}
+	client.OwnerId = user.Id
+	client.CreatedAt = time.Now()
+
+	if _, err := datastore.Put(ctx, client.ID(ctx), client); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func loadOAuthClient(w ResponseWriter, r Request) (*OAuthClient, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	if _, ok := r.Values()["user"].(*User); !ok {
+		return nil, HTTPErr{"unauthorized", 401}
+	}
+
+	client := &OAuthClient{}
+	if err := datastore.Get(ctx, OAuthClientID(ctx, r.Vars()["client_id"]), client); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// revokeClientSessions deletes all sessions created by the client, optionally only those of userId.
+func revokeClientSessions(ctx context.Context, clientId, userId string) error {
+	q := datastore.NewQuery(sessionKind).Filter("ClientId=", clientId).KeysOnly()
+	if userId != "" {
+		q = q.Ancestor(UserID(ctx, userId))
+	}
+	ids, err := q.GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	return datastore.DeleteMulti(ctx, ids)
+}
+
+func deleteOAuthClient(w ResponseWriter, r Request) (*OAuthClient, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return nil, HTTPErr{"unauthorized", 401}
+	}
+
+	client := &OAuthClient{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		clientID := OAuthClientID(ctx, r.Vars()["client_id"])
+		if err := datastore.Get(ctx, clientID, client); err != nil {
+			return err
+		}
+		if client.OwnerId != user.Id {
+			return HTTPErr{"can only delete your own clients", 403}
+		}
+		return datastore.Delete(ctx, clientID)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+
+	grantIDs, err := datastore.NewQuery(oAuthGrantKind).Filter("ClientId=", client.Id).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := datastore.DeleteMulti(ctx, grantIDs); err != nil {
+		return nil, err
+	}
+	if err := revokeClientSessions(ctx, client.Id, ""); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func listOAuthClients(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only list your own clients", 403}
+	}
+
+	clients := OAuthClients{}
+	if _, err := datastore.NewQuery(oAuthClientKind).Filter("OwnerId=", user.Id).GetAll(ctx, &clients); err != nil {
+		return err
+	}
+
+	w.SetContent(clients.Item(r, user.Id))
+	return nil
+}
+
+func listOAuthGrants(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only list your own authorized frontends", 403}
+	}
+
+	grants := OAuthGrants{}
+	if _, err := datastore.NewQuery(oAuthGrantKind).Ancestor(UserID(ctx, user.Id)).GetAll(ctx, &grants); err != nil {
+		return err
+	}
+
+	w.SetContent(grants.Item(r, user.Id))
+	return nil
+}
+
+func deleteOAuthGrant(w ResponseWriter, r Request) (*OAuthGrant, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return nil, HTTPErr{"unauthorized", 401}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return nil, HTTPErr{"can only revoke your own authorized frontends", 403}
+	}
+
+	grant := &OAuthGrant{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		grantID := OAuthGrantID(ctx, user.Id, r.Vars()["client_id"])
+		if err := datastore.Get(ctx, grantID, grant); err != nil {
+			return err
+		}
+		return datastore.Delete(ctx, grantID)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+
+	if err := revokeClientSessions(ctx, grant.ClientId, user.Id); err != nil {
+		return nil, err
+	}
+
+	return grant, nil
+}
+
+// redirectWithCode creates an authorization code for the request and redirects the user agent back to the client with it.
+func redirectWithCode(ctx context.Context, w http.ResponseWriter, r *http.Request, req *oAuthRequest) error {
+	code, err := newUserId()
+	if err != nil {
+		return err
+	}
+	oAuthCode := &OAuthCode{
+		ClientId:      req.ClientId,
+		UserId:        req.UserId,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        req.Scopes,
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     time.Now().Add(oAuthCodeValidity),
+	}
+	if _, err := datastore.Put(ctx, OAuthCodeID(ctx, code), oAuthCode); err != nil {
+		return err
+	}
+	// Codes that never got exchanged are left behind, so clean them up as new ones are created.
+	expiredIDs, err := datastore.NewQuery(oAuthCodeKind).Filter("ExpiresAt <", time.Now()).KeysOnly().Limit(maxExpiredOAuthCodes).GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := datastore.DeleteMulti(ctx, expiredIDs); err != nil {
+		return err
+	}
+
+	redirectURL, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		return err
+	}
+	q := redirectURL.Query()
+	q.Set("code", code)
+	if req.State != "" {
+		q.Set("state", req.State)
+	}
+	redirectURL.RawQuery = q.Encode()
+
+	http.Redirect(w, r, redirectURL.String(), 303)
+	return nil
+}
+
+func handleOAuthAuthorize(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	query := r.Req().URL.Query()
+
+	client, err := getOAuthClient(ctx, query.Get("client_id"))
+	if err != nil {
+		return HTTPErr{err.Error(), 400}
+	}
+	// Never redirect to unregistered URIs, not even with errors.
+	redirectURI := query.Get("redirect_uri")
+	if !client.allowsRedirect(redirectURI) {
+		return HTTPErr{fmt.Sprintf("%q is not a registered redirect URI of %q", redirectURI, client.Name), 400}
+	}
+
+	redirectErr := func(code, desc string) error {
+		redirectURL, err := url.Parse(redirectURI)
+		if err != nil {
+			return err
+		}
+		q := redirectURL.Query()
+		q.Set("error", code)
+		q.Set("error_description", desc)
+		if state := query.Get("state"); state != "" {
+			q.Set("state", state)
+		}
+		redirectURL.RawQuery = q.Encode()
+		http.Redirect(w, r.Req(), redirectURL.String(), 303)
+		return nil
+	}
+
+	if query.Get("response_type") != "code" {
+		return redirectErr("unsupported_response_type", "only the code response type is supported")
+	}
+	if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != pkceS256ChallengeType {
+		return redirectErr("invalid_request", "PKCE with the S256 code challenge method is required")
+	}
+	scopes := strings.Fields(query.Get("scope"))
+	if len(scopes) == 0 {
+		return redirectErr("invalid_scope", "at least one scope is required")
+	}
+	if err := validateScopes(scopes); err != nil {
+		return redirectErr("invalid_scope", err.Error())
+	}
+
+	// Unauthenticated HTML requests get redirected to the login by loginRedirect, and come back here afterwards.
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	csrfToken, err := newUserId()
+	if err != nil {
+		return err
+	}
+	req := &oAuthRequest{
+		ClientId:      client.Id,
+		UserId:        user.Id,
+		RedirectURI:   redirectURI,
+		Scopes:        scopes,
+		State:         query.Get("state"),
+		CodeChallenge: query.Get("code_challenge"),
+		CSRFToken:     csrfToken,
+		ExpiresAt:     time.Now().Add(oAuthConsentValidity),
+	}
+
+	grant := &OAuthGrant{}
+	if err := datastore.Get(ctx, OAuthGrantID(ctx, user.Id, client.Id), grant); err == nil && grant.covers(scopes) {
+		return redirectWithCode(ctx, w, r.Req(), req)
+	} else if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	cipher, err := EncodeString(ctx, string(b))
+	if err != nil {
+		return err
+	}
+	consentURL, err := router.Get(OAuthConsentRoute).URL()
+	if err != nil {
+		return err
+	}
+	// The consent is posted by the same user, so it needs the same token.
+	if token := query.Get("token"); token != "" {
+		consentURL.RawQuery = url.Values{"token": []string{token}}.Encode()
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oAuthCSRFCookie,
+		Value:    csrfToken,
+		Path:     consentURL.Path,
+		Expires:  req.ExpiresAt,
+		Secure:   r.Req().TLS != nil,
+		HttpOnly: true,
+	})
+
+	scopeList := []string{}
+	for _, scope := range scopes {
+		scopeList = append(scopeList, fmt.Sprintf("<li>%s</li>", html.EscapeString(scopeDescriptions[scope])))
+	}
+	renderMessage(w, "Consent requested", fmt.Sprintf(`%s wants to act on your behalf, and to be able to:
+<ul>%s</ul>
+Is this OK? You can revoke this later.</br>
+<form method="POST" action="%s"><input type="hidden" name="consent" value="%s"><input type="submit" value="Yes"/></form>
+<form method="GET" action="%s"><input type="hidden" name="error" value="access_denied"><input type="hidden" name="state" value="%s"><input type="submit" value="No"/></form>`,
+		html.EscapeString(client.Name), strings.Join(scopeList, ""), html.EscapeString(consentURL.String()), cipher, html.EscapeString(redirectURI), html.EscapeString(req.State)))
+	return nil
+}
+
+func handleOAuthConsent(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	plain, err := DecodeString(ctx, r.Req().PostFormValue("consent"))
+	if err != nil {
+		return err
+	}
+	req := &oAuthRequest{}
+	if err := json.Unmarshal([]byte(plain), req); err != nil {
+		return err
+	}
+	if req.ExpiresAt.Before(time.Now()) {
+		return HTTPErr{"consent request timed out", 412}
+	}
+	if req.UserId != user.Id {
+		return HTTPErr{"can only consent to your own authorization requests", 403}
+	}
+	cookie, err := r.Req().Cookie(oAuthCSRFCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(req.CSRFToken)) != 1 {
+		return HTTPErr{"consent not posted from the consent screen", 403}
+	}
+
+	client, err := getOAuthClient(ctx, req.ClientId)
+	if err != nil {
+		return HTTPErr{err.Error(), 400}
+	}
+
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		grant := &OAuthGrant{}
+		grantID := OAuthGrantID(ctx, req.UserId, req.ClientId)
+		if err := datastore.Get(ctx, grantID, grant); err == datastore.ErrNoSuchEntity {
+			grant = &OAuthGrant{
+				UserId:    req.UserId,
+				ClientId:  req.ClientId,
+				CreatedAt: time.Now(),
+			}
+		} else if err != nil {
+			return err
+		}
+		grant.ClientName = client.Name
+		for _, scope := range req.Scopes {
+			if !grant.covers([]string{scope}) {
+				grant.Scopes = append(grant.Scopes, scope)
+			}
+		}
+		_, err := datastore.Put(ctx, grantID, grant)
+		return err
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return err
+	}
+
+	log.Infof(ctx, "%q authorized %q with %+v", req.UserId, client.Name, req.Scopes)
+
+	return redirectWithCode(ctx, w, r.Req(), req)
+}
+
+type oAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// issueTokens rotates the refresh token of the session, and returns new tokens for it.
+// Disabled users get no tokens, since their sessions are only revoked when they get disabled.
+func issueTokens(ctx context.Context, session *Session) (*oAuthTokenResponse, error) {
+	if disabled, err := IsDisabled(ctx, session.UserId); err != nil {
+		return nil, err
+	} else if disabled {
+		return nil, oAuthErr{"invalid_grant", "account disabled", 400}
+	}
+
+	user := &User{}
+	if err := datastore.Get(ctx, UserID(ctx, session.UserId), user); err != nil {
+		return nil, err
+	}
+
+	refreshSecret, err := newUserId()
+	if err != nil {
+		return nil, err
+	}
+	session.RefreshHash = hashSecret(refreshSecret)
+	session.LastUsedAt = time.Now()
+	session.ValidUntil = time.Now().Add(oAuthRefreshValidity)
+	if _, err := datastore.Put(ctx, session.ID(ctx), session); err != nil {
+		return nil, err
+	}
+
+	accessToken, err := session.encodeToken(ctx, user, time.Now().Add(oAuthAccessValidity))
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := EncodeString(ctx, strings.Join([]string{session.UserId, session.Id, refreshSecret}, ","))
+	if err != nil {
+		return nil, err
+	}
+	return &oAuthTokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(oAuthAccessValidity / time.Second),
+		RefreshToken: refreshToken,
+		Scope:        strings.Join(session.Scopes, " "),
+	}, nil
+}
+
+func exchangeOAuthCode(ctx context.Context, r *http.Request, client *OAuthClient) (*oAuthTokenResponse, error) {
+	invalidGrant := oAuthErr{"invalid_grant", "invalid, expired or already used authorization code", 400}
+
+	oAuthCode := &OAuthCode{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		codeID := OAuthCodeID(ctx, r.PostFormValue("code"))
+		if err := datastore.Get(ctx, codeID, oAuthCode); err == datastore.ErrNoSuchEntity {
+			return invalidGrant
+		} else if err != nil {
+			return err
+		}
+		return datastore.Delete(ctx, codeID)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+
+	if oAuthCode.ExpiresAt.Before(time.Now()) || oAuthCode.ClientId != client.Id || oAuthCode.RedirectURI != r.PostFormValue("redirect_uri") {
+		return nil, invalidGrant
+	}
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != oAuthCode.CodeChallenge {
+		return nil, oAuthErr{"invalid_grant", "code verifier doesn't match code challenge", 400}
+	}
+
+	sessionId, err := newUserId()
+	if err != nil {
+		return nil, err
+	}
+	return issueTokens(ctx, &Session{
+		Id:        sessionId,
+		UserId:    oAuthCode.UserId,
+		Name:      client.Name,
+		Device:    r.UserAgent(),
+		Scopes:    oAuthCode.Scopes,
+		ClientId:  client.Id,
+		CreatedAt: time.Now(),
+	})
+}
+
+func refreshOAuthToken(ctx context.Context, r *http.Request, client *OAuthClient) (*oAuthTokenResponse, error) {
+	invalidGrant := oAuthErr{"invalid_grant", "invalid, expired or revoked refresh token", 400}
+
+	plain, err := DecodeString(ctx, r.PostFormValue("refresh_token"))
+	if err != nil {
+		return nil, invalidGrant
+	}
+	parts := strings.Split(plain, ",")
+	if len(parts) != 3 {
+		return nil, invalidGrant
+	}
+
+	var resp *oAuthTokenResponse
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		session := &Session{}
+		if err := datastore.Get(ctx, SessionID(ctx, parts[0], parts[1]), session); err == datastore.ErrNoSuchEntity {
+			return invalidGrant
+		} else if err != nil {
+			return err
+		}
+		if session.ClientId != client.Id || session.ValidUntil.Before(time.Now()) || subtle.ConstantTimeCompare(hashSecret(parts[2]), session.RefreshHash) != 1 {
+			return invalidGrant
+		}
+		var err error
+		resp, err = issueTokens(ctx, session)
+		return err
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func handleOAuthToken(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if err := r.Req().ParseForm(); err != nil {
+		return writeOAuthErr(w, oAuthErr{"invalid_request", err.Error(), 400})
+	}
+
+	clientId, clientSecret, hasBasic := r.Req().BasicAuth()
+	if !hasBasic {
+		clientId = r.Req().PostFormValue("client_id")
+		clientSecret = r.Req().PostFormValue("client_secret")
+	}
+	client, err := getOAuthClient(ctx, clientId)
+	if err != nil {
+		return writeOAuthErr(w, err)
+	}
+	if err := client.authenticate(clientSecret); err != nil {
+		return writeOAuthErr(w, err)
+	}
+
+	var resp *oAuthTokenResponse
+	switch grantType := r.Req().PostFormValue("grant_type"); grantType {
+	case "authorization_code":
+		resp, err = exchangeOAuthCode(ctx, r.Req(), client)
+	case "refresh_token":
+		resp, err = refreshOAuthToken(ctx, r.Req(), client)
+	default:
+		err = oAuthErr{"unsupported_grant_type", fmt.Sprintf("unsupported grant type %q", grantType), 400}
+	}
+	if err != nil {
+		return writeOAuthErr(w, err)
+	}
+
+	return writeOAuthJSON(w, 200, resp)
+}
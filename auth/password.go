@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	passwordAccountKind = "PasswordAccount"
+
+	PasswordProvider = "password"
+
+	minPasswordLength    = 8
+	verificationValidity = time.Hour * 24
+)
+
+// SendMail is used to send verification mail to password accounts, and is set by the package owning the mail configuration.
+var SendMail func(ctx context.Context, to, subject, body string) error
+
+// PasswordAccount is a login provider account hosted by ourselves, where the email is the subject.
+type PasswordAccount struct {
+	Email     string
+	UserId    string
+	Hash      []byte `datastore:",noindex"`
+	Verified  bool
+	CreatedAt time.Time
+}
+
+func PasswordAccountID(ctx context.Context, email string) *datastore.Key {
+	return datastore.NewKey(ctx, passwordAccountKind, strings.ToLower(email), 0, nil)
+}
+
+func (p *PasswordAccount) ID(ctx context.Context) *datastore.Key {
+	return PasswordAccountID(ctx, p.Email)
+}
+
+func (p *PasswordAccount) Item(r Request) *Item {
+	return NewItem(p).SetName(p.Email)
+}
+
+type PasswordCredentials struct {
+	Email    string
+	Password string
+	Name     string
+}
+
+func decodePasswordCredentials(r Request) (*PasswordCredentials, error) {
+	creds := &PasswordCredentials{}
+	if err := json.NewDecoder(r.Req().Body).Decode(creds); err != nil {
+		return nil, HTTPErr{fmt.Sprintf("unable to parse credentials: %v", err), 400}
+	}
+	addr, err := mail.ParseAddress(creds.Email)
+	if err != nil {
+		return nil, HTTPErr{fmt.Sprintf("%q is not an email address", creds.Email), 400}
+	}
+	creds.Email = strings.ToLower(addr.Address)
+	return creds, nil
+}
+
+// sendVerification mails a link verifying the account to its email.
+func (p *PasswordAccount) sendVerification(ctx context.Context, r *http.Request) error {
+	if SendMail == nil {
+		return fmt.Errorf("no mail sender configured")
+	}
+	token, err := EncodeString(ctx, fmt.Sprintf("%d,%s", time.Now().Add(verificationValidity).Unix(), p.Email))
+	if err != nil {
+		return err
+	}
+	verifyURL, err := router.Get(PasswordVerifyRoute).URL()
+	if err != nil {
+		return err
+	}
+	verifyURL.Host = r.Host
+	if r.TLS == nil {
+		verifyURL.Scheme = "http"
+	} else {
+		verifyURL.Scheme = "https"
+	}
+	verifyURL.RawQuery = "t=" + token
+	return SendMail(ctx, p.Email, "Verify your diplicity account", fmt.Sprintf("Visit %s within %v to verify your diplicity account.", verifyURL.String(), verificationValidity))
+}
+
+func handlePasswordRegister(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	creds, err := decodePasswordCredentials(r)
+	if err != nil {
+		return err
+	}
+	if len(creds.Password) < minPasswordLength {
+		return HTTPErr{fmt.Sprintf("passwords must be at least %d characters long", minPasswordLength), 400}
+	}
+
+	// Authenticated users registering password accounts link them to themselves.
+	linkUserId := ""
+	if user, ok := r.Values()["user"].(*User); ok {
+		linkUserId = user.Id
+	}
+	newId, err := newUserId()
+	if err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	account := &PasswordAccount{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := datastore.Get(ctx, PasswordAccountID(ctx, creds.Email), account); err == nil {
+			// Unverified accounts expire with their first verification, so that nobody can hold on to an email they don't own.
+			if account.Verified || time.Now().Sub(account.CreatedAt) < verificationValidity {
+				// Registering an unverified account again with the right password resends the verification.
+				if account.Verified || bcrypt.CompareHashAndPassword(account.Hash, []byte(creds.Password)) != nil {
+					return HTTPErr{fmt.Sprintf("%q is already registered", creds.Email), 409}
+				}
+				return nil
+			}
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		userId := linkUserId
+		if userId == "" {
+			userId = newId
+			user := &User{
+				Id:    userId,
+				Email: creds.Email,
+				Name:  creds.Name,
+			}
+			if _, err := datastore.Put(ctx, UserID(ctx, userId), user); err != nil {
+				return err
+			}
+		}
+		*account = PasswordAccount{
+			Email:     creds.Email,
+			UserId:    userId,
+			Hash:      hash,
+			CreatedAt: time.Now(),
+		}
+		identity := &Identity{
+			Provider:  PasswordProvider,
+			Subject:   creds.Email,
+			UserId:    userId,
+			Email:     creds.Email,
+			CreatedAt: time.Now(),
+		}
+		_, err := datastore.PutMulti(ctx, []*datastore.Key{account.ID(ctx), identity.ID(ctx)}, []interface{}{account, identity})
+		return err
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		return err
+	}
+
+	if err := account.sendVerification(ctx, r.Req()); err != nil {
+		log.Errorf(ctx, "Unable to send verification mail to %q: %v; register again to retry", account.Email, err)
+		return err
+	}
+
+	w.SetContent(account.Item(r))
+	return nil
+}
+
+func handlePasswordVerify(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	plain, err := DecodeString(ctx, r.Req().URL.Query().Get("t"))
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(plain, ",", 2)
+	if len(parts) != 2 {
+		return HTTPErr{"malformed verification token", 400}
+	}
+	validUntil, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return HTTPErr{"malformed verification token", 400}
+	}
+	if time.Unix(validUntil, 0).Before(time.Now()) {
+		return HTTPErr{"verification token timed out, register again to get a new one", 412}
+	}
+
+	account := &PasswordAccount{}
+	user := &User{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := datastore.Get(ctx, PasswordAccountID(ctx, parts[1]), account); err != nil {
+			return err
+		}
+		// Tokens sent before the account was registered belong to an expired registration of the same email.
+		if validUntil-int64(verificationValidity/time.Second) < account.CreatedAt.Unix() {
+			return HTTPErr{"verification token belongs to an expired registration, register again to get a new one", 412}
+		}
+		if err := datastore.Get(ctx, UserID(ctx, account.UserId), user); err != nil {
+			return err
+		}
+		account.Verified = true
+		if user.Email == account.Email {
+			user.VerifiedEmail = true
+		}
+		_, err := datastore.PutMulti(ctx, []*datastore.Key{account.ID(ctx), UserID(ctx, account.UserId)}, []interface{}{account, user})
+		return err
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		return err
+	}
+
+	renderMessage(w, "Verified", fmt.Sprintf("%v is now verified, and can be used to log in to diplicity.", account.Email))
+	return nil
+}
+
+type PasswordLogin struct {
+	Token string
+	User  *User
+}
+
+func (p *PasswordLogin) Item(r Request) *Item {
+	return NewItem(p).SetName("password-login")
+}
+
+func handlePasswordLogin(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	creds, err := decodePasswordCredentials(r)
+	if err != nil {
+		return err
+	}
+
+	wrongCredentials := HTTPErr{"wrong email or password", 401}
+
+	account := &PasswordAccount{}
+	if err := datastore.Get(ctx, PasswordAccountID(ctx, creds.Email), account); err == datastore.ErrNoSuchEntity {
+		return wrongCredentials
+	} else if err != nil {
+		return err
+	}
+	if bcrypt.CompareHashAndPassword(account.Hash, []byte(creds.Password)) != nil {
+		return wrongCredentials
+	}
+	if !account.Verified {
+		return HTTPErr{fmt.Sprintf("%q is not verified yet", account.Email), 403}
+	}
+
+	user, err := resolveIdentity(ctx, &ExternalIdentity{
+		Provider: PasswordProvider,
+		Subject:  account.Email,
+		Email:    account.Email,
+	}, "")
+	if err != nil {
+		return err
+	}
+
+	session, err := newSession(ctx, r.Req(), user, "password login", false, loginSessionValidity, nil)
+	if err != nil {
+		return err
+	}
+
+	w.SetContent((&PasswordLogin{
+		Token: session.Token,
+		User:  user,
+	}).Item(r))
+	return nil
+}
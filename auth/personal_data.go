@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	maxDeleteMulti = 500
+)
+
+// PersonalData is everything the auth package stores about a user.
+type PersonalData struct {
+	User           *User
+	Profile        *Profile
+	UserConfig     *UserConfig
+	RedirectURLs   []RedirectURL
+	Identities     []Identity
+	PasswordLogins []string
+	Sessions       []Session
+	OAuthGrants    []OAuthGrant
+}
+
+// LoadPersonalData loads everything the auth package stores about the user, without any secrets.
+// Webhook secrets and FCM replace tokens are blanked, since whoever gets hold of the archive could use them.
+func LoadPersonalData(ctx context.Context, userId string) (*PersonalData, error) {
+	data := &PersonalData{
+		User:       &User{},
+		Profile:    &Profile{},
+		UserConfig: &UserConfig{},
+	}
+	userID := UserID(ctx, userId)
+	if err := datastore.Get(ctx, userID, data.User); err == datastore.ErrNoSuchEntity {
+		data.User = nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := datastore.Get(ctx, ProfileID(ctx, userID), data.Profile); err == datastore.ErrNoSuchEntity {
+		data.Profile = nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := datastore.Get(ctx, UserConfigID(ctx, userID), data.UserConfig); err == datastore.ErrNoSuchEntity {
+		data.UserConfig = nil
+	} else if err != nil {
+		return nil, err
+	} else {
+		for i := range data.UserConfig.Webhooks {
+			data.UserConfig.Webhooks[i].Secret = ""
+		}
+		for i := range data.UserConfig.FCMTokens {
+			data.UserConfig.FCMTokens[i].ReplaceToken = ""
+		}
+	}
+	if _, err := datastore.NewQuery(redirectURLKind).Filter("UserId=", userId).GetAll(ctx, &data.RedirectURLs); err != nil {
+		return nil, err
+	}
+	if _, err := datastore.NewQuery(identityKind).Filter("UserId=", userId).GetAll(ctx, &data.Identities); err != nil {
+		return nil, err
+	}
+	passwordAccounts := []PasswordAccount{}
+	if _, err := datastore.NewQuery(passwordAccountKind).Filter("UserId=", userId).GetAll(ctx, &passwordAccounts); err != nil {
+		return nil, err
+	}
+	for _, account := range passwordAccounts {
+		data.PasswordLogins = append(data.PasswordLogins, account.Email)
+	}
+	if _, err := datastore.NewQuery(sessionKind).Ancestor(userID).GetAll(ctx, &data.Sessions); err != nil {
+		return nil, err
+	}
+	if _, err := datastore.NewQuery(oAuthGrantKind).Ancestor(userID).GetAll(ctx, &data.OAuthGrants); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// AnonymousUserId returns the id replacing userId where the user has to remain after being deleted.
+// It's an HMAC of the user id, so that retried deletions use the same id without revealing the deleted user.
+func AnonymousUserId(ctx context.Context, userId string) (string, error) {
+	nacl, err := getNaCl(ctx)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, nacl.Secret)
+	mac.Write([]byte(userId))
+	return fmt.Sprintf("deleted-%s", hex.EncodeToString(mac.Sum(nil)[:16])), nil
+}
+
+// DeletePersonalData deletes the user and everything the auth package stores about the user.
+// Everything stored with the user as ancestor, in any package, is deleted as well.
+// The user stays disabled, and the Google identity named after the user is kept without user, so that logging in with it again
+// creates a new user instead of bringing the deleted one back.
+func DeletePersonalData(ctx context.Context, userId string) error {
+	userID := UserID(ctx, userId)
+	ids, err := datastore.NewQuery("").Ancestor(userID).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, kind := range []string{redirectURLKind, identityKind, passwordAccountKind, profileNameKind} {
+		kindIDs, err := datastore.NewQuery(kind).Filter("UserId=", userId).KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, kindIDs...)
+	}
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > maxDeleteMulti {
+			batch = batch[:maxDeleteMulti]
+		}
+		if err := datastore.DeleteMulti(ctx, batch); err != nil {
+			return err
+		}
+		ids = ids[len(batch):]
+	}
+	tombstone := &Identity{
+		Provider:  GoogleProvider,
+		Subject:   userId,
+		CreatedAt: time.Now(),
+	}
+	_, err = datastore.Put(ctx, tombstone.ID(ctx), tombstone)
+	return err
+}
@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	profileKind     = "Profile"
+	profileNameKind = "ProfileName"
+
+	maxDisplayNameLength = 32
+	maxBioLength         = 1024
+	anonymousName        = "Anonymous"
+)
+
+var (
+	countryReg = regexp.MustCompile("^[A-Z]{2}$")
+)
+
+var ProfileResource = &Resource{
+	Load:     Scoped(ReadGamesScope, loadProfile),
+	Update:   Scoped(ManageConfigScope, updateProfile),
+	FullPath: "/User/{user_id}/Profile",
+}
+
+// Profile contains the user editable parts of a user, presented instead of the ones fetched from Google.
+type Profile struct {
+	UserId       string
+	DisplayName  string `methods:"PUT"`
+	Bio          string `methods:"PUT" datastore:",noindex"`
+	AvatarURL    string `methods:"PUT" datastore:",noindex"`
+	TimeZone     string `methods:"PUT"`
+	Country      string `methods:"PUT"`
+	HideRealName bool   `methods:"PUT"`
+}
+
+// ProfileName reserves a display name for a user, to keep display names unique.
+type ProfileName struct {
+	UserId string
+}
+
+func ProfileID(ctx context.Context, userID *datastore.Key) *datastore.Key {
+	return datastore.NewKey(ctx, profileKind, "profile", 0, userID)
+}
+
+func (p *Profile) ID(ctx context.Context) *datastore.Key {
+	return ProfileID(ctx, UserID(ctx, p.UserId))
+}
+
+func ProfileNameID(ctx context.Context, displayName string) *datastore.Key {
+	return datastore.NewKey(ctx, profileNameKind, strings.ToLower(displayName), 0, nil)
+}
+
+func (p *Profile) Item(r Request) *Item {
+	profileItem := NewItem(p).SetName("profile").
+		AddLink(r.NewLink(ProfileResource.Link("self", Load, []string{"user_id", p.UserId})))
+	if user, ok := r.Values()["user"].(*User); ok && user.Id == p.UserId {
+		profileItem.AddLink(r.NewLink(ProfileResource.Link("update", Update, []string{"user_id", p.UserId})))
+	}
+	return profileItem.SetDesc([][]string{
+		[]string{
+			"Profile",
+			"The profile of a user replaces the name and picture fetched from Google wherever the user is shown.",
+			"Display names are unique, ignoring case, and at most 32 characters long.",
+			"The avatar URL must be an http or https URL, the time zone a IANA time zone name like `Europe/Stockholm`, and the country an ISO 3166-1 alpha-2 code like `SE`.",
+			"Setting `HideRealName` hides the Google name of the user everywhere the user is shown.",
+		},
+	})
+}
+
+func (p *Profile) Validate() error {
+	p.DisplayName = strings.TrimSpace(p.DisplayName)
+	if utf8.RuneCountInString(p.DisplayName) > maxDisplayNameLength {
+		return HTTPErr{fmt.Sprintf("display names can be at most %d characters long", maxDisplayNameLength), 400}
+	}
+	if utf8.RuneCountInString(p.Bio) > maxBioLength {
+		return HTTPErr{fmt.Sprintf("bios can be at most %d characters long", maxBioLength), 400}
+	}
+	if p.AvatarURL != "" {
+		avatarURL, err := url.Parse(p.AvatarURL)
+		if err != nil || (avatarURL.Scheme != "http" && avatarURL.Scheme != "https") || avatarURL.Host == "" {
+			return HTTPErr{fmt.Sprintf("%q is not an http or https URL", p.AvatarURL), 400}
+		}
+	}
+	if p.TimeZone != "" {
+		if _, err := time.LoadLocation(p.TimeZone); err != nil {
+			return HTTPErr{fmt.Sprintf("unknown time zone %q", p.TimeZone), 400}
+		}
+	}
+	if p.Country != "" && !countryReg.MatchString(p.Country) {
+		return HTTPErr{fmt.Sprintf("%q is not an ISO 3166-1 alpha-2 country code", p.Country), 400}
+	}
+	return nil
+}
+
+// Apply replaces the Google provided details of u with the ones in the profile.
+func (p *Profile) Apply(u *User) {
+	if p.HideRealName {
+		u.Name = anonymousName
+		u.GivenName = ""
+		u.FamilyName = ""
+		u.Link = ""
+		u.Gender = ""
+	}
+	if p.DisplayName != "" {
+		u.Name = p.DisplayName
+	}
+	if p.AvatarURL != "" {
+		u.Picture = p.AvatarURL
+	}
+}
+
+// ApplyProfiles replaces the Google provided details of users with the ones in their profiles, for users that have profiles.
+func ApplyProfiles(ctx context.Context, users []*User) error {
+	if len(users) == 0 {
+		return nil
+	}
+	ids := make([]*datastore.Key, len(users))
+	for i, user := range users {
+		ids[i] = ProfileID(ctx, user.ID(ctx))
+	}
+	profiles := make([]Profile, len(users))
+	err := datastore.GetMulti(ctx, ids, profiles)
+	merr, isMulti := err.(appengine.MultiError)
+	if err != nil && !isMulti {
+		return err
+	}
+	for i := range users {
+		if isMulti && merr[i] != nil {
+			if merr[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return merr[i]
+		}
+		profiles[i].Apply(users[i])
+	}
+	return nil
+}
+
+// GetProfile returns the profile of userId, or an empty profile if the user never created one.
+func GetProfile(ctx context.Context, userId string) (*Profile, error) {
+	profile := &Profile{}
+	if err := datastore.Get(ctx, ProfileID(ctx, UserID(ctx, userId)), profile); err == datastore.ErrNoSuchEntity {
+		profile.UserId = userId
+	} else if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+func loadProfile(w ResponseWriter, r Request) (*Profile, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	_, ok := r.Values()["user"].(*User)
+	if !ok {
+		return nil, HTTPErr{"unauthorized", 401}
+	}
+
+	return GetProfile(ctx, r.Vars()["user_id"])
+}
+
+func updateProfile(w ResponseWriter, r Request) (*Profile, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return nil, HTTPErr{"unauthorized", 401}
+	}
+
+	if user.Id != r.Vars()["user_id"] {
+		return nil, HTTPErr{"can only update your own profile", 403}
+	}
+
+	bodyBytes, err := ioutil.ReadAll(r.Req().Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var profile *Profile
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		oldProfile := &Profile{}
+		if err := datastore.Get(ctx, ProfileID(ctx, UserID(ctx, user.Id)), oldProfile); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		// Start from the old profile, so that fields left out of the request keep their values.
+		profile = &Profile{}
+		*profile = *oldProfile
+		if err := CopyBytes(profile, r, bodyBytes, "PUT"); err != nil {
+			return err
+		}
+		profile.UserId = user.Id
+		if err := profile.Validate(); err != nil {
+			return err
+		}
+		if strings.ToLower(oldProfile.DisplayName) != strings.ToLower(profile.DisplayName) {
+			if profile.DisplayName != "" {
+				profileName := &ProfileName{}
+				if err := datastore.Get(ctx, ProfileNameID(ctx, profile.DisplayName), profileName); err == nil && profileName.UserId != user.Id {
+					return HTTPErr{fmt.Sprintf("display name %q is already taken", profile.DisplayName), 409}
+				} else if err != nil && err != datastore.ErrNoSuchEntity {
+					return err
+				}
+				if _, err := datastore.Put(ctx, ProfileNameID(ctx, profile.DisplayName), &ProfileName{UserId: user.Id}); err != nil {
+					return err
+				}
+			}
+			if oldProfile.DisplayName != "" {
+				if err := datastore.Delete(ctx, ProfileNameID(ctx, oldProfile.DisplayName)); err != nil {
+					return err
+				}
+			}
+		}
+		_, err := datastore.Put(ctx, profile.ID(ctx), profile)
+		return err
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
@@ -0,0 +1,293 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/urlfetch"
+
+	. "github.com/zond/goaeoas"
+	oauth2service "google.golang.org/api/oauth2/v2"
+)
+
+const (
+	oidcProviderKind = "OIDCProvider"
+
+	GoogleProvider = "google"
+)
+
+// ExternalIdentity is what a login provider tells us about the user who just logged in.
+type ExternalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	VerifiedEmail bool
+	Name          string
+	GivenName     string
+	FamilyName    string
+	Picture       string
+	Locale        string
+}
+
+// toUser creates a new user from the identity.
+func (e *ExternalIdentity) toUser(userId string) *User {
+	return &User{
+		Id:            userId,
+		Email:         e.Email,
+		VerifiedEmail: e.VerifiedEmail,
+		Name:          e.Name,
+		GivenName:     e.GivenName,
+		FamilyName:    e.FamilyName,
+		Picture:       e.Picture,
+		Locale:        e.Locale,
+	}
+}
+
+// LoginProvider is an external service users can log in with.
+type LoginProvider interface {
+	// AuthCodeURL returns the URL to send the user to to log in, which will redirect back to the OAuth2 callback with state.
+	AuthCodeURL(ctx context.Context, r *http.Request, state string) (string, error)
+	// Identify exchanges the code in the OAuth2 callback for the identity of the user.
+	Identify(ctx context.Context, r *http.Request) (*ExternalIdentity, error)
+}
+
+func getCallbackURL(r *http.Request) (string, error) {
+	redirectURL, err := router.Get(OAuth2CallbackRoute).URL()
+	if err != nil {
+		return "", err
+	}
+	if r.TLS == nil {
+		redirectURL.Scheme = "http"
+	} else {
+		redirectURL.Scheme = "https"
+	}
+	redirectURL.Host = r.Host
+	return redirectURL.String(), nil
+}
+
+type googleLoginProvider struct{}
+
+func (g googleLoginProvider) AuthCodeURL(ctx context.Context, r *http.Request, state string) (string, error) {
+	conf, err := getOAuth2Config(ctx, r)
+	if err != nil {
+		return "", err
+	}
+	return conf.AuthCodeURL(state), nil
+}
+
+func (g googleLoginProvider) Identify(ctx context.Context, r *http.Request) (*ExternalIdentity, error) {
+	conf, err := getOAuth2Config(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := conf.Exchange(ctx, r.URL.Query().Get("code"))
+	if err != nil {
+		return nil, err
+	}
+
+	client := oauth2.NewClient(ctx, oauth2.StaticTokenSource(token))
+	service, err := oauth2service.New(client)
+	if err != nil {
+		return nil, err
+	}
+	userInfo, err := oauth2service.NewUserinfoService(service).Get().Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	user := infoToUser(userInfo)
+	return &ExternalIdentity{
+		Provider:      GoogleProvider,
+		Subject:       user.Id,
+		Email:         user.Email,
+		VerifiedEmail: user.VerifiedEmail,
+		Name:          user.Name,
+		GivenName:     user.GivenName,
+		FamilyName:    user.FamilyName,
+		Picture:       user.Picture,
+		Locale:        user.Locale,
+	}, nil
+}
+
+// OIDCProvider configures a generic OpenID Connect, or OpenID Connect like, login provider.
+// The user info endpoint is expected to return a JSON object with `sub` or `id`, and optionally
+// `email`, `email_verified`, `name`, `given_name`, `family_name`, `picture` or `avatar_url` and `locale`.
+type OIDCProvider struct {
+	Name        string
+	ClientID    string
+	Secret      string
+	AuthURL     string
+	TokenURL    string
+	UserInfoURL string
+	Scopes      []string
+}
+
+func OIDCProviderID(ctx context.Context, name string) *datastore.Key {
+	return datastore.NewKey(ctx, oidcProviderKind, name, 0, nil)
+}
+
+func SetOIDCProvider(ctx context.Context, provider *OIDCProvider) error {
+	if provider.Name == "" || provider.Name == GoogleProvider || provider.Name == PasswordProvider {
+		return HTTPErr{fmt.Sprintf("invalid provider name %q", provider.Name), 400}
+	}
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		currentProvider := &OIDCProvider{}
+		if err := datastore.Get(ctx, OIDCProviderID(ctx, provider.Name), currentProvider); err == nil {
+			return HTTPErr{fmt.Sprintf("%q already configured", provider.Name), 400}
+		}
+		if _, err := datastore.Put(ctx, OIDCProviderID(ctx, provider.Name), provider); err != nil {
+			return err
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: false})
+}
+
+func (o *OIDCProvider) config(r *http.Request) (*oauth2.Config, error) {
+	callbackURL, err := getCallbackURL(r)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Config{
+		ClientID:     o.ClientID,
+		ClientSecret: o.Secret,
+		RedirectURL:  callbackURL,
+		Scopes:       o.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  o.AuthURL,
+			TokenURL: o.TokenURL,
+		},
+	}, nil
+}
+
+func (o *OIDCProvider) AuthCodeURL(ctx context.Context, r *http.Request, state string) (string, error) {
+	conf, err := o.config(r)
+	if err != nil {
+		return "", err
+	}
+	return conf.AuthCodeURL(state), nil
+}
+
+func (o *OIDCProvider) Identify(ctx context.Context, r *http.Request) (*ExternalIdentity, error) {
+	conf, err := o.config(r)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, urlfetch.Client(ctx))
+	token, err := conf.Exchange(ctx, r.URL.Query().Get("code"))
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", o.UserInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := conf.Client(ctx, token).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%q returned %v", o.UserInfoURL, resp.Status)
+	}
+
+	info := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	str := func(keys ...string) string {
+		for _, key := range keys {
+			switch v := info[key].(type) {
+			case string:
+				if v != "" {
+					return v
+				}
+			case float64:
+				return fmt.Sprintf("%.0f", v)
+			}
+		}
+		return ""
+	}
+
+	identity := &ExternalIdentity{
+		Provider:   o.Name,
+		Subject:    str("sub", "id"),
+		Email:      strings.ToLower(str("email")),
+		Name:       str("name", "login"),
+		GivenName:  str("given_name"),
+		FamilyName: str("family_name"),
+		Picture:    str("picture", "avatar_url"),
+		Locale:     str("locale"),
+	}
+	if verified, ok := info["email_verified"].(bool); ok {
+		identity.VerifiedEmail = verified
+	}
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("%q returned no subject in %+v", o.UserInfoURL, info)
+	}
+	return identity, nil
+}
+
+// getLoginProvider returns the named provider, where the empty name means Google.
+func getLoginProvider(ctx context.Context, name string) (LoginProvider, error) {
+	if name == "" || name == GoogleProvider {
+		return googleLoginProvider{}, nil
+	}
+	provider := &OIDCProvider{}
+	if err := datastore.Get(ctx, OIDCProviderID(ctx, name), provider); err == datastore.ErrNoSuchEntity {
+		return nil, HTTPErr{fmt.Sprintf("unknown login provider %q", name), 404}
+	} else if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+type LoginProviders []string
+
+func (l LoginProviders) Item(r Request) *Item {
+	providerItems := make(List, len(l))
+	for i, name := range l {
+		providerItems[i] = NewItem(name).SetName(name).AddLink(r.NewLink(Link{
+			Rel:         "login",
+			Route:       LoginRoute,
+			QueryParams: url.Values{"provider": []string{name}},
+		}))
+	}
+	return NewItem(providerItems).SetName("login-providers").AddLink(r.NewLink(Link{
+		Rel:   "self",
+		Route: ListLoginProvidersRoute,
+	})).SetDesc([][]string{
+		[]string{
+			"Login providers",
+			"Each provider has a `login` link, which works like the `login` link of the index, including the `redirect-to` query parameter.",
+			"Adding `link=true` to the `login` link of an authenticated user adds the provider identity to that user, instead of logging in as the user owning the identity.",
+			"Email and password accounts are created, verified and logged in to using the `password-register`, `password-verify` and `password-login` routes.",
+		},
+	})
+}
+
+func listLoginProviders(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	keys, err := datastore.NewQuery(oidcProviderKind).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	providers := LoginProviders{GoogleProvider}
+	for _, key := range keys {
+		providers = append(providers, key.StringID())
+	}
+
+	w.SetContent(providers.Item(r))
+	return nil
+}
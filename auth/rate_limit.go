@@ -0,0 +1,334 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	rateLimitsKind = "RateLimits"
+	throttleKind   = "Throttle"
+
+	DefaultRouteClass   = "default"
+	WriteRouteClass     = "write"
+	PressRouteClass     = "press"
+	ExpensiveRouteClass = "expensive"
+
+	// How many times to retry updating a bucket when other requests update it concurrently.
+	rateLimitCASRetries = 3
+	// How often to record that a user is still throttled.
+	throttleLogInterval = time.Minute
+	maxThrottles        = 100
+)
+
+var (
+	// DefaultRateLimits are used until other limits are configured.
+	DefaultRateLimits = &RateLimits{
+		Quotas: []RateQuota{
+			{Class: DefaultRouteClass, Burst: 300, PerMinute: 300},
+			{Class: WriteRouteClass, Burst: 60, PerMinute: 60},
+			{Class: PressRouteClass, Burst: 30, PerMinute: 20},
+			{Class: ExpensiveRouteClass, Burst: 30, PerMinute: 20},
+		},
+	}
+
+	prodRateLimits     *RateLimits
+	prodRateLimitsLock = sync.RWMutex{}
+
+	routeClasses     = map[string]string{}
+	routeClassesLock = sync.RWMutex{}
+)
+
+// RateQuota lets each user make Burst requests to routes of Class at once, refilled by PerMinute requests per minute.
+type RateQuota struct {
+	Class     string
+	Burst     float64
+	PerMinute float64
+}
+
+type RateLimits struct {
+	Quotas []RateQuota
+}
+
+func (r *RateLimits) quota(class string) *RateQuota {
+	for i := range r.Quotas {
+		if r.Quotas[i].Class == class {
+			return &r.Quotas[i]
+		}
+	}
+	return nil
+}
+
+func getRateLimitsKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, rateLimitsKind, prodKey, 0, nil)
+}
+
+func SetRateLimits(ctx context.Context, rateLimits *RateLimits) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		currentRateLimits := &RateLimits{}
+		if err := datastore.Get(ctx, getRateLimitsKey(ctx), currentRateLimits); err == nil {
+			return HTTPErr{"RateLimits already configured", 400}
+		}
+		if _, err := datastore.Put(ctx, getRateLimitsKey(ctx), rateLimits); err != nil {
+			return err
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: false})
+}
+
+func GetRateLimits(ctx context.Context) (*RateLimits, error) {
+	prodRateLimitsLock.RLock()
+	if prodRateLimits != nil {
+		defer prodRateLimitsLock.RUnlock()
+		return prodRateLimits, nil
+	}
+	prodRateLimitsLock.RUnlock()
+	prodRateLimitsLock.Lock()
+	defer prodRateLimitsLock.Unlock()
+	foundRateLimits := &RateLimits{}
+	if err := datastore.Get(ctx, getRateLimitsKey(ctx), foundRateLimits); err == datastore.ErrNoSuchEntity {
+		foundRateLimits = DefaultRateLimits
+	} else if err != nil {
+		return nil, err
+	}
+	prodRateLimits = foundRateLimits
+	return prodRateLimits, nil
+}
+
+// SetRouteClass makes requests to routes count against the quota of class. Routes without class count against the default quota.
+func SetRouteClass(class string, routes ...string) {
+	routeClassesLock.Lock()
+	defer routeClassesLock.Unlock()
+	for _, route := range routes {
+		routeClasses[route] = class
+	}
+}
+
+// bucket is a token bucket, stored in memcache.
+type bucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+// take refills the bucket according to quota, and takes a token from it if possible.
+// It returns how long until the next token is available if the bucket is empty.
+func (b *bucket) take(quota *RateQuota) time.Duration {
+	now := time.Now()
+	b.Tokens = math.Min(quota.Burst, b.Tokens+now.Sub(b.UpdatedAt).Minutes()*quota.PerMinute)
+	b.UpdatedAt = now
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return 0
+	}
+	return time.Duration((1 - b.Tokens) / quota.PerMinute * float64(time.Minute))
+}
+
+// takeToken takes a token from the bucket of the client for quota, and returns how long to wait if none was available.
+func takeToken(ctx context.Context, client string, quota *RateQuota) (time.Duration, error) {
+	key := fmt.Sprintf("rate-limit/%s/%s", quota.Class, client)
+	for i := 0; i < rateLimitCASRetries; i++ {
+		b := &bucket{}
+		item, err := memcache.Get(ctx, key)
+		miss := err == memcache.ErrCacheMiss
+		if miss {
+			b.Tokens = quota.Burst
+			b.UpdatedAt = time.Now()
+			item = &memcache.Item{Key: key}
+		} else if err != nil {
+			return 0, err
+		} else if err := json.Unmarshal(item.Value, b); err != nil {
+			return 0, err
+		}
+		wait := b.take(quota)
+		if wait > 0 {
+			return wait, nil
+		}
+		if item.Value, err = json.Marshal(b); err != nil {
+			return 0, err
+		}
+		// A full bucket stays full, so it doesn't have to outlive the time it takes to refill.
+		item.Expiration = time.Duration(quota.Burst/quota.PerMinute*float64(time.Minute)) + time.Minute
+		if miss {
+			err = memcache.Add(ctx, item)
+		} else {
+			err = memcache.CompareAndSwap(ctx, item)
+		}
+		if err == nil {
+			return 0, nil
+		} else if err != memcache.ErrCASConflict && err != memcache.ErrNotStored {
+			return 0, err
+		}
+	}
+	return 0, fmt.Errorf("too much contention on %q", key)
+}
+
+// Throttle records that a client was recently refused by the rate limiter.
+type Throttle struct {
+	Client           string
+	UserId           string
+	Class            string
+	Route            string
+	At               time.Time
+	ThrottledMinutes int
+}
+
+func ThrottleID(ctx context.Context, client, class string) *datastore.Key {
+	return datastore.NewKey(ctx, throttleKind, fmt.Sprintf("%s/%s", client, class), 0, nil)
+}
+
+func (t *Throttle) Item(r Request) *Item {
+	return NewItem(t).SetName(t.Client)
+}
+
+type Throttles []Throttle
+
+func (t Throttles) Item(r Request) *Item {
+	throttleItems := make(List, len(t))
+	for i := range t {
+		throttleItems[i] = t[i].Item(r)
+	}
+	return NewItem(throttleItems).SetName("throttles").AddLink(r.NewLink(Link{
+		Rel:   "self",
+		Route: ListThrottlesRoute,
+	})).SetDesc([][]string{
+		[]string{
+			"Throttled clients",
+			"The most recently rate limited users, or IP addresses for unauthenticated clients, with how many minutes they have been throttled.",
+		},
+	})
+}
+
+// recordThrottle stores that client got throttled, at most once per throttleLogInterval per client and class.
+func recordThrottle(ctx context.Context, client, userId, class, route string) {
+	if err := memcache.Add(ctx, &memcache.Item{
+		Key:        fmt.Sprintf("throttle-recorded/%s/%s", class, client),
+		Value:      []byte{},
+		Expiration: throttleLogInterval,
+	}); err == memcache.ErrNotStored {
+		return
+	} else if err != nil {
+		log.Warningf(ctx, "Unable to check if throttling of %q was recorded: %v", client, err)
+		return
+	}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		throttle := &Throttle{}
+		throttleID := ThrottleID(ctx, client, class)
+		if err := datastore.Get(ctx, throttleID, throttle); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		throttle.Client = client
+		throttle.UserId = userId
+		throttle.Class = class
+		throttle.Route = route
+		throttle.At = time.Now()
+		throttle.ThrottledMinutes++
+		_, err := datastore.Put(ctx, throttleID, throttle)
+		return err
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		log.Warningf(ctx, "Unable to record throttling of %q: %v", client, err)
+	}
+}
+
+// rateLimitFilter refuses requests from clients that have used up their quota for the class of the route.
+// It fails open, since being unable to limit requests is better than being unable to serve them.
+func rateLimitFilter(w ResponseWriter, r Request) (bool, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	route := mux.CurrentRoute(r.Req())
+	if route == nil {
+		return true, nil
+	}
+	routeClassesLock.RLock()
+	class, found := routeClasses[route.GetName()]
+	routeClassesLock.RUnlock()
+	if !found {
+		class = DefaultRouteClass
+	}
+
+	client := ""
+	userId := ""
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		user, ok = r.Values()[scopedUserKey].(*User)
+	}
+	if ok {
+		superusers, err := GetSuperusers(ctx)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return false, err
+		}
+		if err == nil && superusers.Includes(user.Id) {
+			return true, nil
+		}
+		userId = user.Id
+		client = fmt.Sprintf("user:%s", user.Id)
+	} else {
+		host, _, err := net.SplitHostPort(r.Req().RemoteAddr)
+		if err != nil {
+			host = r.Req().RemoteAddr
+		}
+		client = fmt.Sprintf("ip:%s", host)
+	}
+
+	rateLimits, err := GetRateLimits(ctx)
+	if err != nil {
+		return false, err
+	}
+	quota := rateLimits.quota(class)
+	if quota == nil || quota.PerMinute <= 0 {
+		return true, nil
+	}
+
+	wait, err := takeToken(ctx, client, quota)
+	if err != nil {
+		log.Warningf(ctx, "Unable to rate limit %q: %v", client, err)
+		return true, nil
+	}
+	if wait == 0 {
+		return true, nil
+	}
+
+	recordThrottle(ctx, client, userId, class, route.GetName())
+
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+	return false, HTTPErr{fmt.Sprintf("too many %s requests, retry in %v", class, wait), 429}
+}
+
+func listThrottles(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	superusers, err := GetSuperusers(ctx)
+	if err == datastore.ErrNoSuchEntity {
+		return HTTPErr{"unauthorized", 403}
+	} else if err != nil {
+		return err
+	}
+	if !superusers.Includes(user.Id) {
+		return HTTPErr{"unauthorized", 403}
+	}
+
+	throttles := Throttles{}
+	if _, err := datastore.NewQuery(throttleKind).Order("-At").Limit(maxThrottles).GetAll(ctx, &throttles); err != nil {
+		return err
+	}
+
+	w.SetContent(throttles.Item(r))
+	return nil
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/gorilla/mux"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	ReadGamesScope    = "read-games"
+	ReadPressScope    = "read-press"
+	WriteGamesScope   = "write-games"
+	WriteOrdersScope  = "write-orders"
+	WritePressScope   = "write-press"
+	ManageConfigScope = "manage-config"
+
+	// AnyScope marks handlers that any token may use, whatever its scopes.
+	AnyScope = "any"
+
+	// The token filter keeps the users of scoped tokens here, until a handler accepting one of their scopes makes them the user of the request.
+	scopedUserKey = "scoped-user"
+)
+
+var (
+	Scopes = []string{
+		ReadGamesScope,
+		ReadPressScope,
+		WriteGamesScope,
+		WriteOrdersScope,
+		WritePressScope,
+		ManageConfigScope,
+	}
+)
+
+func validateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		found := false
+		for _, valid := range Scopes {
+			found = found || scope == valid
+		}
+		if !found {
+			return HTTPErr{fmt.Sprintf("unknown scope %q, valid scopes are %+v", scope, Scopes), 400}
+		}
+	}
+	return nil
+}
+
+// useScope makes the user of a scoped token the user of the request, if the token has scope.
+// Requests without scoped tokens are left alone.
+func useScope(r Request, scope string) error {
+	user, ok := r.Values()[scopedUserKey].(*User)
+	if !ok {
+		return nil
+	}
+	if scope != AnyScope {
+		found := false
+		for _, has := range user.Scopes {
+			found = found || has == scope
+		}
+		if !found {
+			routeName := ""
+			if route := mux.CurrentRoute(r.Req()); route != nil {
+				routeName = route.GetName()
+			}
+			return HTTPErr{fmt.Sprintf("token lacks the %q scope required for %q", scope, routeName), 403}
+		}
+	}
+	r.Values()["user"] = user
+	return nil
+}
+
+// ScopedHandler makes handler accept tokens with scope.
+// Handlers that don't declare a scope never see the users of scoped tokens, so routes managing tokens, sessions and identities need full tokens.
+func ScopedHandler(scope string, handler func(ResponseWriter, Request) error) func(ResponseWriter, Request) error {
+	return func(w ResponseWriter, r Request) error {
+		if err := useScope(r, scope); err != nil {
+			return err
+		}
+		return handler(w, r)
+	}
+}
+
+// Scoped makes the Load, Create, Update or Delete function fn of a resource accept tokens with scope, like ScopedHandler.
+func Scoped(scope string, fn interface{}) interface{} {
+	fnVal := reflect.ValueOf(fn)
+	fnType := fnVal.Type()
+	return reflect.MakeFunc(fnType, func(args []reflect.Value) []reflect.Value {
+		if err := useScope(args[1].Interface().(Request), scope); err != nil {
+			results := make([]reflect.Value, fnType.NumOut())
+			for i := range results {
+				results[i] = reflect.Zero(fnType.Out(i))
+			}
+			results[len(results)-1] = reflect.ValueOf(&err).Elem()
+			return results
+		}
+		return fnVal.Call(args)
+	}).Interface()
+}
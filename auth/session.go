@@ -0,0 +1,314 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	sessionKind = "Session"
+
+	loginSessionValidity = time.Hour * 24
+	// Tokens without sessions were all created valid for at most a day, so anything claiming more is forged or broken.
+	legacyTokenValidity = time.Hour * 24
+
+	defaultPersonalTokenDays = 90
+	maxPersonalTokenDays     = 365
+
+	// How old LastUsedAt can get before a request updates it, to avoid writing the session on every request.
+	sessionTouchInterval = time.Hour
+)
+
+var SessionResource *Resource
+
+func init() {
+	SessionResource = &Resource{
+		Create:     createSession,
+		Delete:     deleteSession,
+		CreatePath: "/User/{user_id}/Session",
+		FullPath:   "/User/{user_id}/Session/{session_id}",
+		Listers: []Lister{
+			{
+				Path:    "/User/{user_id}/Sessions",
+				Route:   ListSessionsRoute,
+				Handler: listSessions,
+			},
+		},
+	}
+}
+
+// Session is a logged in device, or a personal access token. Tokens are only accepted while their session exists.
+type Session struct {
+	Id         string
+	UserId     string
+	Name       string `methods:"POST"`
+	Device     string `datastore:",noindex"`
+	Personal   bool
+	Scopes     []string `methods:"POST"`
+	ClientId   string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ValidUntil time.Time
+
+	// ValidDays is the requested validity of new personal access tokens.
+	ValidDays int `methods:"POST" datastore:"-"`
+	// Token is only populated when the session is created.
+	Token string `datastore:"-" json:",omitempty"`
+	// Current is true for the session of the request.
+	Current bool `datastore:"-"`
+	// RefreshHash is the hash of the current refresh token of sessions created by OAuth2 clients.
+	RefreshHash []byte `datastore:",noindex" json:"-"`
+}
+
+func SessionID(ctx context.Context, userId, sessionId string) *datastore.Key {
+	return datastore.NewKey(ctx, sessionKind, sessionId, 0, UserID(ctx, userId))
+}
+
+func (s *Session) ID(ctx context.Context) *datastore.Key {
+	return SessionID(ctx, s.UserId, s.Id)
+}
+
+func (s *Session) Item(r Request) *Item {
+	return NewItem(s).SetName(s.Name).
+		AddLink(r.NewLink(SessionResource.Link("revoke", Delete, []string{"user_id", s.UserId, "session_id", s.Id})))
+}
+
+type Sessions []Session
+
+func (s Sessions) Item(r Request, userId string) *Item {
+	sessionItems := make(List, len(s))
+	for i := range s {
+		sessionItems[i] = s[i].Item(r)
+	}
+	return NewItem(sessionItems).SetName("sessions").AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ListSessionsRoute,
+		RouteParams: []string{"user_id", userId},
+	})).AddLink(r.NewLink(Link{
+		Rel:         "revoke-all",
+		Route:       RevokeSessionsRoute,
+		RouteParams: []string{"user_id", userId},
+		Method:      "POST",
+	})).AddLink(r.NewLink(SessionResource.Link("create-personal-token", Create, []string{"user_id", userId}))).
+		SetDesc([][]string{
+			[]string{
+				"Sessions",
+				"Every login creates a session, and tokens are only valid while their session exists. Revoking a session logs out the device using it.",
+				"`revoke-all` revokes every session, including personal access tokens and the session of the request.",
+			},
+			[]string{
+				"Personal access tokens",
+				fmt.Sprintf("Personal access tokens are named long lived sessions meant for scripts, created by posting `Name` and `ValidDays` (default %d, max %d).", defaultPersonalTokenDays, maxPersonalTokenDays),
+				"The token is only returned when the session is created.",
+			},
+			[]string{
+				"Scopes",
+				fmt.Sprintf("Posting `Scopes` limits what a personal access token can be used for, and the valid scopes are %+v.", Scopes),
+				"Tokens without scopes have full access, and only they can manage sessions, identities and approved frontends.",
+			},
+		})
+}
+
+// newSession creates a session for user, and returns it with a token for it.
+func newSession(ctx context.Context, r *http.Request, user *User, name string, personal bool, validity time.Duration, scopes []string) (*Session, error) {
+	sessionId, err := newUserId()
+	if err != nil {
+		return nil, err
+	}
+	session := &Session{
+		Id:         sessionId,
+		UserId:     user.Id,
+		Name:       name,
+		Device:     r.UserAgent(),
+		Personal:   personal,
+		Scopes:     scopes,
+		CreatedAt:  time.Now(),
+		LastUsedAt: time.Now(),
+		ValidUntil: time.Now().Add(validity),
+	}
+	if _, err := datastore.Put(ctx, session.ID(ctx), session); err != nil {
+		return nil, err
+	}
+
+	if session.Token, err = session.encodeToken(ctx, user, session.ValidUntil); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// encodeToken returns a token for user in this session, valid until validUntil.
+func (s *Session) encodeToken(ctx context.Context, user *User, validUntil time.Time) (string, error) {
+	tokenUser := *user
+	tokenUser.SessionId = s.Id
+	tokenUser.ValidUntil = validUntil
+	tokenUser.Scopes = s.Scopes
+	return EncodeToken(ctx, &tokenUser)
+}
+
+// checkSession returns an error unless the token user belongs to a live session, or is a legacy token without session.
+func checkSession(ctx context.Context, user *User) error {
+	if user.SessionId == "" {
+		if user.ValidUntil.After(time.Now().Add(legacyTokenValidity)) {
+			return HTTPErr{"token without session valid for too long", 401}
+		}
+		// Disabling users revokes their sessions, but tokens without sessions have to be checked.
+		if disabled, err := IsDisabled(ctx, user.Id); err != nil {
+			return err
+		} else if disabled {
+			return HTTPErr{"account disabled", 403}
+		}
+		return nil
+	}
+	session := &Session{}
+	if err := datastore.Get(ctx, SessionID(ctx, user.Id, user.SessionId), session); err == datastore.ErrNoSuchEntity {
+		return HTTPErr{"session revoked", 401}
+	} else if err != nil {
+		return err
+	}
+	if session.ValidUntil.Before(time.Now()) {
+		return HTTPErr{"session timed out", 401}
+	}
+	if time.Now().Sub(session.LastUsedAt) > sessionTouchInterval {
+		if err := touchSession(ctx, session.ID(ctx)); err != nil {
+			log.Warningf(ctx, "Unable to update last use of session %q: %v", session.Id, err)
+		}
+	}
+	return nil
+}
+
+// touchSession updates LastUsedAt of the session, unless it was revoked since it was loaded.
+// It re-reads the session in a transaction, to not bring back revoked sessions or overwrite rotated refresh tokens.
+func touchSession(ctx context.Context, sessionID *datastore.Key) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		session := &Session{}
+		if err := datastore.Get(ctx, sessionID, session); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		session.LastUsedAt = time.Now()
+		_, err := datastore.Put(ctx, sessionID, session)
+		return err
+	}, &datastore.TransactionOptions{XG: false})
+}
+
+func createSession(w ResponseWriter, r Request) (*Session, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return nil, HTTPErr{"unauthorized", 401}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return nil, HTTPErr{"can only create your own personal access tokens", 403}
+	}
+
+	request := &Session{}
+	if err := Copy(request, r, "POST"); err != nil {
+		return nil, err
+	}
+	if request.Name == "" {
+		return nil, HTTPErr{"personal access tokens must have names", 400}
+	}
+	if request.ValidDays == 0 {
+		request.ValidDays = defaultPersonalTokenDays
+	}
+	if request.ValidDays < 0 || request.ValidDays > maxPersonalTokenDays {
+		return nil, HTTPErr{fmt.Sprintf("personal access tokens can be valid for 1 to %d days", maxPersonalTokenDays), 400}
+	}
+	if err := validateScopes(request.Scopes); err != nil {
+		return nil, err
+	}
+
+	return newSession(ctx, r.Req(), user, request.Name, true, time.Duration(request.ValidDays)*time.Hour*24, request.Scopes)
+}
+
+func deleteSession(w ResponseWriter, r Request) (*Session, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return nil, HTTPErr{"unauthorized", 401}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return nil, HTTPErr{"can only revoke your own sessions", 403}
+	}
+
+	session := &Session{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		sessionID := SessionID(ctx, user.Id, r.Vars()["session_id"])
+		if err := datastore.Get(ctx, sessionID, session); err != nil {
+			return err
+		}
+		return datastore.Delete(ctx, sessionID)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func listSessions(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only list your own sessions", 403}
+	}
+
+	found := Sessions{}
+	if _, err := datastore.NewQuery(sessionKind).Ancestor(UserID(ctx, user.Id)).GetAll(ctx, &found); err != nil {
+		return err
+	}
+	sessions := Sessions{}
+	for _, session := range found {
+		if session.ValidUntil.Before(time.Now()) {
+			continue
+		}
+		session.Current = session.Id == user.SessionId
+		sessions = append(sessions, session)
+	}
+
+	w.SetContent(sessions.Item(r, user.Id))
+	return nil
+}
+
+func revokeSessions(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*User)
+	if !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only revoke your own sessions", 403}
+	}
+
+	ids, err := datastore.NewQuery(sessionKind).Ancestor(UserID(ctx, user.Id)).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := datastore.DeleteMulti(ctx, ids); err != nil {
+		return err
+	}
+
+	log.Infof(ctx, "Revoked %v sessions of %q", len(ids), user.Id)
+
+	w.SetContent(Sessions{}.Item(r, user.Id))
+	return nil
+}
@@ -1,6 +1,10 @@
 package auth
 
 import (
+	"fmt"
+	"net/url"
+	"time"
+
 	"github.com/aymerick/raymond"
 	"github.com/zond/go-fcm"
 	"golang.org/x/net/context"
@@ -121,13 +125,14 @@ func (m *MailNotificationConfig) Customize(ctx context.Context, msg *sendgrid.SG
 }
 
 type FCMToken struct {
-	Value         string                `methods:"PUT"`
-	Disabled      bool                  `methods:"PUT"`
-	Note          string                `methods:"PUT" datastore:",noindex"`
-	App           string                `methods:"PUT"`
-	MessageConfig FCMNotificationConfig `methods:"PUT"`
-	PhaseConfig   FCMNotificationConfig `methods:"PUT"`
-	ReplaceToken  string                `methods:"PUT"`
+	Value          string                `methods:"PUT"`
+	Disabled       bool                  `methods:"PUT"`
+	Note           string                `methods:"PUT" datastore:",noindex"`
+	App            string                `methods:"PUT"`
+	MessageConfig  FCMNotificationConfig `methods:"PUT"`
+	PhaseConfig    FCMNotificationConfig `methods:"PUT"`
+	ReminderConfig FCMNotificationConfig `methods:"PUT"`
+	ReplaceToken   string                `methods:"PUT"`
 }
 
 type UnsubscribeConfig struct {
@@ -149,14 +154,46 @@ func (u *UnsubscribeConfig) Validate() error {
 	return nil
 }
 
+// How often message notifications are mailed. Immediate mode sends one mail per message, the others collect them into digests.
+const (
+	ImmediateDigestMode = ""
+	HourlyDigestMode    = "hourly"
+	DailyDigestMode     = "daily"
+)
+
 type MailConfig struct {
 	Enabled           bool                   `methods:"PUT"`
 	UnsubscribeConfig UnsubscribeConfig      `methods:"PUT"`
 	MessageConfig     MailNotificationConfig `methods:"PUT"`
 	PhaseConfig       MailNotificationConfig `methods:"PUT"`
+	ReminderConfig    MailNotificationConfig `methods:"PUT"`
+	DigestMode        string                 `methods:"PUT"`
+	DigestConfig      MailNotificationConfig `methods:"PUT"`
+}
+
+// DigestInterval returns how long message notifications are collected before they are mailed.
+func (m *MailConfig) DigestInterval() time.Duration {
+	switch m.DigestMode {
+	case HourlyDigestMode:
+		return time.Hour
+	case DailyDigestMode:
+		return time.Hour * 24
+	}
+	return 0
 }
 
 func (m *MailConfig) Validate() error {
+	switch m.DigestMode {
+	case ImmediateDigestMode, HourlyDigestMode, DailyDigestMode:
+	default:
+		return HTTPErr{fmt.Sprintf("unknown digest mode %q, use %q, %q or %q", m.DigestMode, ImmediateDigestMode, HourlyDigestMode, DailyDigestMode), 400}
+	}
+	if err := m.DigestConfig.Validate(); err != nil {
+		return err
+	}
+	if err := m.ReminderConfig.Validate(); err != nil {
+		return err
+	}
 	if err := m.MessageConfig.Validate(); err != nil {
 		return err
 	}
@@ -169,15 +206,120 @@ func (m *MailConfig) Validate() error {
 	return nil
 }
 
+// Events webhooks can subscribe to.
+const (
+	PhaseWebhookEvent     = "phase"
+	MessageWebhookEvent   = "message"
+	GameStartWebhookEvent = "game-start"
+	GameEndWebhookEvent   = "game-end"
+)
+
+type Webhook struct {
+	URL      string   `methods:"PUT"`
+	Secret   string   `methods:"PUT" datastore:",noindex"`
+	Events   []string `methods:"PUT"`
+	Disabled bool     `methods:"PUT"`
+	Note     string   `methods:"PUT" datastore:",noindex"`
+	Failures int
+}
+
+// Wants returns whether the webhook subscribes to the event. Webhooks without events subscribe to all of them.
+func (w *Webhook) Wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, wanted := range w.Events {
+		if wanted == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return HTTPErr{fmt.Sprintf("webhook URL %q is not an absolute HTTPS URL", w.URL), 400}
+	}
+	if w.Secret == "" {
+		return HTTPErr{fmt.Sprintf("webhook %q has no secret", w.URL), 400}
+	}
+	for _, event := range w.Events {
+		switch event {
+		case PhaseWebhookEvent, MessageWebhookEvent, GameStartWebhookEvent, GameEndWebhookEvent:
+		default:
+			return HTTPErr{fmt.Sprintf("unknown webhook event %q, use %q, %q, %q or %q", event, PhaseWebhookEvent, MessageWebhookEvent, GameStartWebhookEvent, GameEndWebhookEvent), 400}
+		}
+	}
+	return nil
+}
+
+// QuietHours is a daily period, in the time zone of the user profile, during which non urgent notifications are held back.
+type QuietHours struct {
+	Enabled   bool `methods:"PUT"`
+	StartHour int  `methods:"PUT"`
+	EndHour   int  `methods:"PUT"`
+}
+
+func (q *QuietHours) Validate() error {
+	if q.StartHour < 0 || q.StartHour > 23 || q.EndHour < 0 || q.EndHour > 23 {
+		return HTTPErr{"quiet hours must start and end at hours between 0 and 23", 400}
+	}
+	return nil
+}
+
+// Until returns when the quiet hours containing at end, or the zero time if at isn't inside the quiet hours.
+func (q *QuietHours) Until(at time.Time, loc *time.Location) time.Time {
+	if !q.Enabled || q.StartHour == q.EndHour {
+		return time.Time{}
+	}
+	local := at.In(loc)
+	hour := local.Hour()
+	inside := false
+	if q.StartHour < q.EndHour {
+		inside = hour >= q.StartHour && hour < q.EndHour
+	} else {
+		inside = hour >= q.StartHour || hour < q.EndHour
+	}
+	if !inside {
+		return time.Time{}
+	}
+	end := time.Date(local.Year(), local.Month(), local.Day(), q.EndHour, 0, 0, 0, loc)
+	if !end.After(local) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
 type UserConfig struct {
-	UserId     string
-	FCMTokens  []FCMToken `methods:"PUT"`
-	MailConfig MailConfig `methods:"PUT"`
+	UserId      string
+	FCMTokens   []FCMToken `methods:"PUT"`
+	MailConfig  MailConfig `methods:"PUT"`
+	QuietHours  QuietHours `methods:"PUT"`
+	Webhooks    []Webhook  `methods:"PUT"`
+	SandboxMode bool       `methods:"PUT"`
+}
+
+// QuietUntil returns when the quiet hours of the user containing at end, or the zero time if at isn't inside the quiet hours.
+// Users without a valid time zone in their profile have their quiet hours in UTC.
+func (u *UserConfig) QuietUntil(ctx context.Context, at time.Time) (time.Time, error) {
+	if !u.QuietHours.Enabled {
+		return time.Time{}, nil
+	}
+	profile, err := GetProfile(ctx, u.UserId)
+	if err != nil {
+		return time.Time{}, err
+	}
+	loc, err := time.LoadLocation(profile.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	return u.QuietHours.Until(at, loc), nil
 }
 
 var UserConfigResource = &Resource{
-	Load:     loadUserConfig,
-	Update:   updateUserConfig,
+	Load:     Scoped(ManageConfigScope, loadUserConfig),
+	Update:   Scoped(ManageConfigScope, updateUserConfig),
 	FullPath: "/User/{user_id}/UserConfig",
 }
 
@@ -205,7 +347,7 @@ func (u *UserConfig) Item(r Request) *Item {
 				"A disabled flag which will turn notification to that token off, and which the server toggles if FCM returns errors when notifications are sent to that token.",
 				"A note field, which the server will populate with the reason the token was disabled.",
 				"An app field, which the app populating the token can use to identify tokens belonging to it to avoid removing/updating tokens belonging to other apps.",
-				"Two template fields, one for phase and one for message notifications.",
+				"Three template fields, one for phase notifications, one for message notifications and one for deadline reminders.",
 				"Each token also has a `ReplaceToken` defined by the client. Defining a `ReplaceToken` other than the empty strings allows the client to replace the `Value` in the token without requiring a regular authentication token.",
 			},
 			[]string{
@@ -225,15 +367,40 @@ func (u *UserConfig) Item(r Request) *Item {
 				"New message FCM notifications",
 				"FCM notifications for new messages will have the payload `{ DiplicityJSON: DATA }` where DATA is `{ message: [message JSON], type: 'message' }` compressed with libz.",
 			},
+			[]string{
+				"Deadline reminder FCM notifications",
+				"Members who haven't given any orders and aren't ready to resolve get reminded before the deadline. FCM reminders will have the payload `{ DiplicityJSON: DATA }` where DATA is `{ phaseMeta: [phase JSON], gameID: [game ID], deadlineAt: [deadline], type: 'reminder' }` compressed with libz.",
+			},
 			[]string{
 				"Email config",
 				"A user has an email config, defining if and how this user should receive email about new phases and messages.",
 				"The email config contains several fields.",
 				"An enabled flag which turns email notifications on.",
 				"Information about whether the unsubscribe link in the email should render some HTML or redirect to another host, defined by two Handlebars templates, one for the redirect link and one for the HTML to display.",
-				"Two template fields, one for phase and one for message notifications.",
+				"Three template fields, one for phase notifications, one for message notifications and one for deadline reminders.",
+				"A digest mode, which is empty to mail every message immediately, or `hourly` or `daily` to collect messages into one digest mail per hour or day, grouped by game and channel.",
+				"A template field for digests, which get `{ games: [{ game: [game JSON], desc: [game description], channels: [{ channel: [channel members], replyAddress: [address], messages: [message JSON] }] }] }` as data.",
 				"All templates will be parsed by the same parser as the FCM templates.",
 			},
+			[]string{
+				"Quiet hours",
+				"When quiet hours are enabled, message and phase notifications that would be sent between `StartHour` and `EndHour` are held back until `EndHour`.",
+				"The hours are in the time zone of your profile, or UTC if your profile has no time zone. Quiet hours may wrap around midnight, e.g. from 22 to 7.",
+				"Deadline reminders are urgent, and are sent during quiet hours as well.",
+			},
+			[]string{
+				"Webhooks",
+				"Each webhook is an HTTPS URL that gets `POST`ed JSON when something happens in your games, in the shape `{ Type: [event], UserId: [user ID], CreatedAt: [time], Data: [event data] }`.",
+				"The events are `phase`, `message`, `game-start` and `game-end`, and get the same data as the corresponding FCM notifications. A webhook with no `Events` gets all of them.",
+				"Each request has an `X-Diplicity-Signature` header containing `sha256=` followed by the hex encoded HMAC-SHA256 of the body, keyed with the `Secret` of the webhook.",
+				"Failed deliveries are retried with exponential backoff. Webhooks that fail too many deliveries in a row get disabled, with the reason in the `Note` field. Updating the user config resets the failure count.",
+				"Webhooks respect the notification muting in game states, but not quiet hours.",
+			},
+			[]string{
+				"Sandbox mode",
+				"Users in sandbox mode may import game records, to study them with the regular phase, map and order endpoints.",
+				"Imported games are read only, unrated, have no members and aren't listed among the finished games.",
+			},
 		})
 }
 
@@ -277,8 +444,24 @@ func updateUserConfig(w ResponseWriter, r Request) (*UserConfig, error) {
 		if err := token.PhaseConfig.Validate(); err != nil {
 			return nil, err
 		}
+		if err := token.ReminderConfig.Validate(); err != nil {
+			return nil, err
+		}
 	}
 
+	if err := config.QuietHours.Validate(); err != nil {
+		return nil, err
+	}
+	webhookURLs := map[string]bool{}
+	for _, webhook := range config.Webhooks {
+		if err := webhook.Validate(); err != nil {
+			return nil, err
+		}
+		if webhookURLs[webhook.URL] {
+			return nil, HTTPErr{fmt.Sprintf("webhook %q defined more than once", webhook.URL), 400}
+		}
+		webhookURLs[webhook.URL] = true
+	}
 	if err := config.MailConfig.Validate(); err != nil {
 		return nil, err
 	}
@@ -0,0 +1,121 @@
+package diptest
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/game"
+	"google.golang.org/appengine/datastore"
+)
+
+// countAuditEvents returns how many audit events of action target the encoded key.
+func countAuditEvents(action, encodedKey string) int {
+	key, err := datastore.DecodeKey(encodedKey)
+	if err != nil {
+		panic(err)
+	}
+	count := 0
+	events := superuserEnv().GetRoute(auth.ListAuditEventsRoute).QueryParams(url.Values{
+		"action": []string{action},
+	}).Success()
+	for _, event := range events.GetValue("Properties").([]interface{}) {
+		targets, _ := event.(map[string]interface{})["Properties"].(map[string]interface{})["TargetKeys"].([]interface{})
+		if len(targets) > 0 && targets[0] == key.String() {
+			count++
+		}
+	}
+	return count
+}
+
+func TestAdmin(t *testing.T) {
+	su := superuserEnv()
+	owner := NewEnv().SetUID(String("fake"))
+	joiner := NewEnv().SetUID(String("fake"))
+
+	gameDesc := String("test-game")
+	owner.GetRoute(game.IndexRoute).Success().
+		Follow("create-game", "Links").
+		Body(map[string]interface{}{
+			"Variant":            "Classical",
+			"Desc":               gameDesc,
+			"PhaseLengthMinutes": time.Duration(60),
+		}).Success()
+	gameID := joiner.GetRoute(game.IndexRoute).Success().
+		Follow("open-games", "Links").Success().
+		Find(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"}).
+		GetValue("Properties", "ID").(string)
+	joiner.GetRoute(game.IndexRoute).Success().
+		Follow("open-games", "Links").Success().
+		Find(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"}).
+		Follow("join", "Links").Body(map[string]interface{}{}).Success()
+
+	t.Run("DeniedToMembers", func(t *testing.T) {
+		owner.DeleteRoute(game.AdminRemoveMemberRoute).RouteParams("game_id", gameID, "user_id", joiner.GetUID()).Failure()
+		owner.PostRoute(game.AdminCancelGameRoute).RouteParams("game_id", gameID).Failure()
+		owner.DeleteRoute(game.AdminDeleteGameRoute).RouteParams("game_id", gameID).Failure()
+		owner.PostRoute(game.AdminDisableUserRoute).RouteParams("user_id", joiner.GetUID()).Body(map[string]interface{}{
+			"Reason": "stabbing",
+		}).Failure()
+		owner.GetRoute(game.ListMyStagingGamesRoute).Success().
+			Find(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"}).
+			AssertLen(2, "Properties", "Members").
+			AssertBoolEq(false, "Properties", "Finished")
+	})
+
+	t.Run("RemoveMember", func(t *testing.T) {
+		su.DeleteRoute(game.AdminRemoveMemberRoute).RouteParams("game_id", gameID, "user_id", joiner.GetUID()).Success().
+			AssertEq(joiner.GetUID(), "Properties", "User", "Id")
+		owner.GetRoute(game.ListMyStagingGamesRoute).Success().
+			Find(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"}).
+			AssertLen(1, "Properties", "Members")
+		joiner.GetRoute(game.ListMyStagingGamesRoute).Success().
+			AssertNotFind(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"})
+		// Rejected actions aren't audited.
+		su.DeleteRoute(game.AdminRemoveMemberRoute).RouteParams("game_id", gameID, "user_id", joiner.GetUID()).Failure()
+		if count := countAuditEvents("remove-member", gameID); count != 1 {
+			panic(fmt.Errorf("got %v remove-member audit events, wanted 1", count))
+		}
+	})
+
+	t.Run("ReplaceMember", func(t *testing.T) {
+		disabled := NewEnv().SetUID(String("fake"))
+		disabled.GetRoute(game.IndexRoute).Success()
+		su.PostRoute(game.AdminDisableUserRoute).RouteParams("user_id", disabled.GetUID()).Body(map[string]interface{}{
+			"Reason": "testing",
+		}).Success()
+		su.PostRoute(game.AdminReplaceMemberRoute).RouteParams("game_id", gameID, "user_id", owner.GetUID()).Body(map[string]interface{}{
+			"UserId": disabled.GetUID(),
+		}).Failure()
+		owner.GetRoute(game.ListMyStagingGamesRoute).Success().
+			Find(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"})
+	})
+
+	t.Run("CancelGame", func(t *testing.T) {
+		su.PostRoute(game.AdminCancelGameRoute).RouteParams("game_id", gameID).Success().
+			AssertBoolEq(true, "Properties", "Finished").
+			AssertBoolEq(true, "Properties", "Cancelled")
+		owner.GetRoute(game.ListMyFinishedGamesRoute).Success().
+			Find(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"})
+		su.PostRoute(game.AdminCancelGameRoute).RouteParams("game_id", gameID).Failure()
+		// Results of finished games are final.
+		su.PostRoute(game.AdminReplaceMemberRoute).RouteParams("game_id", gameID, "user_id", owner.GetUID()).Body(map[string]interface{}{
+			"UserId": joiner.GetUID(),
+		}).Failure()
+		if count := countAuditEvents("cancel-game", gameID); count != 1 {
+			panic(fmt.Errorf("got %v cancel-game audit events, wanted 1", count))
+		}
+	})
+
+	t.Run("DeleteGame", func(t *testing.T) {
+		su.DeleteRoute(game.AdminDeleteGameRoute).RouteParams("game_id", gameID).Success()
+		owner.GetRoute(game.ListMyFinishedGamesRoute).Success().
+			AssertNotFind(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"})
+		su.DeleteRoute(game.AdminDeleteGameRoute).RouteParams("game_id", gameID).Failure()
+		if count := countAuditEvents("delete-game", gameID); count != 1 {
+			panic(fmt.Errorf("got %v delete-game audit events, wanted 1", count))
+		}
+	})
+}
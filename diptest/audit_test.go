@@ -0,0 +1,69 @@
+package diptest
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/game"
+)
+
+const (
+	superuserID = "diptest-superuser"
+)
+
+var (
+	configureSuperusersOnce sync.Once
+)
+
+// superuserEnv returns an env for a user configured as superuser.
+func superuserEnv() *Env {
+	configureSuperusersOnce.Do(func() {
+		// Superusers can only be configured once, so this fails if the datastore was kept from an earlier run.
+		NewEnv().PostRoute(game.ConfigureRoute).Body(map[string]interface{}{
+			"Superusers": map[string]interface{}{
+				"UserIds": superuserID,
+			},
+		}).do()
+	})
+	return NewEnv().SetUID(superuserID)
+}
+
+func TestAuditEvents(t *testing.T) {
+	su := superuserEnv()
+
+	NewEnv().PostRoute(game.ConfigureRoute).Body(map[string]interface{}{}).Success()
+	NewEnv().PostRoute(game.ConfigureRoute).Body(map[string]interface{}{}).Success()
+
+	NewEnv().SetUID(String("fake")).GetRoute(auth.ListAuditEventsRoute).Failure()
+
+	su.GetRoute(auth.ListAuditEventsRoute).QueryParams(url.Values{
+		"action": []string{"configure"},
+	}).Success().
+		Find(auth.AppAdminActor, []string{"Properties"}, []string{"Properties", "Actor"})
+
+	// Limits below one are ignored, instead of listing nothing.
+	for _, limit := range []string{"0", "-1"} {
+		events := su.GetRoute(auth.ListAuditEventsRoute).QueryParams(url.Values{
+			"action": []string{"configure"},
+			"limit":  []string{limit},
+		}).Success()
+		if l := len(events.GetValue("Properties").([]interface{})); l < 2 {
+			panic(fmt.Errorf("got %v events with limit %v, wanted at least 2", l, limit))
+		}
+	}
+
+	first := su.GetRoute(auth.ListAuditEventsRoute).QueryParams(url.Values{
+		"action": []string{"configure"},
+		"limit":  []string{"1"},
+	}).Success().
+		AssertLen(1, "Properties")
+	second := first.Follow("next", "Links").Success().
+		AssertLen(1, "Properties").
+		AssertEq("configure", "Properties", "0", "Properties", "Action")
+	if first.GetValue("Properties", "0", "Properties", "CreatedAt") == second.GetValue("Properties", "0", "Properties", "CreatedAt") {
+		panic(fmt.Errorf("got the same event on both pages"))
+	}
+}
@@ -142,7 +142,12 @@ func init() {
 		T = &realTransport{
 			host:   "localhost:8080",
 			scheme: "http",
-			client: &http.Client{},
+			client: &http.Client{
+				// Redirects are asserted using Req#Redirect, and often lead outside the app.
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			},
 		}
 		auth.TestMode = true
 	}
@@ -188,6 +193,17 @@ type Req struct {
 	url         *url.URL
 	method      string
 	body        []byte
+	form        bool
+	accept      string
+	header      http.Header
+}
+
+func (e *Env) PostRoute(route string) *Req {
+	return &Req{
+		env:    e,
+		route:  route,
+		method: "POST",
+	}
 }
 
 func (e *Env) PutRoute(route string) *Req {
@@ -198,6 +214,14 @@ func (e *Env) PutRoute(route string) *Req {
 	}
 }
 
+func (e *Env) DeleteRoute(route string) *Req {
+	return &Req{
+		env:    e,
+		route:  route,
+		method: "DELETE",
+	}
+}
+
 func (e *Env) GetRoute(route string) *Req {
 	return &Req{
 		env:    e,
@@ -228,6 +252,28 @@ func (r *Req) QueryParams(queryParams url.Values) *Req {
 	return r
 }
 
+// Accept makes the request ask for another content type than JSON, and leaves the response body undecoded in BodyBytes.
+func (r *Req) Accept(contentType string) *Req {
+	r.accept = contentType
+	return r
+}
+
+// Header adds a header to the request.
+func (r *Req) Header(key, value string) *Req {
+	if r.header == nil {
+		r.header = http.Header{}
+	}
+	r.header.Add(key, value)
+	return r
+}
+
+// Form makes the request body the form encoded values instead of JSON.
+func (r *Req) Form(values url.Values) *Req {
+	r.body = []byte(values.Encode())
+	r.form = true
+	return r
+}
+
 func (r *Req) Body(i interface{}) *Req {
 	b, err := json.Marshal(i)
 	if err != nil {
@@ -242,6 +288,7 @@ type Result struct {
 	URL       *url.URL
 	Body      interface{}
 	BodyBytes []byte
+	Header    http.Header
 	Status    int
 }
 
@@ -430,6 +477,15 @@ func (r *Req) Failure() *Result {
 	return res
 }
 
+// Redirect asserts that the request is redirected, and returns the redirect with the target in its Location header.
+func (r *Req) Redirect() *Result {
+	res := r.do()
+	if res.Status < 300 || res.Status > 399 {
+		panic(fmt.Errorf("%qing %q: got %v, wanted a redirect\n%s", r.method, res.URL.String(), res.Status, res.BodyBytes))
+	}
+	return res
+}
+
 func (r *Req) do() *Result {
 	if r.url == nil {
 		u, err := router.Get(r.route).URL(r.routeParams...)
@@ -460,11 +516,20 @@ func (r *Req) do() *Result {
 	if err != nil {
 		panic(fmt.Errorf("creating GET %q: %v", r.url, err))
 	}
-	req.Header.Set("Accept", "application/json; charset=utf-8")
-	if r.body != nil {
+	if r.accept == "" {
+		req.Header.Set("Accept", "application/json; charset=utf-8")
+	} else {
+		req.Header.Set("Accept", r.accept)
+	}
+	if r.form {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else if r.body != nil {
 		req.Header.Set("Content-Type", "application/json; charset=utf-8")
 	}
-	status, _, responseReader, err := T.Execute(req)
+	for k, v := range r.header {
+		req.Header[k] = v
+	}
+	status, header, responseReader, err := T.Execute(req)
 	if err != nil {
 		panic(fmt.Errorf("executing %+v: %v", req, err))
 	}
@@ -473,7 +538,7 @@ func (r *Req) do() *Result {
 		panic(fmt.Errorf("reading body from %+v: %v", req, err))
 	}
 	var result interface{}
-	if status > 199 && status < 300 {
+	if status > 199 && status < 300 && r.accept == "" {
 		if len(responseBytes) > 0 {
 			if err := json.Unmarshal(responseBytes, &result); err != nil {
 				panic(fmt.Errorf("unmarshaling %q: %v", string(responseBytes), err))
@@ -485,6 +550,7 @@ func (r *Req) do() *Result {
 		URL:       r.url,
 		BodyBytes: responseBytes,
 		Body:      result,
+		Header:    header,
 		Status:    status,
 	}
 }
@@ -0,0 +1,119 @@
+package diptest
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/zond/diplicity/game"
+)
+
+// enableSandboxMode lets the user of env import games.
+func enableSandboxMode(env *Env) {
+	userConfig := env.GetRoute(game.IndexRoute).Success().
+		Follow("user-config", "Links").Success()
+	sandboxConfig := userConfig.GetValue("Properties").(map[string]interface{})
+	sandboxConfig["SandboxMode"] = true
+	userConfig.Follow("update", "Links").Body(sandboxConfig).Success().
+		AssertBoolEq(true, "Properties", "SandboxMode")
+}
+
+func testExport(t *testing.T) {
+	g0 := startedGames[0]
+	g1 := startedGames[1]
+
+	nation := startedGameNats[0]
+
+	var prov string
+
+	switch nation {
+	case "Austria":
+		prov = "vie"
+	case "Germany":
+		prov = "ber"
+	case "Turkey":
+		prov = "ank"
+	case "Italy":
+		prov = "rom"
+	case "France":
+		prov = "bre"
+	case "Russia":
+		prov = "mos"
+	case "England":
+		prov = "lon"
+	}
+
+	phase := g0.
+		Follow("phases", "Links").Success().
+		Find("Spring", []string{"Properties"}, []string{"Properties", "Season"})
+
+	phase.Follow("create-order", "Links").Body(map[string]interface{}{
+		"Parts": []string{prov, "Hold"},
+	}).Success()
+
+	g0.Follow("export", "Links").Success().
+		AssertEq(startedGameDesc, "Desc").
+		AssertEq("Classical", "Variant").
+		AssertLen(1, "Phases").
+		AssertLen(22, "Phases", "0", "Units").
+		Find(nation, []string{"Phases", "0", "Orders"}, []string{"Nation"})
+
+	g1.Follow("export", "Links").Success().
+		AssertEq(startedGameDesc, "Desc").
+		AssertNil("Phases", "0", "Orders")
+
+	recordWithOrders := g0.Follow("export", "Links").Success().Body
+
+	text := string(startedGameEnvs[0].GetRoute(game.ExportGameRoute).RouteParams("game_id", startedGameID).
+		QueryParams(url.Values{"format": []string{"text"}}).Accept("text/plain").Success().BodyBytes)
+	for _, wanted := range []string{
+		fmt.Sprintf("Game:    %s\n", startedGameDesc),
+		"Variant: Classical\n",
+		"Movement results for Spring of 1901.",
+		"Phase not yet resolved.\n",
+		"Ownership of supply centers:\n",
+	} {
+		if !strings.Contains(text, wanted) {
+			panic(fmt.Errorf("text export %q doesn't contain %q", text, wanted))
+		}
+	}
+	foundOrder := false
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, fmt.Sprintf("%s: ", nation)) && strings.HasSuffix(line, " HOLD.") {
+			foundOrder = true
+		}
+	}
+	if !foundOrder {
+		panic(fmt.Errorf("text export %q doesn't contain the hold order of %v", text, nation))
+	}
+
+	phase.Follow("orders", "Links").Success().
+		Find(nation, []string{"Properties"}, []string{"Properties", "Nation"}).
+		Follow("delete", "Links").Success()
+
+	record := g0.Follow("export", "Links").Success().Body
+
+	startedGameEnvs[0].GetRoute(game.IndexRoute).Success().
+		AssertNotRel("import-game", "Links")
+
+	enableSandboxMode(startedGameEnvs[0])
+
+	// The last phase of a record is where the game ended, so orders in it would never be resolved.
+	startedGameEnvs[0].GetRoute(game.IndexRoute).Success().
+		Follow("import-game", "Links").Body(recordWithOrders).Failure()
+
+	imported := startedGameEnvs[0].GetRoute(game.IndexRoute).Success().
+		Follow("import-game", "Links").Body(record).Success().
+		AssertEq(true, "Properties", "Imported").
+		AssertEq(true, "Properties", "Finished")
+	imported.Follow("phases", "Links").Success().
+		AssertLen(1, "Properties").
+		AssertEq(true, "Properties", "0", "Properties", "Resolved").
+		AssertEq(imported.GetValue("Properties", "NewestPhaseMeta", "0", "UnitsJSON"), "Properties", "0", "Properties", "UnitsJSON").
+		AssertEq(imported.GetValue("Properties", "NewestPhaseMeta", "0", "SCsJSON"), "Properties", "0", "Properties", "SCsJSON")
+
+	startedGameEnvs[0].GetRoute(game.IndexRoute).Success().
+		Follow("finished-games", "Links").Success().
+		AssertNotFind(startedGameDesc, []string{"Properties"}, []string{"Properties", "Desc"})
+}
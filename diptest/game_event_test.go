@@ -0,0 +1,24 @@
+package diptest
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/zond/diplicity/game"
+)
+
+func testGameEvents(t *testing.T) {
+	events := startedGames[0].Follow("events", "Links").Success()
+	events.Find("game-started", []string{"Properties"}, []string{"Properties", "Type"})
+	firstID := events.Find("member-joined", []string{"Properties"}, []string{"Properties", "Type"}).GetValue("Properties", "ID").(string)
+
+	startedGameEnvs[0].GetRoute(game.ListGameEventsRoute).
+		RouteParams("game_id", startedGameID).
+		QueryParams(url.Values{"after": []string{firstID}}).Success().
+		AssertNotFind(firstID, []string{"Properties"}, []string{"Properties", "ID"}).
+		Find("game-started", []string{"Properties"}, []string{"Properties", "Type"})
+
+	startedGameEnvs[0].GetRoute(game.ListGameEventsRoute).
+		RouteParams("game_id", startedGameID).
+		QueryParams(url.Values{"after": []string{"not-a-cursor"}}).Failure()
+}
@@ -1,6 +1,10 @@
 package diptest
 
-import "testing"
+import (
+	"sort"
+	"strings"
+	"testing"
+)
 
 func testGameState(t *testing.T) {
 	g0 := startedGames[0]
@@ -40,4 +44,22 @@ func testGameState(t *testing.T) {
 		Find(nat1, []string{"Properties"}, []string{"Properties", "Nation"}).
 		AssertNil("Properties", "Muted")
 
+	channel := []string{nat1, nat0}
+	sort.Strings(channel)
+	g0.Follow("game-states", "Links").Success().
+		Find(nat0, []string{"Properties"}, []string{"Properties", "Nation"}).
+		Follow("update", "Links").Body(map[string]interface{}{
+		"Muted":                     []string{nat1},
+		"MutePhaseNotifications":    true,
+		"MutedChannelNotifications": []string{channel[1] + "," + channel[0]},
+	}).Success()
+
+	startedGameEnvs[0].
+		GetRoute("GameState.Load").
+		RouteParams("game_id", startedGameID, "nation", nat0).Success().
+		AssertEq([]interface{}{nat1}, "Properties", "Muted").
+		AssertBoolEq(true, "Properties", "MutePhaseNotifications").
+		AssertBoolEq(false, "Properties", "MuteMessageNotifications").
+		AssertEq([]interface{}{strings.Join(channel, ",")}, "Properties", "MutedChannelNotifications")
+
 }
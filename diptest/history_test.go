@@ -0,0 +1,11 @@
+package diptest
+
+import (
+	"testing"
+)
+
+func testHistory(t *testing.T) {
+	startedGames[0].Follow("history", "Links").Success().
+		AssertLen(1, "Properties", "Points").
+		AssertLen(7, "Properties", "Points", "0", "Nations")
+}
@@ -0,0 +1,17 @@
+package diptest
+
+import (
+	"testing"
+
+	"github.com/zond/diplicity/game"
+)
+
+func TestLoginProviders(t *testing.T) {
+	env := NewEnv().SetUID(String("fake"))
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("login-providers", "Links").Success().
+		Find("google", []string{"Properties"}, []string{"Name"})
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("identities", "Links").Success().
+		AssertLen(0, "Properties")
+}
@@ -0,0 +1,55 @@
+package diptest
+
+import (
+	"bytes"
+	"fmt"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/zond/diplicity/game"
+)
+
+func testMapImages(t *testing.T) {
+	phase := startedGames[0].Follow("phases", "Links").Success().
+		Find(1, []string{"Properties"}, []string{"Properties", "PhaseOrdinal"})
+
+	rendered := phase.Follow("png-map", "Links").Accept("image/png").Success()
+	if _, err := png.Decode(bytes.NewReader(rendered.BodyBytes)); err != nil {
+		panic(fmt.Errorf("map of phase 1 isn't a PNG: %v", err))
+	}
+	stored := phase.Follow("png-map", "Links").Accept("image/png").Success()
+	if !bytes.Equal(rendered.BodyBytes, stored.BodyBytes) {
+		panic(fmt.Errorf("stored map of phase 1 differs from the rendered one"))
+	}
+
+	g := startedGames[0].Follow("self", "Links").Success()
+	resolvedPhases := len(g.Follow("phases", "Links").Success().GetValue("Properties").([]interface{}))
+
+	if res := g.Follow("gif", "Links").Accept("image/gif").Success(); res.Status != http.StatusAccepted {
+		panic(fmt.Errorf("got %v when asking for an unrendered GIF, wanted %v", res.Status, http.StatusAccepted))
+	}
+	WaitForEmptyQueue("game-renderGameAnimation")
+	anim, err := gif.DecodeAll(bytes.NewReader(g.Follow("gif", "Links").Accept("image/gif").Success().BodyBytes))
+	if err != nil {
+		panic(fmt.Errorf("rendered GIF isn't a GIF: %v", err))
+	}
+	if len(anim.Image) != resolvedPhases {
+		panic(fmt.Errorf("got %v frames, wanted one per resolved phase (%v)", len(anim.Image), resolvedPhases))
+	}
+	// Each delay is rendered and stored separately, so only a few are allowed.
+	startedGameEnvs[0].GetRoute(game.RenderGameGIFRoute).RouteParams("game_id", startedGameID).
+		QueryParams(url.Values{"delay": []string{"7"}}).Failure()
+
+	g.Follow("sprites", "Links").Accept("image/png").Success()
+	WaitForEmptyQueue("game-renderGameAnimation")
+	sheet, err := png.Decode(bytes.NewReader(g.Follow("sprites", "Links").Accept("image/png").Success().BodyBytes))
+	if err != nil {
+		panic(fmt.Errorf("rendered sprite sheet isn't a PNG: %v", err))
+	}
+	if cell := anim.Image[0].Bounds(); sheet.Bounds().Dx()*sheet.Bounds().Dy() < resolvedPhases*cell.Dx()*cell.Dy() {
+		panic(fmt.Errorf("sprite sheet %v is too small for %v maps of %v", sheet.Bounds(), resolvedPhases, cell))
+	}
+}
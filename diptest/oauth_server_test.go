@@ -0,0 +1,186 @@
+package diptest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/game"
+)
+
+func TestOAuthClients(t *testing.T) {
+	env := NewEnv().SetUID(String("fake"))
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("oauth-clients", "Links").Success().
+		AssertLen(0, "Properties").
+		Follow("create", "Links").Body(map[string]interface{}{
+		"Name":         "frontend",
+		"RedirectURIs": []string{"/relative"},
+	}).Failure()
+
+	client := env.GetRoute(game.IndexRoute).Success().
+		Follow("oauth-clients", "Links").Success().
+		Follow("create", "Links").Body(map[string]interface{}{
+		"Name":         "frontend",
+		"RedirectURIs": []string{"https://frontend.example/callback"},
+		"Public":       true,
+	}).Success().
+		AssertEq("frontend", "Properties", "Name")
+	if client.GetValue("Properties", "Secret") == "" {
+		t.Errorf("got no secret for new client")
+	}
+
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("oauth-clients", "Links").Success().
+		AssertLen(1, "Properties")
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("oauth-grants", "Links").Success().
+		AssertLen(0, "Properties")
+
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("oauth-clients", "Links").Success().
+		Find("frontend", []string{"Properties"}, []string{"Properties", "Name"}).
+		Follow("delete", "Links").Success()
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("oauth-clients", "Links").Success().
+		AssertLen(0, "Properties")
+}
+
+func TestOAuthFlow(t *testing.T) {
+	env := NewEnv().SetUID(String("fake"))
+	redirectURI := "https://frontend.example/callback"
+
+	public := env.GetRoute(game.IndexRoute).Success().
+		Follow("oauth-clients", "Links").Success().
+		Follow("create", "Links").Body(map[string]interface{}{
+		"Name":         "public frontend",
+		"RedirectURIs": []string{redirectURI},
+		"Public":       true,
+	}).Success()
+	if secret, found := public.GetValue("Properties").(map[string]interface{})["Secret"]; found {
+		t.Errorf("got secret %q for public client", secret)
+	}
+
+	client := env.GetRoute(game.IndexRoute).Success().
+		Follow("oauth-clients", "Links").Success().
+		Follow("create", "Links").Body(map[string]interface{}{
+		"Name":         "confidential frontend",
+		"RedirectURIs": []string{redirectURI},
+	}).Success()
+	clientId := client.GetValue("Properties", "Id").(string)
+	clientSecret := client.GetValue("Properties", "Secret").(string)
+	basicAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(clientId+":"+clientSecret))
+
+	verifier := String("verifier")
+	challenge := sha256.Sum256([]byte(verifier))
+
+	consentPage := env.GetRoute(auth.OAuthAuthorizeRoute).QueryParams(url.Values{
+		"client_id":             []string{clientId},
+		"redirect_uri":          []string{redirectURI},
+		"response_type":         []string{"code"},
+		"code_challenge":        []string{base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": []string{"S256"},
+		"scope":                 []string{"read-games"},
+		"state":                 []string{"some-state"},
+	}).Accept("text/html").Success()
+	match := regexp.MustCompile(`name="consent" value="([^"]+)"`).FindSubmatch(consentPage.BodyBytes)
+	if match == nil {
+		panic(fmt.Errorf("found no consent in %s", consentPage.BodyBytes))
+	}
+	consent := url.Values{"consent": []string{string(match[1])}}
+	var csrfCookie *http.Cookie
+	for _, cookie := range (&http.Response{Header: consentPage.Header}).Cookies() {
+		if cookie.Name == "oauth-consent-csrf" {
+			csrfCookie = cookie
+		}
+	}
+	if csrfCookie == nil {
+		panic(fmt.Errorf("got no CSRF cookie with %+v", consentPage.Header))
+	}
+
+	// Consent needs the cookie of the consent screen, and the user who was asked.
+	env.PostRoute(auth.OAuthConsentRoute).Form(consent).Failure()
+	NewEnv().SetUID(String("fake")).PostRoute(auth.OAuthConsentRoute).Form(consent).
+		Header("Cookie", csrfCookie.String()).Failure()
+	redirect := env.PostRoute(auth.OAuthConsentRoute).Form(consent).
+		Header("Cookie", csrfCookie.String()).Redirect()
+	location, err := url.Parse(redirect.Header.Get("Location"))
+	if err != nil {
+		panic(err)
+	}
+	if location.Query().Get("state") != "some-state" {
+		panic(fmt.Errorf("got state %q, wanted %q", location.Query().Get("state"), "some-state"))
+	}
+	code := location.Query().Get("code")
+
+	exchange := url.Values{
+		"grant_type":    []string{"authorization_code"},
+		"code":          []string{code},
+		"redirect_uri":  []string{redirectURI},
+		"code_verifier": []string{verifier},
+	}
+	NewEnv().PostRoute(auth.OAuthTokenRoute).Form(exchange).
+		Header("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(clientId+":wrong"))).Failure()
+	tokens := NewEnv().PostRoute(auth.OAuthTokenRoute).Form(exchange).
+		Header("Authorization", basicAuth).Success().
+		AssertEq("Bearer", "token_type").
+		AssertEq("read-games", "scope")
+	// Codes are single use.
+	NewEnv().PostRoute(auth.OAuthTokenRoute).Form(exchange).
+		Header("Authorization", basicAuth).Failure()
+
+	NewEnv().GetRoute(game.IndexRoute).
+		Header("Authorization", "Bearer "+tokens.GetValue("access_token").(string)).Success().
+		AssertEq(env.GetUID(), "Properties", "User", "Id")
+	// Client credentials are only accepted by the token route.
+	NewEnv().GetRoute(game.IndexRoute).
+		Header("Authorization", basicAuth).Failure()
+
+	refresh := url.Values{
+		"grant_type":    []string{"refresh_token"},
+		"refresh_token": []string{tokens.GetValue("refresh_token").(string)},
+	}
+	refreshed := NewEnv().PostRoute(auth.OAuthTokenRoute).Form(refresh).
+		Header("Authorization", basicAuth).Success().
+		AssertEq("read-games", "scope")
+	if refreshed.GetValue("refresh_token") == tokens.GetValue("refresh_token") {
+		t.Errorf("refresh token wasn't rotated")
+	}
+	// Refresh tokens are rotated, so the old one no longer works.
+	NewEnv().PostRoute(auth.OAuthTokenRoute).Form(refresh).
+		Header("Authorization", basicAuth).Failure()
+	NewEnv().GetRoute(game.IndexRoute).
+		Header("Authorization", "Bearer "+refreshed.GetValue("access_token").(string)).Success().
+		AssertEq(env.GetUID(), "Properties", "User", "Id")
+
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("oauth-grants", "Links").Success().
+		AssertLen(1, "Properties").
+		AssertEq(clientId, "Properties", "0", "Properties", "ClientId")
+
+	// The grant covers the scopes, so authorizing again redirects with a code right away.
+	redirect = env.GetRoute(auth.OAuthAuthorizeRoute).QueryParams(url.Values{
+		"client_id":             []string{clientId},
+		"redirect_uri":          []string{redirectURI},
+		"response_type":         []string{"code"},
+		"code_challenge":        []string{base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": []string{"S256"},
+		"scope":                 []string{"read-games"},
+	}).Accept("text/html").Redirect()
+	if location, err = url.Parse(redirect.Header.Get("Location")); err != nil {
+		panic(err)
+	}
+	exchange.Set("code", location.Query().Get("code"))
+
+	// Codes issued before the user got disabled give no tokens.
+	superuserEnv().PostRoute(game.AdminDisableUserRoute).RouteParams("user_id", env.GetUID()).Body(map[string]interface{}{
+		"Reason": "testing",
+	}).Success()
+	NewEnv().PostRoute(auth.OAuthTokenRoute).Form(exchange).
+		Header("Authorization", basicAuth).Failure()
+}
@@ -0,0 +1,107 @@
+package diptest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/zond/diplicity/game"
+)
+
+func testPhaseDiff(t *testing.T) {
+	startedGames[0].Follow("phases", "Links").Success().
+		Find("Spring", []string{"Properties"}, []string{"Properties", "Season"}).
+		Follow("diff", "Links").Success().
+		AssertEq(float64(1), "Properties", "PhaseOrdinal").
+		AssertLen(0, "Properties", "Events").
+		AssertEq("", "Properties", "Summary")
+
+	env := NewEnv().SetUID(String("fake"))
+	enableSandboxMode(env)
+
+	// Austria moves to Tyrolia while France and Germany bounce in Burgundy, and then dislodges the Italian army in Venice.
+	phases := env.GetRoute(game.IndexRoute).Success().
+		Follow("import-game", "Links").Body(map[string]interface{}{
+		"Variant": "Classical",
+		"Phases": []map[string]interface{}{
+			{
+				"PhaseOrdinal": 1,
+				"Season":       "Spring",
+				"Year":         1901,
+				"Type":         "Movement",
+				"Orders": []map[string]interface{}{
+					{"Nation": "Austria", "Parts": []string{"vie", "Move", "tyr"}},
+					{"Nation": "France", "Parts": []string{"par", "Move", "bur"}},
+					{"Nation": "Germany", "Parts": []string{"mun", "Move", "bur"}},
+				},
+			},
+			{
+				"PhaseOrdinal": 2,
+				"Season":       "Spring",
+				"Year":         1901,
+				"Type":         "Retreat",
+			},
+			{
+				"PhaseOrdinal": 3,
+				"Season":       "Fall",
+				"Year":         1901,
+				"Type":         "Movement",
+				"Orders": []map[string]interface{}{
+					{"Nation": "Austria", "Parts": []string{"tri", "Move", "ven"}},
+					{"Nation": "Austria", "Parts": []string{"tyr", "Support", "tri", "ven"}},
+				},
+			},
+			{
+				"PhaseOrdinal": 4,
+				"Season":       "Fall",
+				"Year":         1901,
+				"Type":         "Retreat",
+			},
+		},
+	}).Success().
+		Follow("phases", "Links").Success()
+
+	springDiff := phases.
+		Find(float64(2), []string{"Properties"}, []string{"Properties", "PhaseOrdinal"}).
+		Follow("diff", "Links").Success().
+		AssertEq(float64(2), "Properties", "PhaseOrdinal").
+		AssertEq("", "Properties", "Summary")
+	springDiff.Find(map[string]interface{}{
+		"Type":        "Move",
+		"Nation":      "Austria",
+		"UnitType":    "Army",
+		"Province":    "vie",
+		"Destination": "tyr",
+	}, []string{"Properties", "Events"}, nil)
+	springDiff.
+		Find("par", []string{"Properties", "Events"}, []string{"Province"}).
+		AssertEq("Bounce", "Type").
+		AssertEq("bur", "Destination")
+	springDiff.
+		Find("mun", []string{"Properties", "Events"}, []string{"Province"}).
+		AssertEq("Bounce", "Type").
+		AssertEq("bur", "Destination")
+
+	fallDiff := phases.
+		Find(float64(4), []string{"Properties"}, []string{"Properties", "PhaseOrdinal"}).
+		Follow("diff", "Links").Success().
+		AssertEq(float64(4), "Properties", "PhaseOrdinal")
+	fallDiff.Find(map[string]interface{}{
+		"Type":        "Move",
+		"Nation":      "Austria",
+		"UnitType":    "Fleet",
+		"Province":    "tri",
+		"Destination": "ven",
+	}, []string{"Properties", "Events"}, nil)
+	fallDiff.Find(map[string]interface{}{
+		"Type":     "Dislodged",
+		"Nation":   "Italy",
+		"UnitType": "Army",
+		"Province": "ven",
+		"Detail":   "tri",
+	}, []string{"Properties", "Events"}, nil)
+	fallDiff.AssertNotFind("tyr", []string{"Properties", "Events"}, []string{"Province"})
+	if summary := fallDiff.GetValue("Properties", "Summary").(string); !strings.HasPrefix(summary, "Italy's army in Venice was dislodged") {
+		panic(fmt.Errorf("wanted the dislodgement of Venice in the summary, got %q", summary))
+	}
+}
@@ -69,9 +69,16 @@ func withStartedGame(f func()) {
 func TestStartGame(t *testing.T) {
 	withStartedGame(func() {
 		t.Run("TestGameState", testGameState)
+		t.Run("TestGameEvents", testGameEvents)
 		t.Run("TestOrders", testOrders)
 		t.Run("TestOptions", testOptions)
+		t.Run("TestExport", testExport)
+		t.Run("TestPhaseText", testPhaseText)
+		t.Run("TestPhaseDiff", testPhaseDiff)
+		t.Run("TestHistory", testHistory)
+		t.Run("TestVariantStats", testVariantStats)
 		t.Run("TestChat", testChat)
+		t.Run("TestUserUpdates", testUserUpdates)
 		t.Run("TestPhaseState", testPhaseState)
 		t.Run("TestReadyResolution", testReadyResolution)
 		t.Run("TestBanEfficacy", testBanEfficacy)
@@ -81,6 +88,11 @@ func TestStartGame(t *testing.T) {
 
 func TestDIASEnding(t *testing.T) {
 	withStartedGame(func() {
+		var variantStatsBefore *Result
+		t.Run("LoadVariantStatsBefore", func(t *testing.T) {
+			variantStatsBefore = startedGames[0].Follow("variant-stats", "Links").Success()
+		})
+
 		t.Run("PreparePhaseStatesWithWantsDIAS", func(t *testing.T) {
 			for i, nat := range startedGameNats {
 				order := []string{"", "Move", ""}
@@ -142,6 +154,12 @@ func TestDIASEnding(t *testing.T) {
 			}
 		})
 
+		t.Run("VerifyVariantStatsAggregated", func(t *testing.T) {
+			WaitForEmptyQueue("game-updateGlickos")
+			WaitForEmptyQueue("game-aggregateVariantStats")
+			assertVariantStatsAfterDIAS(variantStatsBefore, startedGames[0].Follow("variant-stats", "Links").Success())
+		})
+
 	})
 }
 
@@ -445,6 +463,8 @@ func TestTimeoutResolution(t *testing.T) {
 				pr.Find(env.GetUID(), []string{"Properties", "NMRUsers"}, nil)
 			}
 		})
+
+		t.Run("TestMapImages", testMapImages)
 	})
 
 }
@@ -0,0 +1,26 @@
+package diptest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func testPhaseText(t *testing.T) {
+	phase := startedGames[0].Follow("phases", "Links").Success().
+		Find("Spring", []string{"Properties"}, []string{"Properties", "Season"})
+
+	res := phase.Follow("self", "Links").Accept("text/plain").Success()
+	if contentType := res.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+		panic(fmt.Errorf("got content type %q, wanted text/plain", contentType))
+	}
+	text := string(res.BodyBytes)
+	for _, want := range []string{"Spring 1901, Movement", "Austria: 3 supply centers, 3 units", "Army Vienna", "Fleet Trieste"} {
+		if !strings.Contains(text, want) {
+			panic(fmt.Errorf("found no %q in %q", want, text))
+		}
+	}
+
+	phase.Follow("self", "Links").Success().
+		AssertEq("Spring", "Properties", "Season")
+}
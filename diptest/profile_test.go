@@ -0,0 +1,63 @@
+package diptest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/game"
+)
+
+func TestProfile(t *testing.T) {
+	name := String("profile")
+
+	env := NewEnv().SetUID(String("fake"))
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("profile", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"DisplayName":  name,
+		"Bio":          "Stabbing since 1959.",
+		"TimeZone":     "Europe/Stockholm",
+		"Country":      "SE",
+		"HideRealName": true,
+	}).Success().
+		AssertEq(name, "Properties", "DisplayName")
+
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("profile", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"Bio": "Stabbing since 1960.",
+	}).Success().
+		AssertEq(name, "Properties", "DisplayName").
+		AssertEq("Stabbing since 1960.", "Properties", "Bio").
+		AssertEq("Europe/Stockholm", "Properties", "TimeZone")
+
+	env2 := NewEnv().SetUID(String("fake"))
+	env2.GetRoute(game.IndexRoute).Success().
+		Follow("profile", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"DisplayName": name,
+	}).Failure()
+	env2.GetRoute(game.IndexRoute).Success().
+		Follow("profile", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"TimeZone": "Mars/Olympus_Mons",
+	}).Failure()
+
+	gameDesc := String("test-game")
+	env2.GetRoute(game.IndexRoute).Success().
+		Follow("create-game", "Links").
+		Body(map[string]interface{}{
+			"Variant":            "Classical",
+			"Desc":               gameDesc,
+			"PhaseLengthMinutes": time.Duration(60),
+		}).Success()
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("open-games", "Links").Success().
+		Find(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"}).
+		Follow("join", "Links").Body(map[string]interface{}{}).Success().
+		AssertEq(name, "Properties", "User", "Name")
+	env2.GetRoute(game.ListMyStagingGamesRoute).Success().
+		Find(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"}).
+		Find(env.GetUID(), []string{"Properties", "Members"}, []string{"User", "Id"}).
+		AssertEq(name, "User", "Name")
+}
@@ -0,0 +1,49 @@
+package diptest
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/diplicity/game"
+)
+
+func TestRateLimit(t *testing.T) {
+	env := NewEnv().SetUID(String("fake"))
+
+	quota := auth.DefaultRateLimits.Quotas[0]
+	for _, q := range auth.DefaultRateLimits.Quotas {
+		if q.Class == auth.ExpensiveRouteClass {
+			quota = q
+		}
+	}
+
+	// The bucket starts full, and refills far slower than the requests drain it.
+	var throttled *Result
+	for i := 0; i < int(quota.Burst)+10 && throttled == nil; i++ {
+		res := env.GetRoute(game.ListOpenGamesRoute).do()
+		if res.Status == 429 {
+			if i < int(quota.Burst)-1 {
+				panic(fmt.Errorf("throttled after %v requests, wanted at least %v", i, quota.Burst))
+			}
+			throttled = res
+		} else if res.Status != 200 {
+			panic(fmt.Errorf("got %v listing open games: %s", res.Status, res.BodyBytes))
+		}
+	}
+	if throttled == nil {
+		panic(fmt.Errorf("never throttled after %v requests", int(quota.Burst)+10))
+	}
+	if retryAfter, err := strconv.Atoi(throttled.Header.Get("Retry-After")); err != nil || retryAfter < 1 {
+		panic(fmt.Errorf("got Retry-After %q, wanted a positive number of seconds", throttled.Header.Get("Retry-After")))
+	}
+
+	// Other classes have their own buckets.
+	env.GetRoute(game.IndexRoute).Success()
+	// And other users have their own buckets.
+	NewEnv().SetUID(String("fake")).GetRoute(game.ListOpenGamesRoute).Success()
+
+	// Only superusers may see who is throttled.
+	env.GetRoute(auth.ListThrottlesRoute).Failure()
+}
@@ -0,0 +1,68 @@
+package diptest
+
+import (
+	"testing"
+
+	"github.com/zond/diplicity/game"
+)
+
+func TestPersonalAccessTokens(t *testing.T) {
+	env := NewEnv().SetUID(String("fake"))
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("sessions", "Links").Success().
+		AssertLen(0, "Properties").
+		Follow("create-personal-token", "Links").Body(map[string]interface{}{
+		"Name":      "script",
+		"ValidDays": 7,
+	}).Success().
+		AssertEq("script", "Properties", "Name").
+		AssertEq(true, "Properties", "Personal")
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("sessions", "Links").Success().
+		Follow("create-personal-token", "Links").Body(map[string]interface{}{
+		"Name":      "forever",
+		"ValidDays": 1000,
+	}).Failure()
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("sessions", "Links").Success().
+		Follow("create-personal-token", "Links").Body(map[string]interface{}{
+		"Name":   "bot",
+		"Scopes": []string{"read-games", "launch-missiles"},
+	}).Failure()
+
+	sessions := env.GetRoute(game.IndexRoute).Success().
+		Follow("sessions", "Links").Success().
+		AssertLen(1, "Properties")
+	sessions.Find("script", []string{"Properties"}, []string{"Properties", "Name"}).
+		Follow("revoke", "Links").Success()
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("sessions", "Links").Success().
+		AssertLen(0, "Properties")
+}
+
+func TestScopedPersonalAccessTokens(t *testing.T) {
+	env := NewEnv().SetUID(String("fake"))
+	stats := env.GetRoute(game.IndexRoute).Success().
+		Follow("sessions", "Links").Success().
+		Follow("create-personal-token", "Links").Body(map[string]interface{}{
+		"Name":   "stats",
+		"Scopes": []string{"read-games"},
+	}).Success().
+		AssertLen(1, "Properties", "Scopes").
+		AssertEq("read-games", "Properties", "Scopes", "0")
+	readGames := "Bearer " + stats.GetValue("Properties", "Token").(string)
+
+	press := env.GetRoute(game.IndexRoute).Success().
+		Follow("sessions", "Links").Success().
+		Follow("create-personal-token", "Links").Body(map[string]interface{}{
+		"Name":   "press",
+		"Scopes": []string{"read-press"},
+	}).Success()
+	readPress := "Bearer " + press.GetValue("Properties", "Token").(string)
+
+	// Live updates contain press.
+	NewEnv().GetRoute(game.ListUserUpdatesRoute).RouteParams("user_id", env.GetUID()).
+		Header("Authorization", readGames).Failure()
+	NewEnv().GetRoute(game.ListUserUpdatesRoute).RouteParams("user_id", env.GetUID()).
+		Header("Authorization", readPress).Success()
+}
@@ -27,6 +27,11 @@ func TestUserConfig(t *testing.T) {
 				"TitleTemplate":       "",
 				"BodyTemplate":        "",
 			},
+			"ReminderConfig": map[string]interface{}{
+				"ClickActionTemplate": "",
+				"TitleTemplate":       "",
+				"BodyTemplate":        "",
+			},
 		},
 		map[string]interface{}{
 			"Value":        String("token"),
@@ -44,6 +49,11 @@ func TestUserConfig(t *testing.T) {
 				"TitleTemplate":       "",
 				"BodyTemplate":        "",
 			},
+			"ReminderConfig": map[string]interface{}{
+				"ClickActionTemplate": "",
+				"TitleTemplate":       "",
+				"BodyTemplate":        "",
+			},
 		},
 	}
 	env.GetRoute(game.IndexRoute).Success().
@@ -70,3 +80,88 @@ func TestUserConfig(t *testing.T) {
 		AssertEq(tokens, "Properties", "FCMTokens")
 
 }
+
+func TestMailDigestMode(t *testing.T) {
+	env := NewEnv().SetUID(String("fake"))
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("user-config", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"MailConfig": map[string]interface{}{
+			"Enabled":    true,
+			"DigestMode": "weekly",
+		},
+	}).Failure()
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("user-config", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"MailConfig": map[string]interface{}{
+			"Enabled":    true,
+			"DigestMode": auth.DailyDigestMode,
+		},
+	}).Success().
+		AssertEq(auth.DailyDigestMode, "Properties", "MailConfig", "DigestMode")
+}
+
+func TestQuietHours(t *testing.T) {
+	env := NewEnv().SetUID(String("fake"))
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("user-config", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"QuietHours": map[string]interface{}{
+			"Enabled":   true,
+			"StartHour": 22,
+			"EndHour":   24,
+		},
+	}).Failure()
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("user-config", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"QuietHours": map[string]interface{}{
+			"Enabled":   true,
+			"StartHour": 22,
+			"EndHour":   7,
+		},
+	}).Success().
+		AssertBoolEq(true, "Properties", "QuietHours", "Enabled").
+		AssertEq(22.0, "Properties", "QuietHours", "StartHour").
+		AssertEq(7.0, "Properties", "QuietHours", "EndHour")
+}
+
+func TestWebhooks(t *testing.T) {
+	env := NewEnv().SetUID(String("fake"))
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("user-config", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"Webhooks": []interface{}{
+			map[string]interface{}{
+				"URL":    "http://example.com/hook",
+				"Secret": "secret",
+			},
+		},
+	}).Failure()
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("user-config", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"Webhooks": []interface{}{
+			map[string]interface{}{
+				"URL":    "https://example.com/hook",
+				"Secret": "secret",
+				"Events": []string{"weather"},
+			},
+		},
+	}).Failure()
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("user-config", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"Webhooks": []interface{}{
+			map[string]interface{}{
+				"URL":    "https://example.com/hook",
+				"Secret": "secret",
+				"Events": []string{auth.PhaseWebhookEvent, auth.GameEndWebhookEvent},
+			},
+		},
+	}).Success().
+		AssertEq("https://example.com/hook", "Properties", "Webhooks", "0", "URL").
+		AssertEq([]interface{}{auth.PhaseWebhookEvent, auth.GameEndWebhookEvent}, "Properties", "Webhooks", "0", "Events").
+		AssertBoolEq(false, "Properties", "Webhooks", "0", "Disabled")
+}
@@ -0,0 +1,38 @@
+package diptest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/game"
+)
+
+func TestUserDeletion(t *testing.T) {
+	env := NewEnv().SetUID(String("fake"))
+	other := NewEnv().SetUID(String("fake"))
+
+	gameDesc := String("test-game")
+	other.GetRoute(game.IndexRoute).Success().
+		Follow("create-game", "Links").
+		Body(map[string]interface{}{
+			"Variant":            "Classical",
+			"Desc":               gameDesc,
+			"PhaseLengthMinutes": time.Duration(60),
+		}).Success()
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("open-games", "Links").Success().
+		Find(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"}).
+		Follow("join", "Links").Body(map[string]interface{}{}).Success()
+
+	other.DeleteRoute(game.DeleteUserRoute).RouteParams("user_id", env.GetUID()).Failure()
+
+	env.DeleteRoute(game.DeleteUserRoute).RouteParams("user_id", env.GetUID()).Success()
+
+	WaitForEmptyQueue("game-deleteUserData")
+
+	// Deleted users leave the games that haven't started.
+	other.GetRoute(game.ListMyStagingGamesRoute).Success().
+		Find(gameDesc, []string{"Properties"}, []string{"Properties", "Desc"}).
+		AssertLen(1, "Properties", "Members").
+		AssertNotFind(env.GetUID(), []string{"Properties", "Members"}, []string{"User", "Id"})
+}
@@ -0,0 +1,88 @@
+package diptest
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/zond/diplicity/game"
+)
+
+func TestUserExport(t *testing.T) {
+	env := NewEnv().SetUID(String("fake"))
+	banned := NewEnv().SetUID(String("fake")).SetEmail(fmt.Sprintf("%s@fake.fake", String("banned")))
+	banned.GetRoute(game.IndexRoute).Success()
+
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("bans", "Links").Success().
+		Follow("create", "Links").Body(map[string]interface{}{
+		"UserIds": []string{env.GetUID(), banned.GetUID()},
+	}).Success()
+
+	replaceToken := String("replace-token")
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("user-config", "Links").Success().
+		Follow("update", "Links").Body(map[string]interface{}{
+		"FCMTokens": []map[string]interface{}{
+			{
+				"Value":        String("token"),
+				"ReplaceToken": replaceToken,
+			},
+		},
+	}).Success()
+
+	env.GetRoute(game.IndexRoute).Success().
+		Follow("exports", "Links").Success().
+		AssertLen(0, "Properties").
+		Follow("create", "Links").Body(map[string]interface{}{}).Success().
+		AssertBoolEq(false, "Properties", "Finished")
+
+	WaitForEmptyQueue("game-exportUserData")
+
+	download := env.GetRoute(game.IndexRoute).Success().
+		Follow("exports", "Links").Success().
+		AssertLen(1, "Properties").
+		AssertBoolEq(true, "Properties", "0", "Properties", "Finished").
+		AssertRel("download", "Properties", "0", "Links").
+		Follow("download", "Properties", "0", "Links").Accept("application/zip").Success()
+
+	archive, err := zip.NewReader(bytes.NewReader(download.BodyBytes), int64(len(download.BodyBytes)))
+	if err != nil {
+		panic(err)
+	}
+	files := map[string][]byte{}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			panic(err)
+		}
+		if files[f.Name], err = ioutil.ReadAll(r); err != nil {
+			panic(err)
+		}
+	}
+	// Secrets that could be used by whoever gets hold of the archive are blanked.
+	if strings.Contains(string(files["account.json"]), replaceToken) {
+		panic(fmt.Errorf("account.json contains the FCM replace token: %s", files["account.json"]))
+	}
+	bansJSON := files["bans.json"]
+	// Only the side of the ban of the exporting user is exported.
+	if strings.Contains(string(bansJSON), banned.GetUID()) {
+		panic(fmt.Errorf("bans.json contains the banned user: %s", bansJSON))
+	}
+	bans := []map[string]interface{}{}
+	if err := json.Unmarshal(bansJSON, &bans); err != nil {
+		panic(err)
+	}
+	if len(bans) != 1 || bans[0]["Signed"] != true || bans[0]["SignedByOther"] != false {
+		panic(fmt.Errorf("got bans %s, wanted one ban signed by the exporting user", bansJSON))
+	}
+	if id := bans[0]["User"].(map[string]interface{})["Id"]; id != env.GetUID() {
+		panic(fmt.Errorf("got ban of %v, wanted %v", id, env.GetUID()))
+	}
+
+	NewEnv().SetUID(String("fake")).GetRoute(game.ListUserExportsRoute).RouteParams("user_id", env.GetUID()).Failure()
+}
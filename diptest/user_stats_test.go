@@ -14,3 +14,13 @@ func TestUserStatsLists(t *testing.T) {
 	env.GetRoute(game.ListTopHaterPlayersRoute).Success()
 	env.GetRoute(game.ListTopQuickPlayersRoute).Success()
 }
+
+func TestVersus(t *testing.T) {
+	env := NewEnv().SetUID(String("fake"))
+	env2 := NewEnv().SetUID(String("fake"))
+	env.GetRoute("UserStats.Load").RouteParams("user_id", env2.GetUID()).Success().
+		Follow("versus", "Links").Success().
+		AssertEq(env.GetUID(), "Properties", "UserId").
+		AssertEq(env2.GetUID(), "Properties", "OtherId").
+		AssertEq(float64(0), "Properties", "Games")
+}
@@ -0,0 +1,41 @@
+package diptest
+
+import (
+	"net/url"
+	"sort"
+	"testing"
+
+	"github.com/zond/diplicity/game"
+)
+
+func testUserUpdates(t *testing.T) {
+	body := String("live message")
+	members := sort.StringSlice{startedGameNats[0], startedGameNats[1]}
+	sort.Sort(members)
+
+	next := startedGameEnvs[1].GetRoute(game.IndexRoute).Success().
+		Follow("updates", "Links").Success().
+		AssertLen(0, "Properties").
+		Find("next", []string{"Links"}, []string{"Rel"})
+
+	startedGames[0].Follow("channels", "Links").Success().
+		Follow("message", "Links").Body(map[string]interface{}{
+		"Body":           body,
+		"ChannelMembers": members,
+	}).Success()
+
+	WaitForEmptyQueue("game-sendMsgNotificationsToUsers")
+
+	next.FollowLink().Success().
+		Find(body, []string{"Properties"}, []string{"Properties", "Body"}).
+		AssertEq(game.MessageUserUpdate, "Properties", "Type")
+
+	startedGameEnvs[0].GetRoute(game.ListUserUpdatesRoute).
+		RouteParams("user_id", startedGameEnvs[1].GetUID()).Failure()
+
+	for _, timeout := range []string{"soon", "-1"} {
+		startedGameEnvs[1].GetRoute(game.ListUserUpdatesRoute).
+			RouteParams("user_id", startedGameEnvs[1].GetUID()).
+			QueryParams(url.Values{"after": []string{"1"}, "timeout": []string{timeout}}).Failure()
+	}
+}
@@ -0,0 +1,38 @@
+package diptest
+
+import (
+	"testing"
+)
+
+func testVariantStats(t *testing.T) {
+	startedGames[0].Follow("variant-stats", "Links").Success().
+		AssertEq("Classical", "Properties", "Variant").
+		AssertLen(7, "Properties", "Nations")
+}
+
+// assertVariantStatsAfterDIAS asserts that the stats of after count one more game than before, drawn by all nations in its second phase.
+func assertVariantStatsAfterDIAS(before, after *Result) {
+	count := func(r *Result, path ...string) float64 {
+		return r.GetValue(path...).(float64)
+	}
+	after.
+		AssertEq(count(before, "Properties", "Games")+1, "Properties", "Games").
+		AssertEq(count(before, "Properties", "DrawGames")+1, "Properties", "DrawGames").
+		AssertEq(count(before, "Properties", "SoloGames"), "Properties", "SoloGames").
+		AssertEq(count(before, "Properties", "PhaseSum")+2, "Properties", "PhaseSum").
+		AssertEq(count(before, "Properties", "YearSum")+1, "Properties", "YearSum")
+	for _, nat := range startedGameNats {
+		scs := 3.0
+		if nat == "Russia" {
+			scs = 4
+		}
+		nationBefore := before.Find(nat, []string{"Properties", "Nations"}, []string{"Nation"})
+		after.Find(nat, []string{"Properties", "Nations"}, []string{"Nation"}).
+			AssertEq(count(nationBefore, "Games")+1, "Games").
+			AssertEq(count(nationBefore, "Draws")+1, "Draws").
+			AssertEq(count(nationBefore, "Solos"), "Solos").
+			AssertEq(count(nationBefore, "Survivals"), "Survivals").
+			AssertEq(count(nationBefore, "Eliminations"), "Eliminations").
+			AssertEq(count(nationBefore, "SCSum")+scs, "SCSum")
+	}
+}
@@ -0,0 +1,587 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	. "github.com/zond/goaeoas"
+	dip "github.com/zond/godip/common"
+)
+
+const (
+	recomputeUserStatsBatchSize = 100
+)
+
+var (
+	recomputeAllUserStatsFunc *DelayFunc
+)
+
+func init() {
+	recomputeAllUserStatsFunc = NewDelayFunc("game-recomputeAllUserStats", recomputeAllUserStats)
+}
+
+// requireSuperuser returns the user of the request, or an error unless the user is a superuser.
+func requireSuperuser(ctx context.Context, r Request) (*auth.User, error) {
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthorized", 401}
+	}
+
+	superusers, err := auth.GetSuperusers(ctx)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, HTTPErr{"unauthorized", 403}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !superusers.Includes(user.Id) {
+		return nil, HTTPErr{"unauthorized", 403}
+	}
+
+	return user, nil
+}
+
+// forceResolvePhase moves the deadline of the phase to now, and resolves it.
+func forceResolvePhase(ctx context.Context, gameID *datastore.Key, phaseOrdinal int64) error {
+	phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
+	if err != nil {
+		return err
+	}
+
+	phase := &Phase{}
+	if err := datastore.Get(ctx, phaseID, phase); err != nil {
+		return err
+	}
+	if phase.Resolved {
+		return HTTPErr{"phase already resolved", 412}
+	}
+
+	phase.DeadlineAt = time.Now()
+	if _, err := datastore.Put(ctx, phaseID, phase); err != nil {
+		return err
+	}
+
+	return timeoutResolvePhase(ctx, gameID, phaseOrdinal)
+}
+
+func adminResolvePhase(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if _, err := requireSuperuser(ctx, r); err != nil {
+		return err
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	phaseOrdinal, err := strconv.ParseInt(r.Vars()["phase_ordinal"], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
+	if err != nil {
+		return err
+	}
+
+	if err := forceResolvePhase(ctx, gameID, phaseOrdinal); err != nil {
+		return err
+	}
+
+	if err := auth.Audit(ctx, r, "resolve-phase", nil, phaseID); err != nil {
+		return err
+	}
+
+	phase := &Phase{}
+	if err := datastore.Get(ctx, phaseID, phase); err != nil {
+		return err
+	}
+
+	w.SetContent(phase.Item(r))
+	return nil
+}
+
+// adminDeleteGame deletes the game and everything stored under it.
+// Tasks scheduled for the game skip it when they find it gone, and the stats of the members are recomputed without it.
+// Variant stats keep the contribution of the game if it was rated, since they are only ever added to.
+func adminDeleteGame(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if _, err := requireSuperuser(ctx, r); err != nil {
+		return err
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		return err
+	}
+	game.ID = gameID
+
+	// Phases, orders, messages, results and everything else about the game are descendants of it.
+	ids, err := datastore.NewQuery("").Ancestor(gameID).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > maxPutMulti {
+			batch = batch[:maxPutMulti]
+		}
+		if err := datastore.DeleteMulti(ctx, batch); err != nil {
+			return err
+		}
+		ids = ids[len(batch):]
+	}
+
+	if err := auth.Audit(ctx, r, "delete-game", game, gameID); err != nil {
+		return err
+	}
+
+	uids := []string{}
+	for _, member := range game.Members {
+		uids = append(uids, member.User.Id)
+	}
+	if len(uids) > 0 {
+		if err := UpdateUserStatsASAP(ctx, uids); err != nil {
+			return err
+		}
+	}
+
+	w.SetContent(game.Item(r))
+	return nil
+}
+
+func adminCancelGame(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if _, err := requireSuperuser(ctx, r); err != nil {
+		return err
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	game := &Game{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := datastore.Get(ctx, gameID, game); err != nil {
+			return err
+		}
+		game.ID = gameID
+		if game.Finished {
+			return HTTPErr{"game already finished", 412}
+		}
+		// Finished games don't get resolved, so any scheduled resolution will be skipped.
+		game.Closed = true
+		game.Finished = true
+		game.Cancelled = true
+		game.FinishedAt = time.Now()
+		if err := recordGameEvent(ctx, game, &GameEvent{
+			GameID: gameID,
+			Type:   GameFinishedEvent,
+		}); err != nil {
+			return err
+		}
+		return game.Save(ctx)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return err
+	}
+
+	if err := auth.Audit(ctx, r, "cancel-game", nil, gameID); err != nil {
+		return err
+	}
+
+	uids := []string{}
+	for _, member := range game.Members {
+		uids = append(uids, member.User.Id)
+	}
+	if len(uids) > 0 {
+		if err := UpdateUserStatsASAP(ctx, uids); err != nil {
+			return err
+		}
+	}
+
+	w.SetContent(game.Item(r))
+	return nil
+}
+
+func adminRemoveMember(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if _, err := requireSuperuser(ctx, r); err != nil {
+		return err
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	userId := r.Vars()["user_id"]
+
+	var member *Member
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		game := &Game{}
+		if err := datastore.Get(ctx, gameID, game); err != nil {
+			return HTTPErr{"non existing game", 412}
+		}
+		game.ID = gameID
+		isMember := false
+		member, isMember = game.GetMember(userId)
+		if !isMember {
+			return HTTPErr{"non existing member", 404}
+		}
+		if game.Started {
+			return HTTPErr{"members of started games have nations, replace them instead", 412}
+		}
+		newMembers := []Member{}
+		for _, oldMember := range game.Members {
+			if oldMember.User.Id != userId {
+				newMembers = append(newMembers, oldMember)
+			}
+		}
+		if len(newMembers) == 0 {
+			return datastore.Delete(ctx, gameID)
+		}
+		if err := recordGameEvent(ctx, game, &GameEvent{
+			GameID: gameID,
+			Type:   MemberLeftEvent,
+			UserId: userId,
+		}); err != nil {
+			return err
+		}
+		game.Members = newMembers
+		return game.Save(ctx)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return err
+	}
+
+	if err := auth.Audit(ctx, r, "remove-member", nil, gameID, auth.UserID(ctx, userId)); err != nil {
+		return err
+	}
+
+	w.SetContent(member.Item(r))
+	return nil
+}
+
+type MemberReplacement struct {
+	UserId string
+}
+
+func adminReplaceMember(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if _, err := requireSuperuser(ctx, r); err != nil {
+		return err
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	userId := r.Vars()["user_id"]
+
+	replacement := &MemberReplacement{}
+	if err := json.NewDecoder(r.Req().Body).Decode(replacement); err != nil {
+		return err
+	}
+
+	newUser := &auth.User{}
+	if err := datastore.Get(ctx, auth.UserID(ctx, replacement.UserId), newUser); err == datastore.ErrNoSuchEntity {
+		return HTTPErr{fmt.Sprintf("non existing user %q", replacement.UserId), 404}
+	} else if err != nil {
+		return err
+	}
+	if disabled, err := auth.IsDisabled(ctx, newUser.Id); err != nil {
+		return err
+	} else if disabled {
+		return HTTPErr{fmt.Sprintf("%q is disabled", newUser.Id), 412}
+	}
+
+	var member *Member
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		game := &Game{}
+		if err := datastore.Get(ctx, gameID, game); err != nil {
+			return HTTPErr{"non existing game", 412}
+		}
+		game.ID = gameID
+		if game.Finished {
+			return HTTPErr{"members of finished games can't be replaced, since their results are final", 412}
+		}
+		if _, isMember := game.GetMember(newUser.Id); isMember {
+			return HTTPErr{fmt.Sprintf("%q is already a member", newUser.Id), 412}
+		}
+		isMember := false
+		member, isMember = game.GetMember(userId)
+		if !isMember {
+			return HTTPErr{"non existing member", 404}
+		}
+		if err := recordGameEvent(ctx, game, &GameEvent{
+			GameID: gameID,
+			Type:   MemberLeftEvent,
+			UserId: userId,
+			Nation: member.Nation,
+		}); err != nil {
+			return err
+		}
+		if err := recordGameEvent(ctx, game, &GameEvent{
+			GameID: gameID,
+			Type:   MemberJoinedEvent,
+			UserId: newUser.Id,
+			Nation: member.Nation,
+		}); err != nil {
+			return err
+		}
+		member.User = *newUser
+		member.GameAlias = ""
+		return game.Save(ctx)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return err
+	}
+
+	if err := UpdateUserStatsASAP(ctx, []string{userId, newUser.Id}); err != nil {
+		return err
+	}
+
+	if err := auth.Audit(ctx, r, "replace-member", replacement, gameID, auth.UserID(ctx, userId), auth.UserID(ctx, replacement.UserId)); err != nil {
+		return err
+	}
+
+	w.SetContent(member.Item(r))
+	return nil
+}
+
+func adminResetPhaseState(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if _, err := requireSuperuser(ctx, r); err != nil {
+		return err
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	phaseOrdinal, err := strconv.ParseInt(r.Vars()["phase_ordinal"], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	nation := dip.Nation(r.Vars()["nation"])
+
+	phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
+	if err != nil {
+		return err
+	}
+
+	phaseStateID, err := PhaseStateID(ctx, phaseID, nation)
+	if err != nil {
+		return err
+	}
+
+	phaseState := &PhaseState{}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		game := &Game{}
+		phase := &Phase{}
+		if err := datastore.GetMulti(ctx, []*datastore.Key{gameID, phaseID, phaseStateID}, []interface{}{game, phase, phaseState}); err != nil {
+			return err
+		}
+		game.ID = gameID
+		if phase.Resolved {
+			return HTTPErr{"can only reset phase states of unresolved phases", 412}
+		}
+		// NoOrders and Eliminated are decided by the game, not the member, and are kept.
+		phaseState.ReadyToResolve = false
+		phaseState.WantsDIAS = false
+		phaseState.OnProbation = false
+		phaseState.Note = ""
+		if err := phaseState.Save(ctx); err != nil {
+			return err
+		}
+		if err := recordGameEvent(ctx, game, &GameEvent{
+			GameID:       gameID,
+			Type:         PhaseStateChangedEvent,
+			Nation:       nation,
+			PhaseOrdinal: phaseOrdinal,
+		}); err != nil {
+			return err
+		}
+		for i := range game.Members {
+			if game.Members[i].Nation == nation {
+				game.Members[i].NewestPhaseState = *phaseState
+			}
+		}
+		return game.Save(ctx)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return err
+	}
+
+	if err := auth.Audit(ctx, r, "reset-phase-state", nil, phaseStateID); err != nil {
+		return err
+	}
+
+	w.SetContent(phaseState.Item(r))
+	return nil
+}
+
+func adminRecomputeUserStats(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if _, err := requireSuperuser(ctx, r); err != nil {
+		return err
+	}
+
+	userId := r.Vars()["user_id"]
+
+	if err := updateUserStatFunc.EnqueueIn(ctx, 0, userId); err != nil {
+		return err
+	}
+
+	if err := auth.Audit(ctx, r, "recompute-user-stats", nil, UserStatsID(ctx, userId)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func adminRecomputeAllUserStats(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if _, err := requireSuperuser(ctx, r); err != nil {
+		return err
+	}
+
+	if err := recomputeAllUserStatsFunc.EnqueueIn(ctx, 0, ""); err != nil {
+		return err
+	}
+
+	if err := auth.Audit(ctx, r, "recompute-all-user-stats", nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// recomputeAllUserStats enqueues recomputation of a batch of existing user stats, and then itself for the next batch.
+func recomputeAllUserStats(ctx context.Context, cursor string) error {
+	log.Infof(ctx, "recomputeAllUserStats(..., %q)", cursor)
+
+	query := datastore.NewQuery(userStatsKind).KeysOnly()
+	if cursor != "" {
+		decoded, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			log.Errorf(ctx, "Unable to decode cursor %q: %v; giving up", cursor, err)
+			return err
+		}
+		query = query.Start(decoded)
+	}
+
+	iter := query.Run(ctx)
+
+	uids := []string{}
+	var err error
+	for err == nil && len(uids) < recomputeUserStatsBatchSize {
+		var key *datastore.Key
+		key, err = iter.Next(nil)
+		if err == nil {
+			uids = append(uids, key.StringID())
+		}
+	}
+	if err != nil && err != datastore.Done {
+		log.Errorf(ctx, "Unable to load next user stats: %v; hope datastore gets fixed", err)
+		return err
+	}
+
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if len(uids) > 0 {
+			if err := UpdateUserStatsFunc.EnqueueIn(ctx, 0, uids); err != nil {
+				log.Errorf(ctx, "Unable to enqueue updating %v: %v; hope datastore gets fixed", uids, err)
+				return err
+			}
+		}
+		if err == nil {
+			nextCursor, err := iter.Cursor()
+			if err != nil {
+				log.Errorf(ctx, "Unable to get next cursor: %v; hope datastore gets fixed", err)
+				return err
+			}
+			if err := recomputeAllUserStatsFunc.EnqueueIn(ctx, 0, nextCursor.String()); err != nil {
+				log.Errorf(ctx, "Unable to enqueue next batch: %v; hope datastore gets fixed", err)
+				return err
+			}
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		log.Errorf(ctx, "Unable to commit recompute tx: %v", err)
+		return err
+	}
+
+	log.Infof(ctx, "recomputeAllUserStats(..., %q) *** SUCCESS ***", cursor)
+
+	return nil
+}
+
+func adminDisableUser(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, err := requireSuperuser(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	disabled := &auth.DisabledUser{}
+	if err := json.NewDecoder(r.Req().Body).Decode(disabled); err != nil {
+		return err
+	}
+	disabled.UserId = r.Vars()["user_id"]
+	disabled.DisabledBy = user.Id
+
+	if err := auth.DisableUser(ctx, disabled); err != nil {
+		return err
+	}
+
+	if err := auth.Audit(ctx, r, "disable-user", disabled, auth.UserID(ctx, disabled.UserId)); err != nil {
+		return err
+	}
+
+	w.SetContent(disabled.Item(r))
+	return nil
+}
+
+func adminEnableUser(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if _, err := requireSuperuser(ctx, r); err != nil {
+		return err
+	}
+
+	userId := r.Vars()["user_id"]
+
+	if err := auth.EnableUser(ctx, userId); err != nil {
+		return err
+	}
+
+	if err := auth.Audit(ctx, r, "enable-user", nil, auth.UserID(ctx, userId)); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -21,16 +21,16 @@ var BanResource *Resource
 
 func init() {
 	BanResource = &Resource{
-		Load:       loadBan,
-		Create:     createBan,
-		Delete:     deleteBan,
+		Load:       auth.Scoped(auth.ReadGamesScope, loadBan),
+		Create:     auth.Scoped(auth.ManageConfigScope, createBan),
+		Delete:     auth.Scoped(auth.ManageConfigScope, deleteBan),
 		CreatePath: "/User/{user_id}/Ban",
 		FullPath:   "/User/{user_id}/Ban/{banned_id}",
 		Listers: []Lister{
 			{
 				Path:    "/User/{user_id}/Bans",
 				Route:   ListBansRoute,
-				Handler: listBans,
+				Handler: auth.ScopedHandler(auth.ReadGamesScope, listBans),
 			},
 		},
 	}
@@ -56,6 +56,17 @@ func (b Bans) Item(r Request, userId string) *Item {
 	return bansItem
 }
 
+// ApplyProfiles replaces the Google details of the users of the bans with the ones in their profiles.
+func (b Bans) ApplyProfiles(ctx context.Context) error {
+	users := []*auth.User{}
+	for i := range b {
+		for j := range b[i].Users {
+			users = append(users, &b[i].Users[j])
+		}
+	}
+	return auth.ApplyProfiles(ctx, users)
+}
+
 type Ban struct {
 	UserIds  []string `methods:"POST"`
 	OwnerIds []string
@@ -132,6 +143,10 @@ func loadBan(w ResponseWriter, r Request) (*Ban, error) {
 		return nil, err
 	}
 
+	if err := (Bans{*ban}).ApplyProfiles(ctx); err != nil {
+		return nil, err
+	}
+
 	return ban, nil
 }
 
@@ -205,6 +220,10 @@ func listBans(w ResponseWriter, r Request) error {
 		return err
 	}
 
+	if err := bans.ApplyProfiles(ctx); err != nil {
+		return err
+	}
+
 	w.SetContent(bans.Item(r, user.Id))
 
 	return nil
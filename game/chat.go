@@ -58,13 +58,13 @@ func init() {
 	sendMsgNotificationsToMailFunc = NewDelayFunc("game-sendMsgNotificationsToMail", sendMsgNotificationsToMail)
 
 	MessageResource = &Resource{
-		Create:     createMessage,
+		Create:     auth.Scoped(auth.WritePressScope, createMessage),
 		CreatePath: "/Game/{game_id}/Messages",
 		Listers: []Lister{
 			{
 				Path:    "/Game/{game_id}/Channel/{channel_members}/Messages",
 				Route:   ListMessagesRoute,
-				Handler: listMessages,
+				Handler: auth.ScopedHandler(auth.ReadPressScope, listMessages),
 			},
 		},
 	}
@@ -76,6 +76,7 @@ type msgNotificationContext struct {
 	userConfigID *datastore.Key
 	game         *Game
 	member       *Member
+	gameState    *GameState
 	channel      *Channel
 	message      *Message
 	user         *auth.User
@@ -111,6 +112,10 @@ func getMsgNotificationContext(ctx context.Context, host, scheme string, gameID
 	)
 	if err != nil {
 		if merr, ok := err.(appengine.MultiError); ok {
+			if merr[0] == datastore.ErrNoSuchEntity || merr[2] == datastore.ErrNoSuchEntity {
+				log.Infof(ctx, "%v or %v doesn't exist anymore, will skip sending notification", gameID, messageID)
+				return nil, noConfigError
+			}
 			if merr[3] == datastore.ErrNoSuchEntity {
 				log.Infof(ctx, "%q has no configuration, will skip sending notification", userId)
 				return nil, noConfigError
@@ -131,6 +136,17 @@ func getMsgNotificationContext(ctx context.Context, host, scheme string, gameID
 		return nil, noConfigError
 	}
 
+	res.gameState, err = GetGameState(ctx, gameID, res.member.Nation)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load game state of %v in %v: %v; hope datastore gets fixed", res.member.Nation, gameID, err)
+		return nil, err
+	}
+
+	if err := (Games{*res.game}).ApplyProfiles(ctx); err != nil {
+		log.Errorf(ctx, "Unable to apply the profiles of the members of %v: %v; hope datastore gets fixed", gameID, err)
+		return nil, err
+	}
+
 	res.mapURL, err = router.Get(RenderPhaseMapRoute).URL("game_id", res.game.ID.Encode(), "phase_ordinal", fmt.Sprint(res.game.NewestPhaseMeta[0].PhaseOrdinal))
 	if err != nil {
 		log.Errorf(ctx, "Unable to create map URL for game %v and phase %v: %v; wtf?", res.game.ID, res.game.NewestPhaseMeta[0].PhaseOrdinal, err)
@@ -175,6 +191,23 @@ func sendEmailError(ctx context.Context, to string, errorMessage string) error {
 	return nil
 }
 
+func sendPlainMail(ctx context.Context, to, subject, body string) error {
+	sendGridConf, err := GetSendGrid(ctx)
+	if err != nil {
+		return err
+	}
+
+	msg := sendgrid.NewMail()
+	msg.SetText(body)
+	msg.SetSubject(subject)
+	msg.AddTo(to)
+	msg.SetFrom(noreplyFromAddr)
+
+	client := sendgrid.NewSendGridClientWithApiKey(sendGridConf.APIKey)
+	client.Client = urlfetch.Client(ctx)
+	return client.Send(msg)
+}
+
 func sendMsgNotificationsToMail(ctx context.Context, host, scheme string, gameID *datastore.Key, channelMembers Nations, messageID *datastore.Key, userId string) error {
 	log.Infof(ctx, "sendMsgNotificationsToMail(..., %q, %q, %v, %+v, %v, %q)", host, scheme, gameID, channelMembers, messageID, userId)
 
@@ -192,6 +225,34 @@ func sendMsgNotificationsToMail(ctx context.Context, host, scheme string, gameID
 		return nil
 	}
 
+	if msgContext.gameState.MutesMessageNotifications(channelMembers) {
+		log.Infof(ctx, "%q has muted message notifications for %v in %v, will skip sending notification", userId, channelMembers, gameID)
+		return nil
+	}
+
+	if interval := msgContext.userConfig.MailConfig.DigestInterval(); interval > 0 {
+		if err := queueMsgNotificationForDigest(ctx, host, scheme, gameID, channelMembers, messageID, userId, interval); err != nil {
+			log.Errorf(ctx, "Unable to queue notification for the digest of %q: %v; hope datastore gets fixed", userId, err)
+			return err
+		}
+		log.Infof(ctx, "sendMsgNotificationsToMail(..., %q, %q, %v, %+v, %v, %q) *** QUEUED FOR DIGEST ***", host, scheme, gameID, channelMembers, messageID, userId)
+		return nil
+	}
+
+	quietUntil, err := msgContext.userConfig.QuietUntil(ctx, time.Now())
+	if err != nil {
+		log.Errorf(ctx, "Unable to check quiet hours of %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+	if !quietUntil.IsZero() {
+		if err := sendMsgNotificationsToMailFunc.EnqueueAt(ctx, quietUntil, host, scheme, gameID, channelMembers, messageID, userId); err != nil {
+			log.Errorf(ctx, "Unable to defer mail to %q until %v: %v; hope datastore gets fixed", userId, quietUntil, err)
+			return err
+		}
+		log.Infof(ctx, "sendMsgNotificationsToMail(..., %q, %q, %v, %+v, %v, %q) *** DEFERRED UNTIL %v ***", host, scheme, gameID, channelMembers, messageID, userId, quietUntil)
+		return nil
+	}
+
 	sendGridConf, err := GetSendGrid(ctx)
 	if err != nil {
 		log.Errorf(ctx, "Unable to load sendgrid API key: %v; upload one or hope datastore gets fixed", err)
@@ -279,6 +340,25 @@ func sendMsgNotificationsToFCM(ctx context.Context, host, scheme string, gameID
 		return nil
 	}
 
+	if msgContext.gameState.MutesMessageNotifications(channelMembers) {
+		log.Infof(ctx, "%q has muted message notifications for %v in %v, will skip sending notifications", userId, channelMembers, gameID)
+		return nil
+	}
+
+	quietUntil, err := msgContext.userConfig.QuietUntil(ctx, time.Now())
+	if err != nil {
+		log.Errorf(ctx, "Unable to check quiet hours of %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+	if !quietUntil.IsZero() {
+		if err := sendMsgNotificationsToFCMFunc.EnqueueAt(ctx, quietUntil, host, scheme, gameID, channelMembers, messageID, userId, finishedTokens); err != nil {
+			log.Errorf(ctx, "Unable to defer notifications to %q until %v: %v; hope datastore gets fixed", userId, quietUntil, err)
+			return err
+		}
+		log.Infof(ctx, "sendMsgNotificationsToFCM(..., %q, %q, %v, %+v, %v, %q, %+v) *** DEFERRED UNTIL %v ***", host, scheme, gameID, channelMembers, messageID, userId, finishedTokens, quietUntil)
+		return nil
+	}
+
 	for _, fcmToken := range msgContext.userConfig.FCMTokens {
 		if fcmToken.Disabled || fcmToken.Value == "" {
 			continue
@@ -343,7 +423,10 @@ func sendMsgNotificationsToUsers(ctx context.Context, host, scheme string, gameI
 
 	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
 		game := &Game{}
-		if err := datastore.Get(ctx, gameID, game); err != nil {
+		if err := datastore.Get(ctx, gameID, game); err == datastore.ErrNoSuchEntity {
+			log.Infof(ctx, "%v doesn't exist anymore, exiting", gameID)
+			return nil
+		} else if err != nil {
 			log.Errorf(ctx, "Unable to load game %v: %v; hope datastore gets fixed", gameID, err)
 			return err
 		}
@@ -372,6 +455,23 @@ func sendMsgNotificationsToUsers(ctx context.Context, host, scheme string, gameI
 			return err
 		}
 
+		message := &Message{}
+		if err := datastore.Get(ctx, messageID, message); err != nil {
+			log.Errorf(ctx, "Unable to load message %v: %v; hope datastore gets fixed", messageID, err)
+			return err
+		}
+		if err := recordUserUpdate(ctx, uids[0], &UserUpdate{
+			Type:           MessageUserUpdate,
+			GameID:         gameID,
+			MessageID:      messageID,
+			ChannelMembers: channelMembers,
+			Sender:         message.Sender,
+			Body:           message.Body,
+		}); err != nil {
+			log.Errorf(ctx, "Unable to record update to %q: %v; hope datastore gets fixed", uids[0], err)
+			return err
+		}
+
 		if err := sendMsgNotificationsToFCMFunc.EnqueueIn(ctx, 0, host, scheme, gameID, channelMembers, messageID, uids[0], map[string]struct{}{}); err != nil {
 			log.Errorf(ctx, "Unable to enqueue sending FCM to %q: %v; hope datastore gets fixed", uids[0], err)
 			return err
@@ -380,6 +480,10 @@ func sendMsgNotificationsToUsers(ctx context.Context, host, scheme string, gameI
 			log.Errorf(ctx, "Unable to enqueue sending mail to %q: %v; hope datastore gets fixed", uids[0], err)
 			return err
 		}
+		if err := sendMsgWebhooksFunc.EnqueueIn(ctx, 0, host, scheme, gameID, channelMembers, messageID, uids[0]); err != nil {
+			log.Errorf(ctx, "Unable to enqueue sending webhooks to %q: %v; hope datastore gets fixed", uids[0], err)
+			return err
+		}
 		if len(uids) > 1 {
 			if err := sendMsgNotificationsToUsersFunc.EnqueueIn(ctx, 0, host, scheme, gameID, channelMembers, messageID, uids[1:]); err != nil {
 				log.Errorf(ctx, "Unable to enqueue sending to rest: %v; hope datastore gets fixed", err)
@@ -391,6 +495,7 @@ func sendMsgNotificationsToUsers(ctx context.Context, host, scheme string, gameI
 		log.Errorf(ctx, "Unable to commit send tx: %v", err)
 		return err
 	}
+	signalUserUpdate(ctx, uids[0])
 	log.Infof(ctx, "Successfully enqueued sending notification to %q, and to rest if there were any", uids[0])
 
 	log.Infof(ctx, "sendMsgNotificationsToUsers(..., %q, %q, %v, %+v, %v, %+v) *** SUCCESS ***", host, scheme, gameID, channelMembers, messageID, uids)
@@ -669,6 +774,15 @@ func createMessageHelper(ctx context.Context, r Request, message *Message) error
 		if message.ID, err = datastore.Put(ctx, datastore.NewIncompleteKey(ctx, messageKind, channelID), message); err != nil {
 			return err
 		}
+		if err := recordGameEvent(ctx, game, &GameEvent{
+			GameID:         message.GameID,
+			Type:           MessagePostedEvent,
+			Nation:         message.Sender,
+			ChannelMembers: message.ChannelMembers,
+			MessageID:      message.ID,
+		}); err != nil {
+			return err
+		}
 		channel.NMessages += 1
 		if _, err = datastore.Put(ctx, channelID, channel); err != nil {
 			return err
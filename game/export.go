@@ -0,0 +1,391 @@
+package game
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip/variants"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	. "github.com/zond/goaeoas"
+	dip "github.com/zond/godip/common"
+)
+
+const (
+	exportFormatJSON = "json"
+	exportFormatText = "text"
+)
+
+// GameRecord is a self contained record of everything the viewer is allowed to see of a game.
+type GameRecord struct {
+	GameID             string
+	Desc               string
+	Variant            string
+	PhaseLengthMinutes time.Duration
+	Started            bool
+	Finished           bool
+	CreatedAt          time.Time
+	FinishedAt         time.Time
+	ExportedAt         time.Time
+	Members            []MemberRecord
+	Phases             []PhaseRecord
+	Press              []PressRecord `json:",omitempty"`
+}
+
+type MemberRecord struct {
+	Nation dip.Nation
+	Name   string
+}
+
+type PhaseRecord struct {
+	PhaseOrdinal int64
+	Season       dip.Season
+	Year         int
+	Type         dip.PhaseType
+	Resolved     bool
+	Units        []UnitWrapper
+	SCs          []SC
+	Dislodgeds   []Dislodged
+	Dislodgers   []Dislodger
+	Bounces      []Bounce
+	Resolutions  []Resolution
+	Orders       []OrderRecord
+}
+
+type OrderRecord struct {
+	Nation dip.Nation
+	Parts  []string
+}
+
+type PressRecord struct {
+	ChannelMembers Nations
+	Sender         dip.Nation
+	Body           string
+	CreatedAt      time.Time
+}
+
+// resolution returns the stored resolution for prov, or "" if there is none.
+func (p *PhaseRecord) resolution(prov dip.Province) string {
+	for _, res := range p.Resolutions {
+		if res.Province == prov {
+			return res.Resolution
+		}
+	}
+	return ""
+}
+
+// unit returns the unit at prov when the phase started.
+func (p *PhaseRecord) unit(prov dip.Province) (dip.Unit, bool) {
+	for _, unit := range p.Units {
+		if unit.Province == prov {
+			return unit.Unit, true
+		}
+	}
+	return dip.Unit{}, false
+}
+
+// provinceName returns the long name of prov in variant, if the variant defines one.
+func provinceName(variant string, prov dip.Province) string {
+	if v, found := variants.Variants[variant]; found {
+		if name, found := v.ProvinceLongNames[prov]; found {
+			return name
+		}
+		if name, found := v.ProvinceLongNames[prov.Super()]; found {
+			if sub := prov.Sub(); sub != "" {
+				return fmt.Sprintf("%s (%s)", name, strings.ToUpper(string(sub)))
+			}
+			return name
+		}
+	}
+	return string(prov)
+}
+
+// NewGameRecord loads the phases, orders and (optionally) public press of game,
+// hiding the orders of unresolved phases except the ones given by viewer.
+func NewGameRecord(ctx context.Context, game *Game, viewer dip.Nation, includePress bool) (*GameRecord, error) {
+	record := &GameRecord{
+		GameID:             game.ID.Encode(),
+		Desc:               game.Desc,
+		Variant:            game.Variant,
+		PhaseLengthMinutes: game.PhaseLengthMinutes,
+		Started:            game.Started,
+		Finished:           game.Finished,
+		CreatedAt:          game.CreatedAt,
+		FinishedAt:         game.FinishedAt,
+		ExportedAt:         time.Now(),
+	}
+	for _, member := range game.Members {
+		record.Members = append(record.Members, MemberRecord{
+			Nation: member.Nation,
+			Name:   member.User.Name,
+		})
+	}
+
+	phases := Phases{}
+	if _, err := datastore.NewQuery(phaseKind).Ancestor(game.ID).GetAll(ctx, &phases); err != nil {
+		return nil, err
+	}
+	orders := Orders{}
+	if _, err := datastore.NewQuery(orderKind).Filter("GameID=", game.ID).GetAll(ctx, &orders); err != nil {
+		return nil, err
+	}
+
+	ordersByPhase := map[int64][]OrderRecord{}
+	for _, order := range orders {
+		ordersByPhase[order.PhaseOrdinal] = append(ordersByPhase[order.PhaseOrdinal], OrderRecord{
+			Nation: order.Nation,
+			Parts:  order.Parts,
+		})
+	}
+
+	for _, phase := range phases {
+		phaseRecord := PhaseRecord{
+			PhaseOrdinal: phase.PhaseOrdinal,
+			Season:       phase.Season,
+			Year:         phase.Year,
+			Type:         phase.Type,
+			Resolved:     phase.Resolved,
+			Units:        phase.Units,
+			SCs:          phase.SCs,
+			Dislodgeds:   phase.Dislodgeds,
+			Dislodgers:   phase.Dislodgers,
+			Bounces:      phase.Bounces,
+			Resolutions:  phase.Resolutions,
+		}
+		for _, order := range ordersByPhase[phase.PhaseOrdinal] {
+			if phase.Resolved || order.Nation == viewer {
+				phaseRecord.Orders = append(phaseRecord.Orders, order)
+			}
+		}
+		sort.Sort(orderRecords(phaseRecord.Orders))
+		record.Phases = append(record.Phases, phaseRecord)
+	}
+	sort.Sort(phaseRecords(record.Phases))
+
+	if includePress {
+		channelID, err := ChannelID(ctx, game.ID, publicChannel(game.Variant))
+		if err != nil {
+			return nil, err
+		}
+		messages := Messages{}
+		if _, err := datastore.NewQuery(messageKind).Ancestor(channelID).Order("CreatedAt").GetAll(ctx, &messages); err != nil {
+			return nil, err
+		}
+		for _, message := range messages {
+			record.Press = append(record.Press, PressRecord{
+				ChannelMembers: message.ChannelMembers,
+				Sender:         message.Sender,
+				Body:           message.Body,
+				CreatedAt:      message.CreatedAt,
+			})
+		}
+	}
+
+	return record, nil
+}
+
+type phaseRecords []PhaseRecord
+
+func (p phaseRecords) Len() int           { return len(p) }
+func (p phaseRecords) Less(i, j int) bool { return p[i].PhaseOrdinal < p[j].PhaseOrdinal }
+func (p phaseRecords) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+type orderRecords []OrderRecord
+
+func (o orderRecords) Len() int { return len(o) }
+func (o orderRecords) Less(i, j int) bool {
+	if o[i].Nation != o[j].Nation {
+		return o[i].Nation < o[j].Nation
+	}
+	return strings.Join(o[i].Parts, " ") < strings.Join(o[j].Parts, " ")
+}
+func (o orderRecords) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+
+// describeOrder renders an order the way DPjudge result mails do, e.g. "Army Vienna -> Galicia".
+func (r *GameRecord) describeOrder(phase *PhaseRecord, order OrderRecord) string {
+	if len(order.Parts) < 2 {
+		return strings.Join(order.Parts, " ")
+	}
+	name := func(prov string) string {
+		return provinceName(r.Variant, dip.Province(prov))
+	}
+	unitDesc := func(prov string) string {
+		if unit, found := phase.unit(dip.Province(prov)); found {
+			return fmt.Sprintf("%s %s", unit.Type, name(prov))
+		}
+		for _, dislodged := range phase.Dislodgeds {
+			if dislodged.Province == dip.Province(prov) {
+				return fmt.Sprintf("%s %s", dislodged.Dislodged.Type, name(prov))
+			}
+		}
+		return name(prov)
+	}
+	src := order.Parts[0]
+	switch order.Parts[1] {
+	case "Hold":
+		return fmt.Sprintf("%s HOLD", unitDesc(src))
+	case "Move":
+		if len(order.Parts) > 2 {
+			return fmt.Sprintf("%s -> %s", unitDesc(src), name(order.Parts[2]))
+		}
+	case "MoveViaConvoy":
+		if len(order.Parts) > 2 {
+			return fmt.Sprintf("%s -> %s (via convoy)", unitDesc(src), name(order.Parts[2]))
+		}
+	case "Support":
+		if len(order.Parts) > 3 && order.Parts[2] != order.Parts[3] {
+			return fmt.Sprintf("%s SUPPORT %s -> %s", unitDesc(src), unitDesc(order.Parts[2]), name(order.Parts[3]))
+		} else if len(order.Parts) > 2 {
+			return fmt.Sprintf("%s SUPPORT %s", unitDesc(src), unitDesc(order.Parts[2]))
+		}
+	case "Convoy":
+		if len(order.Parts) > 3 {
+			return fmt.Sprintf("%s CONVOY %s -> %s", unitDesc(src), unitDesc(order.Parts[2]), name(order.Parts[3]))
+		}
+	case "Disband":
+		return fmt.Sprintf("%s DISBAND", unitDesc(src))
+	case "Build":
+		if len(order.Parts) > 2 {
+			return fmt.Sprintf("Build %s %s", strings.ToLower(order.Parts[2]), name(src))
+		}
+	}
+	parts := []string{unitDesc(src)}
+	for _, part := range order.Parts[1:] {
+		parts = append(parts, strings.ToUpper(part))
+	}
+	return strings.Join(parts, " ")
+}
+
+// resolutionSuffix converts a godip resolution to the DPjudge style failure notes.
+func resolutionSuffix(resolution string) string {
+	switch {
+	case resolution == "" || resolution == "OK":
+		return ""
+	case strings.Contains(resolution, "Bounce"):
+		return " (*bounce*)"
+	case strings.Contains(resolution, "SupportBroken"):
+		return " (*cut*)"
+	case strings.Contains(resolution, "Dislodged"):
+		return " (*dislodged*)"
+	}
+	return " (*void*)"
+}
+
+// Text renders the record in the plain text format used by DPjudge result mails, which jDip can import.
+func (r *GameRecord) Text() string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Game:    %s\n", r.Desc)
+	fmt.Fprintf(buf, "Variant: %s\n", r.Variant)
+	fmt.Fprintf(buf, "Id:      %s\n", r.GameID)
+	for _, member := range r.Members {
+		fmt.Fprintf(buf, "%s: %s\n", member.Nation, member.Name)
+	}
+	for i := range r.Phases {
+		phase := &r.Phases[i]
+		season := string(phase.Season)
+		if phase.Type == "Adjustment" {
+			season = "Winter"
+		}
+		fmt.Fprintf(buf, "\n%s results for %s of %d. (%s)\n\n", phase.Type, season, phase.Year, r.GameID)
+		if !phase.Resolved {
+			buf.WriteString("Phase not yet resolved.\n")
+		}
+		for _, order := range phase.Orders {
+			suffix := ""
+			if phase.Resolved && len(order.Parts) > 0 {
+				suffix = resolutionSuffix(phase.resolution(dip.Province(order.Parts[0])))
+				if suffix == "" && i+1 < len(r.Phases) {
+					for _, dislodged := range r.Phases[i+1].Dislodgeds {
+						if dislodged.Province.Super() == dip.Province(order.Parts[0]).Super() {
+							suffix = " (*dislodged*)"
+						}
+					}
+				}
+			}
+			fmt.Fprintf(buf, "%s: %s.%s\n", order.Nation, r.describeOrder(phase, order), suffix)
+		}
+		if phase.Type == "Adjustment" || i == 0 {
+			owned := map[dip.Nation][]string{}
+			nations := Nations{}
+			for _, sc := range phase.SCs {
+				if _, found := owned[sc.Owner]; !found {
+					nations = append(nations, sc.Owner)
+				}
+				owned[sc.Owner] = append(owned[sc.Owner], provinceName(r.Variant, sc.Province))
+			}
+			sort.Sort(nations)
+			buf.WriteString("\nOwnership of supply centers:\n\n")
+			for _, nation := range nations {
+				sort.Strings(owned[nation])
+				fmt.Fprintf(buf, "%s: %s.\n", nation, strings.Join(owned[nation], ", "))
+			}
+		}
+	}
+	if len(r.Press) > 0 {
+		buf.WriteString("\nPress:\n")
+		for _, press := range r.Press {
+			fmt.Fprintf(buf, "\n%s, %s:\n%s\n", press.Sender, press.CreatedAt.UTC().Format(time.RFC1123), press.Body)
+		}
+	}
+	return buf.String()
+}
+
+func exportGame(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		return err
+	}
+	game.ID = gameID
+
+	if !game.Started {
+		return HTTPErr{"can only export started games", 412}
+	}
+
+	var nation dip.Nation
+	if member, found := game.GetMember(user.Id); found {
+		nation = member.Nation
+	}
+
+	record, err := NewGameRecord(ctx, game, nation, r.Req().URL.Query().Get("press") == "true")
+	if err != nil {
+		return err
+	}
+
+	format := r.Req().URL.Query().Get("format")
+	if format == "" {
+		format = exportFormatJSON
+	}
+
+	switch format {
+	case exportFormatJSON:
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"diplicity-%s.json\"", gameID.Encode()))
+		return json.NewEncoder(w).Encode(record)
+	case exportFormatText:
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"diplicity-%s.txt\"", gameID.Encode()))
+		_, err = w.Write([]byte(record.Text()))
+		return err
+	}
+
+	return HTTPErr{fmt.Sprintf("unknown export format %q", format), 400}
+}
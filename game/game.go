@@ -51,61 +51,61 @@ var (
 func init() {
 	gameListerParams := []string{"variant", "min-reliability", "min-quickness", "max-hater", "max-hated", "min-rating", "max-rating", "limit", "cursor"}
 	GameResource = &Resource{
-		Load:   loadGame,
-		Create: createGame,
+		Load:   auth.Scoped(auth.ReadGamesScope, loadGame),
+		Create: auth.Scoped(auth.WriteGamesScope, createGame),
 		Listers: []Lister{
 			{
 				Path:        "/Games/Open",
 				Route:       ListOpenGamesRoute,
-				Handler:     openGamesHandler.handlePublic,
+				Handler:     auth.ScopedHandler(auth.ReadGamesScope, openGamesHandler.handlePublic),
 				QueryParams: gameListerParams,
 			},
 			{
 				Path:        "/Games/Started",
 				Route:       ListStartedGamesRoute,
-				Handler:     startedGamesHandler.handlePublic,
+				Handler:     auth.ScopedHandler(auth.ReadGamesScope, startedGamesHandler.handlePublic),
 				QueryParams: gameListerParams,
 			},
 			{
 				Path:        "/Games/Finished",
 				Route:       ListFinishedGamesRoute,
-				Handler:     finishedGamesHandler.handlePublic,
+				Handler:     auth.ScopedHandler(auth.ReadGamesScope, finishedGamesHandler.handlePublic),
 				QueryParams: gameListerParams,
 			},
 			{
 				Path:        "/Games/My/Staging",
 				Route:       ListMyStagingGamesRoute,
-				Handler:     stagingGamesHandler.handlePrivate,
+				Handler:     auth.ScopedHandler(auth.ReadGamesScope, stagingGamesHandler.handlePrivate),
 				QueryParams: gameListerParams,
 			},
 			{
 				Path:        "/Games/My/Started",
 				Route:       ListMyStartedGamesRoute,
-				Handler:     startedGamesHandler.handlePrivate,
+				Handler:     auth.ScopedHandler(auth.ReadGamesScope, startedGamesHandler.handlePrivate),
 				QueryParams: gameListerParams,
 			},
 			{
 				Path:        "/Games/My/Finished",
 				Route:       ListMyFinishedGamesRoute,
-				Handler:     finishedGamesHandler.handlePrivate,
+				Handler:     auth.ScopedHandler(auth.ReadGamesScope, finishedGamesHandler.handlePrivate),
 				QueryParams: gameListerParams,
 			},
 			{
 				Path:        "/Games/{user_id}/Staging",
 				Route:       ListOtherStagingGamesRoute,
-				Handler:     stagingGamesHandler.handleOther,
+				Handler:     auth.ScopedHandler(auth.ReadGamesScope, stagingGamesHandler.handleOther),
 				QueryParams: gameListerParams,
 			},
 			{
 				Path:        "/Games/{user_id}/Started",
 				Route:       ListOtherStartedGamesRoute,
-				Handler:     startedGamesHandler.handleOther,
+				Handler:     auth.ScopedHandler(auth.ReadGamesScope, startedGamesHandler.handleOther),
 				QueryParams: gameListerParams,
 			},
 			{
 				Path:        "/Games/{user_id}/Finished",
 				Route:       ListOtherFinishedGamesRoute,
-				Handler:     finishedGamesHandler.handleOther,
+				Handler:     auth.ScopedHandler(auth.ReadGamesScope, finishedGamesHandler.handleOther),
 				QueryParams: gameListerParams,
 			},
 		},
@@ -344,9 +344,11 @@ func (g Games) Item(r Request, user *auth.User, cursor *datastore.Cursor, limit
 type Game struct {
 	ID *datastore.Key `datastore:"-"`
 
-	Started  bool // Game has started.
-	Closed   bool // Game is no longer joinable..
-	Finished bool // Game has reached its end.
+	Started   bool // Game has started.
+	Closed    bool // Game is no longer joinable..
+	Finished  bool // Game has reached its end.
+	Imported  bool // Game was uploaded as a record, and is read only and unrated.
+	Cancelled bool // Game was ended by a superuser before reaching its end.
 
 	Desc               string        `methods:"POST" datastore:",noindex"`
 	Variant            string        `methods:"POST"`
@@ -368,6 +370,9 @@ type Game struct {
 
 	CreatedAt  time.Time
 	FinishedAt time.Time
+
+	// eventCounter is cached by recordGameEvent, since transactions recording several events don't see their own writes.
+	eventCounter *GameEventCounter
 }
 
 func (g *Game) abbrMatchesNations(abbr dip.Nation) int {
@@ -428,7 +433,8 @@ func (g *Game) Joinable() bool {
 }
 
 func (g *Game) Item(r Request) *Item {
-	gameItem := NewItem(g).SetName(g.Desc).AddLink(r.NewLink(GameResource.Link("self", Load, []string{"id", g.ID.Encode()})))
+	gameItem := NewItem(g).SetName(g.Desc).AddLink(r.NewLink(GameResource.Link("self", Load, []string{"id", g.ID.Encode()}))).
+		AddLink(r.NewLink(VariantStatsResource.Link("variant-stats", Load, []string{"name", g.Variant})))
 	user, ok := r.Values()["user"].(*auth.User)
 	if ok {
 		if _, isMember := g.GetMember(user.Id); isMember {
@@ -455,9 +461,34 @@ func (g *Game) Item(r Request) *Item {
 				RouteParams: []string{"game_id", g.ID.Encode()},
 			}))
 		}
-		if g.Finished {
+		if g.Finished && !g.Imported {
 			gameItem.AddLink(r.NewLink(GameResultResource.Link("game-result", Load, []string{"game_id", g.ID.Encode()})))
 		}
+		if g.Started {
+			gameItem.AddLink(r.NewLink(Link{
+				Rel:         "export",
+				Route:       ExportGameRoute,
+				RouteParams: []string{"game_id", g.ID.Encode()},
+				QueryParams: url.Values{"format": []string{exportFormatJSON}},
+			})).AddLink(r.NewLink(Link{
+				Rel:         "gif",
+				Route:       RenderGameGIFRoute,
+				RouteParams: []string{"game_id", g.ID.Encode()},
+			})).AddLink(r.NewLink(Link{
+				Rel:         "sprites",
+				Route:       RenderGameSpritesRoute,
+				RouteParams: []string{"game_id", g.ID.Encode()},
+			})).AddLink(r.NewLink(Link{
+				Rel:         "history",
+				Route:       GameHistoryRoute,
+				RouteParams: []string{"game_id", g.ID.Encode()},
+			}))
+		}
+		gameItem.AddLink(r.NewLink(Link{
+			Rel:         "events",
+			Route:       ListGameEventsRoute,
+			RouteParams: []string{"game_id", g.ID.Encode()},
+		}))
 		if g.Started {
 			gameItem.AddLink(r.NewLink(Link{
 				Rel:         "game-states",
@@ -526,6 +557,13 @@ func createGame(w ResponseWriter, r Request) (*Game, error) {
 		if err := game.Save(ctx); err != nil {
 			return err
 		}
+		if err := recordGameEvent(ctx, game, &GameEvent{
+			GameID: game.ID,
+			Type:   MemberJoinedEvent,
+			UserId: user.Id,
+		}); err != nil {
+			return err
+		}
 		game.Members[0].NewestPhaseState = PhaseState{
 			GameID: game.ID,
 		}
@@ -537,6 +575,17 @@ func createGame(w ResponseWriter, r Request) (*Game, error) {
 	return game, nil
 }
 
+// ApplyProfiles replaces the Google details of the members of the games with the ones in their profiles.
+func (g Games) ApplyProfiles(ctx context.Context) error {
+	users := []*auth.User{}
+	for i := range g {
+		for j := range g[i].Members {
+			users = append(users, &g[i].Members[j].User)
+		}
+	}
+	return auth.ApplyProfiles(ctx, users)
+}
+
 func (g *Game) Redact(viewer *auth.User) {
 	_, isMember := g.GetMember(viewer.Id)
 	for index := range g.Members {
@@ -557,6 +606,13 @@ func (g *Game) Start(ctx context.Context, r Request) error {
 		g.Members[memberIndex].Nation = variants.Variants[g.Variant].Nations[nationIndex]
 	}
 
+	if err := recordGameEvent(ctx, g, &GameEvent{
+		GameID: g.ID,
+		Type:   GameStartedEvent,
+	}); err != nil {
+		return err
+	}
+
 	scheme := "http"
 	if r.Req().TLS != nil {
 		scheme = "https"
@@ -630,6 +686,10 @@ func loadGame(w ResponseWriter, r Request) (*Game, error) {
 
 	game.Redact(user)
 
+	if err := (Games{*game}).ApplyProfiles(ctx); err != nil {
+		return nil, err
+	}
+
 	filtered := Games{*game}
 	activeBans, err := filtered.RemoveBanned(ctx, user.Id)
 	if err != nil {
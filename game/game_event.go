@@ -0,0 +1,239 @@
+package game
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	. "github.com/zond/goaeoas"
+	dip "github.com/zond/godip/common"
+)
+
+const (
+	gameEventKind        = "GameEvent"
+	gameEventCounterKind = "GameEventCounter"
+
+	maxGameEventLimit = 128
+)
+
+// Types of game events.
+const (
+	MemberJoinedEvent      = "member-joined"
+	MemberLeftEvent        = "member-left"
+	GameStartedEvent       = "game-started"
+	PhaseResolvedEvent     = "phase-resolved"
+	MessagePostedEvent     = "message-posted"
+	PhaseStateChangedEvent = "phase-state-changed"
+	GameFinishedEvent      = "game-finished"
+)
+
+// GameEvent is an entry in the ordered event log of a game. The ID is its sequence number in the log, and doubles as cursor.
+type GameEvent struct {
+	ID             string `datastore:"-"`
+	GameID         *datastore.Key
+	Type           string
+	CreatedAt      time.Time
+	UserId         string
+	Nation         dip.Nation
+	PhaseOrdinal   int64
+	ChannelMembers Nations
+	MessageID      *datastore.Key
+}
+
+// GameEventCounter numbers the events of a game. It's a child of the game, so that recording events doesn't rewrite the game.
+type GameEventCounter struct {
+	NEvents int64
+}
+
+func GameEventCounterID(ctx context.Context, gameID *datastore.Key) *datastore.Key {
+	return datastore.NewKey(ctx, gameEventCounterKind, "", 1, gameID)
+}
+
+func GameEventID(ctx context.Context, gameID *datastore.Key, id int64) *datastore.Key {
+	return datastore.NewKey(ctx, gameEventKind, "", id, gameID)
+}
+
+// recordGameEvent stores the event in the log of the game, numbered by the event counter of the game.
+// Call it in the transaction changing the game, with the game loaded in that transaction, to make the log agree with the game.
+func recordGameEvent(ctx context.Context, game *Game, event *GameEvent) error {
+	if game.eventCounter == nil {
+		counter := &GameEventCounter{}
+		if err := datastore.Get(ctx, GameEventCounterID(ctx, game.ID), counter); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		game.eventCounter = counter
+	}
+	game.eventCounter.NEvents++
+	id := game.eventCounter.NEvents
+	event.ID = fmt.Sprint(id)
+	event.CreatedAt = time.Now()
+	_, err := datastore.PutMulti(ctx, []*datastore.Key{
+		GameEventCounterID(ctx, game.ID),
+		GameEventID(ctx, game.ID, id),
+	}, []interface{}{
+		game.eventCounter,
+		event,
+	})
+	return err
+}
+
+// VisibleTo returns whether the viewer may see the event. Messages are only visible to the members of their channels, and phase state changes only to the member whose phase state changed, until the game is finished.
+func (g *GameEvent) VisibleTo(game *Game, viewer dip.Nation, muted map[dip.Nation]struct{}) bool {
+	switch g.Type {
+	case MessagePostedEvent:
+		if _, isMuted := muted[g.Nation]; isMuted {
+			return false
+		}
+		return game.Finished || g.ChannelMembers.Includes(viewer) || isPublic(game.Variant, g.ChannelMembers)
+	case PhaseStateChangedEvent:
+		return game.Finished || (viewer != "" && g.Nation == viewer)
+	}
+	return true
+}
+
+func (g *GameEvent) Item(r Request) *Item {
+	return NewItem(g).SetName(g.Type)
+}
+
+type GameEvents []GameEvent
+
+func (g GameEvents) Item(r Request, gameID *datastore.Key, after string, limit int, more bool) *Item {
+	eventItems := make(List, len(g))
+	for i := range g {
+		eventItems[i] = g[i].Item(r)
+	}
+	selfParams := url.Values{}
+	if after != "" {
+		selfParams.Set("after", after)
+	}
+	eventsItem := NewItem(eventItems).SetName("game-events").AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ListGameEventsRoute,
+		RouteParams: []string{"game_id", gameID.Encode()},
+		QueryParams: selfParams,
+	})).SetDesc([][]string{
+		[]string{
+			"Game events",
+			"Each game keeps an ordered log of events: members joining or leaving, the game starting, phases resolving, messages being posted, phase states changing and the game finishing.",
+			"Events describe what changed, not the new state. Load the changed resource to see it.",
+		},
+		[]string{
+			"Incremental sync",
+			"The ID of each event is a cursor. Add an 'after' query parameter with the ID of the last event you have seen to list only newer events.",
+			fmt.Sprintf("At most %d events are listed at a time. If there are more, a 'next' link will be available.", maxGameEventLimit),
+		},
+		[]string{
+			"Visibility",
+			"Messages are only listed for the members of their channels, and phase state changes only for the member whose phase state changed, until the game is finished.",
+		},
+	})
+	if more && len(g) > 0 {
+		eventsItem.AddLink(r.NewLink(Link{
+			Rel:         "next",
+			Route:       ListGameEventsRoute,
+			RouteParams: []string{"game_id", gameID.Encode()},
+			QueryParams: url.Values{
+				"after": []string{g[len(g)-1].ID},
+				"limit": []string{fmt.Sprint(limit)},
+			},
+		}))
+	}
+	return eventsItem
+}
+
+// loadGameEvents returns up to limit events of the game after the cursor visible to the viewer, and whether there are more.
+func loadGameEvents(ctx context.Context, game *Game, viewer dip.Nation, after int64, limit int) (GameEvents, bool, error) {
+	muted := map[dip.Nation]struct{}{}
+	if viewer != "" {
+		gameState, err := GetGameState(ctx, game.ID, viewer)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, nat := range gameState.Muted {
+			muted[nat] = struct{}{}
+		}
+	}
+
+	result := GameEvents{}
+	for {
+		events := GameEvents{}
+		q := datastore.NewQuery(gameEventKind).Ancestor(game.ID)
+		if after > 0 {
+			q = q.Filter("__key__ >", GameEventID(ctx, game.ID, after))
+		}
+		ids, err := q.Order("__key__").Limit(limit+1).GetAll(ctx, &events)
+		if err != nil {
+			return nil, false, err
+		}
+		for i := range events {
+			if len(result) == limit {
+				return result, true, nil
+			}
+			events[i].ID = fmt.Sprint(ids[i].IntID())
+			if events[i].VisibleTo(game, viewer, muted) {
+				result = append(result, events[i])
+			}
+			after = ids[i].IntID()
+		}
+		if len(events) <= limit {
+			return result, false, nil
+		}
+	}
+}
+
+func listGameEvents(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	var after int64
+	afterParam := r.Req().URL.Query().Get("after")
+	if afterParam != "" {
+		if after, err = strconv.ParseInt(afterParam, 10, 64); err != nil {
+			return HTTPErr{fmt.Sprintf("unparseable cursor %q", afterParam), 400}
+		}
+	}
+
+	limit := maxGameEventLimit
+	if limitParam := r.Req().URL.Query().Get("limit"); limitParam != "" {
+		if limit, err = strconv.Atoi(limitParam); err != nil {
+			return err
+		}
+		if limit < 1 || limit > maxGameEventLimit {
+			limit = maxGameEventLimit
+		}
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		return err
+	}
+	game.ID = gameID
+
+	var viewer dip.Nation
+	if member, isMember := game.GetMember(user.Id); isMember {
+		viewer = member.Nation
+	}
+
+	events, more, err := loadGameEvents(ctx, game, viewer, after, limit)
+	if err != nil {
+		return err
+	}
+
+	w.SetContent(events.Item(r, gameID, afterParam, limit, more))
+	return nil
+}
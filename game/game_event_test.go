@@ -0,0 +1,65 @@
+package game
+
+import (
+	"testing"
+
+	dip "github.com/zond/godip/common"
+	"github.com/zond/godip/variants"
+)
+
+func TestGameEventVisibleTo(t *testing.T) {
+	game := &Game{Variant: "Classical"}
+	public := Nations{}
+	for _, nat := range variants.Variants[game.Variant].Nations {
+		public = append(public, nat)
+	}
+	privateMessage := &GameEvent{
+		Type:           MessagePostedEvent,
+		Nation:         "Austria",
+		ChannelMembers: Nations{"Austria", "England"},
+	}
+	publicMessage := &GameEvent{
+		Type:           MessagePostedEvent,
+		Nation:         "Austria",
+		ChannelMembers: public,
+	}
+	phaseStateChange := &GameEvent{
+		Type:   PhaseStateChangedEvent,
+		Nation: "Austria",
+	}
+	memberJoined := &GameEvent{
+		Type:   MemberJoinedEvent,
+		Nation: "Austria",
+	}
+	noMuted := map[dip.Nation]struct{}{}
+	austriaMuted := map[dip.Nation]struct{}{"Austria": struct{}{}}
+
+	for _, tc := range []struct {
+		desc    string
+		event   *GameEvent
+		viewer  dip.Nation
+		muted   map[dip.Nation]struct{}
+		visible bool
+	}{
+		{"private message to channel member", privateMessage, "England", noMuted, true},
+		{"private message to other member", privateMessage, "France", noMuted, false},
+		{"private message to non member", privateMessage, "", noMuted, false},
+		{"public message to non member", publicMessage, "", noMuted, true},
+		{"message from muted sender", publicMessage, "England", austriaMuted, false},
+		{"phase state change to its member", phaseStateChange, "Austria", noMuted, true},
+		{"phase state change to other member", phaseStateChange, "England", noMuted, false},
+		{"phase state change to non member", phaseStateChange, "", noMuted, false},
+		{"member joining to non member", memberJoined, "", noMuted, true},
+	} {
+		if got := tc.event.VisibleTo(game, tc.viewer, tc.muted); got != tc.visible {
+			t.Errorf("%s: got visible %v, wanted %v", tc.desc, got, tc.visible)
+		}
+	}
+
+	game.Finished = true
+	for _, event := range []*GameEvent{privateMessage, phaseStateChange} {
+		if !event.VisibleTo(game, "France", noMuted) {
+			t.Errorf("%v of %v wasn't visible to France after the game finished", event.Type, event.Nation)
+		}
+	}
+}
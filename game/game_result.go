@@ -21,6 +21,8 @@ type GameScore struct {
 	Member dip.Nation
 	SCs    int
 	Score  float64
+	// The user as shown in the game, populated when the result is loaded.
+	User auth.User `datastore:"-"`
 }
 
 type GameResults []GameResult
@@ -38,7 +40,10 @@ type GameResult struct {
 	AllUsers          []string
 	Scores            []GameScore
 	Rated             bool
+	StatsAggregated   bool
 	CreatedAt         time.Time
+	// The GameHistory of the game, stored the first time anyone asks for it.
+	HistoryJSON string `datastore:",noindex" json:"-"`
 }
 
 func (g *GameResult) AssignScores() {
@@ -91,8 +96,21 @@ func loadGameResult(w ResponseWriter, r Request) (*GameResult, error) {
 
 	gameResultID := GameResultID(ctx, gameID)
 
+	game := &Game{}
 	gameResult := &GameResult{}
-	if err := datastore.Get(ctx, gameResultID, gameResult); err != nil {
+	if err := datastore.GetMulti(ctx, []*datastore.Key{gameID, gameResultID}, []interface{}{game, gameResult}); err != nil {
+		return nil, err
+	}
+
+	users := []*auth.User{}
+	for i := range gameResult.Scores {
+		if member, found := game.GetMember(gameResult.Scores[i].UserId); found {
+			gameResult.Scores[i].User = member.User
+			gameResult.Scores[i].User.Email = ""
+			users = append(users, &gameResult.Scores[i].User)
+		}
+	}
+	if err := auth.ApplyProfiles(ctx, users); err != nil {
 		return nil, err
 	}
 
@@ -100,7 +118,7 @@ func loadGameResult(w ResponseWriter, r Request) (*GameResult, error) {
 }
 
 var GameResultResource = &Resource{
-	Load:     loadGameResult,
+	Load:     auth.Scoped(auth.ReadGamesScope, loadGameResult),
 	FullPath: "/Game/{game_id}/GameResult",
 }
 
@@ -3,6 +3,7 @@ package game
 import (
 	"fmt"
 	"io/ioutil"
+	"sort"
 
 	"github.com/zond/diplicity/auth"
 	"github.com/zond/godip/variants"
@@ -22,14 +23,14 @@ var GameStateResource *Resource
 
 func init() {
 	GameStateResource = &Resource{
-		Load:     loadGameState,
-		Update:   updateGameState,
+		Load:     auth.Scoped(auth.ReadGamesScope, loadGameState),
+		Update:   auth.Scoped(auth.ManageConfigScope, updateGameState),
 		FullPath: "/Game/{game_id}/GameState/{nation}",
 		Listers: []Lister{
 			{
 				Path:    "/Game/{game_id}/GameStates",
 				Route:   ListGameStatesRoute,
-				Handler: listGameStates,
+				Handler: auth.ScopedHandler(auth.ReadGamesScope, listGameStates),
 			},
 		},
 	}
@@ -56,14 +57,53 @@ func (g GameStates) Item(r Request, gameID *datastore.Key) *Item {
 			"Adding another member nation to the 'Muted' list will hide all press from that member.",
 			"Note that messages from muted members will still count towards the totals in the channel listings.",
 		},
+		[]string{
+			"Notifications",
+			"Setting 'MuteMessageNotifications' or 'MutePhaseNotifications' will stop message or phase notifications from this game, without hiding anything.",
+			"Adding a channel, as its comma separated member nations, to the 'MutedChannelNotifications' list will stop message notifications from that channel only.",
+			"Deadline reminders are sent regardless.",
+		},
 	})
 	return gameStatesItem
 }
 
 type GameState struct {
-	GameID *datastore.Key
-	Nation dip.Nation
-	Muted  []dip.Nation `methods:"PUT"`
+	GameID                    *datastore.Key
+	Nation                    dip.Nation
+	Muted                     []dip.Nation `methods:"PUT"`
+	MuteMessageNotifications  bool         `methods:"PUT"`
+	MutePhaseNotifications    bool         `methods:"PUT"`
+	MutedChannelNotifications []string     `methods:"PUT"`
+}
+
+// MutesMessageNotifications returns whether the member wants no notifications about messages in the channel.
+func (g *GameState) MutesMessageNotifications(channelMembers Nations) bool {
+	if g.MuteMessageNotifications {
+		return true
+	}
+	channel := channelMembers.String()
+	for _, muted := range g.MutedChannelNotifications {
+		if muted == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// GetGameState returns the game state of the nation, or an empty one if the member never updated it.
+func GetGameState(ctx context.Context, gameID *datastore.Key, nation dip.Nation) (*GameState, error) {
+	gameStateID, err := GameStateID(ctx, gameID, nation)
+	if err != nil {
+		return nil, err
+	}
+	gameState := &GameState{}
+	if err := datastore.Get(ctx, gameStateID, gameState); err == datastore.ErrNoSuchEntity {
+		gameState.GameID = gameID
+		gameState.Nation = nation
+	} else if err != nil {
+		return nil, err
+	}
+	return gameState, nil
 }
 
 func (g *GameState) HasMuted(nat dip.Nation) bool {
@@ -148,6 +188,14 @@ func updateGameState(w ResponseWriter, r Request) (*GameState, error) {
 		gameState.GameID = gameID
 		gameState.Nation = member.Nation
 
+		// Channels are identified by their sorted member nations, so accept any order.
+		for i, channel := range gameState.MutedChannelNotifications {
+			channelMembers := Nations{}
+			channelMembers.FromString(channel)
+			sort.Sort(channelMembers)
+			gameState.MutedChannelNotifications[i] = channelMembers.String()
+		}
+
 		return gameState.Save(ctx)
 	}, &datastore.TransactionOptions{XG: false}); err != nil {
 		return nil, err
@@ -90,6 +90,10 @@ func handleReRate(w ResponseWriter, r Request) error {
 		return HTTPErr{"unauthorized", 403}
 	}
 
+	if err := auth.Audit(ctx, r, "re-rate", nil); err != nil {
+		return err
+	}
+
 	ids, err := datastore.NewQuery(glickoKind).KeysOnly().GetAll(ctx, nil)
 	if err != nil {
 		return err
@@ -169,6 +173,12 @@ func processGlickos(ctx context.Context, gameResult *GameResult, onlyUnrated boo
 			return nil
 		}
 		gameResult.Rated = true
+		if !gameResult.StatsAggregated {
+			if err := aggregateVariantStatsFunc.EnqueueIn(ctx, 0, gameResult.GameID); err != nil {
+				log.Errorf(ctx, "Unable to enqueue adding %v to the variant stats: %v; hope datastore gets fixed", PP(gameResult), err)
+				return err
+			}
+		}
 		if _, err := datastore.Put(ctx, gameResultID, gameResult); err != nil {
 			log.Errorf(ctx, "Unable to save game result %v after setting it as rated: %v; hope datastore gets fixed", PP(gameResult), err)
 			return err
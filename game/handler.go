@@ -2,6 +2,7 @@ package game
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"reflect"
 	"strconv"
@@ -29,39 +30,62 @@ const (
 )
 
 const (
-	GetSWJSRoute                = "GetSWJS"
-	GetMainJSRoute              = "GetMainJS"
-	ConfigureRoute              = "AuthConfigure"
-	IndexRoute                  = "Index"
-	ListOpenGamesRoute          = "ListOpenGames"
-	ListStartedGamesRoute       = "ListStartedGames"
-	ListFinishedGamesRoute      = "ListFinishedGames"
-	ListMyStagingGamesRoute     = "ListMyStagingGames"
-	ListMyStartedGamesRoute     = "ListMyStartedGames"
-	ListMyFinishedGamesRoute    = "ListMyFinishedGames"
-	ListOtherStagingGamesRoute  = "ListOtherStagingGames"
-	ListOtherStartedGamesRoute  = "ListOtherStartedGames"
-	ListOtherFinishedGamesRoute = "ListOtherFinishedGames"
-	ListOrdersRoute             = "ListOrders"
-	ListPhasesRoute             = "ListPhases"
-	ListPhaseStatesRoute        = "ListPhaseStates"
-	ListGameStatesRoute         = "ListGameStates"
-	ListOptionsRoute            = "ListOptions"
-	ListChannelsRoute           = "ListChannels"
-	ListMessagesRoute           = "ListMessages"
-	ListBansRoute               = "ListBans"
-	ListTopRatedPlayersRoute    = "ListTopRatedPlayers"
-	ListTopReliablePlayersRoute = "ListTopReliablePlayers"
-	ListTopHatedPlayersRoute    = "ListTopHatedPlayers"
-	ListTopHaterPlayersRoute    = "ListTopHaterPlayers"
-	ListTopQuickPlayersRoute    = "ListTopQuickPlayers"
-	ListFlaggedMessagesRoute    = "ListFlaggedMessages"
-	DevResolvePhaseTimeoutRoute = "DevResolvePhaseTimeout"
-	DevUserStatsUpdateRoute     = "DevUserStatsUpdate"
-	ReceiveMailRoute            = "ReceiveMail"
-	RenderPhaseMapRoute         = "RenderPhaseMap"
-	RenderPhaseMapSVGRoute      = "RenderPhaseMapSVG"
-	ReRateRoute                 = "ReRate"
+	GetSWJSRoute                    = "GetSWJS"
+	GetMainJSRoute                  = "GetMainJS"
+	ConfigureRoute                  = "AuthConfigure"
+	IndexRoute                      = "Index"
+	ListOpenGamesRoute              = "ListOpenGames"
+	ListStartedGamesRoute           = "ListStartedGames"
+	ListFinishedGamesRoute          = "ListFinishedGames"
+	ListMyStagingGamesRoute         = "ListMyStagingGames"
+	ListMyStartedGamesRoute         = "ListMyStartedGames"
+	ListMyFinishedGamesRoute        = "ListMyFinishedGames"
+	ListOtherStagingGamesRoute      = "ListOtherStagingGames"
+	ListOtherStartedGamesRoute      = "ListOtherStartedGames"
+	ListOtherFinishedGamesRoute     = "ListOtherFinishedGames"
+	ListOrdersRoute                 = "ListOrders"
+	ListPhasesRoute                 = "ListPhases"
+	ListPhaseStatesRoute            = "ListPhaseStates"
+	ListGameStatesRoute             = "ListGameStates"
+	ListOptionsRoute                = "ListOptions"
+	ListChannelsRoute               = "ListChannels"
+	ListMessagesRoute               = "ListMessages"
+	ListBansRoute                   = "ListBans"
+	ListTopRatedPlayersRoute        = "ListTopRatedPlayers"
+	ListTopReliablePlayersRoute     = "ListTopReliablePlayers"
+	ListTopHatedPlayersRoute        = "ListTopHatedPlayers"
+	ListTopHaterPlayersRoute        = "ListTopHaterPlayers"
+	ListTopQuickPlayersRoute        = "ListTopQuickPlayers"
+	ListFlaggedMessagesRoute        = "ListFlaggedMessages"
+	DevResolvePhaseTimeoutRoute     = "DevResolvePhaseTimeout"
+	DevUserStatsUpdateRoute         = "DevUserStatsUpdate"
+	ExportGameRoute                 = "ExportGame"
+	ImportGameRoute                 = "ImportGame"
+	ReceiveMailRoute                = "ReceiveMail"
+	RenderPhaseMapRoute             = "RenderPhaseMap"
+	RenderPhaseMapSVGRoute          = "RenderPhaseMapSVG"
+	RenderPhaseMapPNGRoute          = "RenderPhaseMapPNG"
+	RenderPhaseTextRoute            = "RenderPhaseText"
+	PhaseDiffRoute                  = "PhaseDiff"
+	GameHistoryRoute                = "GameHistory"
+	RenderGameGIFRoute              = "RenderGameGIF"
+	RenderGameSpritesRoute          = "RenderGameSprites"
+	ReRateRoute                     = "ReRate"
+	AdminResolvePhaseRoute          = "AdminResolvePhase"
+	AdminDeleteGameRoute            = "AdminDeleteGame"
+	AdminCancelGameRoute            = "AdminCancelGame"
+	AdminRemoveMemberRoute          = "AdminRemoveMember"
+	AdminReplaceMemberRoute         = "AdminReplaceMember"
+	AdminResetPhaseStateRoute       = "AdminResetPhaseState"
+	AdminRecomputeUserStatsRoute    = "AdminRecomputeUserStats"
+	AdminRecomputeAllUserStatsRoute = "AdminRecomputeAllUserStats"
+	AdminDisableUserRoute           = "AdminDisableUser"
+	AdminEnableUserRoute            = "AdminEnableUser"
+	ListUserExportsRoute            = "ListUserExports"
+	DownloadUserExportRoute         = "DownloadUserExport"
+	DeleteUserRoute                 = "DeleteUser"
+	ListGameEventsRoute             = "ListGameEvents"
+	ListUserUpdatesRoute            = "ListUserUpdates"
 )
 
 type userStatsHandler struct {
@@ -107,8 +131,13 @@ func (h *userStatsHandler) handle(w ResponseWriter, r Request) error {
 		}
 	}
 
+	users := make([]*auth.User, len(stats))
 	for i := range stats {
 		stats[i].Redact()
+		users[i] = &stats[i].User
+	}
+	if err := auth.ApplyProfiles(ctx, users); err != nil {
+		return err
 	}
 
 	var cursP *datastore.Cursor
@@ -219,6 +248,11 @@ func (h *gamesHandler) prepare(w ResponseWriter, r Request, userId *string) (*ga
 	q := h.query
 	if userId != nil {
 		q = q.Filter("Members.User.Id=", *userId)
+	} else {
+		// Imported games have no members, and would otherwise crowd the public listings.
+		req.detailFilters = append(req.detailFilters, func(g *Game) bool {
+			return !g.Imported
+		})
 	}
 
 	if variantFilter := uq.Get("variant"); variantFilter != "" {
@@ -296,6 +330,10 @@ func (req *gamesReq) handle(userId *string) error {
 		return err
 	}
 
+	if err := games.ApplyProfiles(req.ctx); err != nil {
+		return err
+	}
+
 	req.w.SetContent(games.Item(req.r, req.user, curs, req.limit, req.h.name, req.h.desc, req.h.route))
 	return nil
 }
@@ -392,17 +430,24 @@ var (
 )
 
 type configuration struct {
-	OAuth      *auth.OAuth
-	FCMConf    *FCMConf
-	SendGrid   *SendGrid
-	Superusers *auth.Superusers
+	OAuth         *auth.OAuth
+	FCMConf       *FCMConf
+	SendGrid      *SendGrid
+	Superusers    *auth.Superusers
+	OIDCProviders []*auth.OIDCProvider
+	RateLimits    *auth.RateLimits
+	Reminders     *Reminders
 }
 
 func handleConfigure(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
+	body, err := ioutil.ReadAll(r.Req().Body)
+	if err != nil {
+		return err
+	}
 	conf := &configuration{}
-	if err := json.NewDecoder(r.Req().Body).Decode(conf); err != nil {
+	if err := json.Unmarshal(body, conf); err != nil {
 		return err
 	}
 	if conf.OAuth != nil {
@@ -425,21 +470,60 @@ func handleConfigure(w ResponseWriter, r Request) error {
 			return err
 		}
 	}
-	return nil
+	if conf.RateLimits != nil {
+		if err := auth.SetRateLimits(ctx, conf.RateLimits); err != nil {
+			return err
+		}
+	}
+	if conf.Reminders != nil {
+		if err := SetReminders(ctx, conf.Reminders); err != nil {
+			return err
+		}
+	}
+	for _, provider := range conf.OIDCProviders {
+		if err := auth.SetOIDCProvider(ctx, provider); err != nil {
+			return err
+		}
+	}
+	return auth.Audit(ctx, r, "configure", body)
 }
 
 func SetupRouter(r *mux.Router) {
 	router = r
+	auth.SendMail = sendPlainMail
 	Handle(r, "/_configure", []string{"POST"}, ConfigureRoute, handleConfigure)
 	Handle(r, "/_re-rate", []string{"GET"}, ReRateRoute, handleReRate)
 	Handle(r, "/_ah/mail/{recipient}", []string{"POST"}, ReceiveMailRoute, receiveMail)
-	Handle(r, "/", []string{"GET"}, IndexRoute, handleIndex)
-	Handle(r, "/Game/{game_id}/Channels", []string{"GET"}, ListChannelsRoute, listChannels)
+	Handle(r, "/", []string{"GET"}, IndexRoute, auth.ScopedHandler(auth.AnyScope, handleIndex))
+	Handle(r, "/Game/{game_id}/Channels", []string{"GET"}, ListChannelsRoute, auth.ScopedHandler(auth.ReadPressScope, listChannels))
 	Handle(r, "/Game/{game_id}/Phase/{phase_ordinal}/_dev_resolve_timeout", []string{"GET"}, DevResolvePhaseTimeoutRoute, devResolvePhaseTimeout)
 	Handle(r, "/User/{user_id}/Stats/_dev_update", []string{"PUT"}, DevUserStatsUpdateRoute, devUserStatsUpdate)
-	Handle(r, "/Game/{game_id}/Phase/{phase_ordinal}/Options", []string{"GET"}, ListOptionsRoute, listOptions)
-	Handle(r, "/Game/{game_id}/Phase/{phase_ordinal}/Map", []string{"GET"}, RenderPhaseMapRoute, renderPhaseMap)
-	Handle(r, "/Game/{game_id}/Phase/{phase_ordinal}/SVG", []string{"GET"}, RenderPhaseMapSVGRoute, renderPhaseMapSVG)
+	Handle(r, "/Game/{game_id}/Phase/{phase_ordinal}/Options", []string{"GET"}, ListOptionsRoute, auth.ScopedHandler(auth.ReadGamesScope, listOptions))
+	Handle(r, "/Game/{game_id}/Phase/{phase_ordinal}/Map", []string{"GET"}, RenderPhaseMapRoute, auth.ScopedHandler(auth.ReadGamesScope, renderPhaseMap))
+	Handle(r, "/Game/{game_id}/Phase/{phase_ordinal}/SVG", []string{"GET"}, RenderPhaseMapSVGRoute, auth.ScopedHandler(auth.ReadGamesScope, renderPhaseMapSVG))
+	Handle(r, "/Game/{game_id}/Phase/{phase_ordinal}/PNG", []string{"GET"}, RenderPhaseMapPNGRoute, auth.ScopedHandler(auth.ReadGamesScope, renderPhaseMapPNG))
+	// Registered before the phase resource, to serve phases as text to clients preferring that.
+	Handle(r.MatcherFunc(prefersPlainText).Subrouter(), "/Game/{game_id}/Phase/{phase_ordinal}", []string{"GET"}, RenderPhaseTextRoute, auth.ScopedHandler(auth.ReadGamesScope, renderPhaseText))
+	Handle(r, "/Game/{game_id}/Phase/{phase_ordinal}/Diff", []string{"GET"}, PhaseDiffRoute, auth.ScopedHandler(auth.ReadGamesScope, loadPhaseDiff))
+	Handle(r, "/Game/{game_id}/History", []string{"GET"}, GameHistoryRoute, auth.ScopedHandler(auth.ReadGamesScope, loadGameHistory))
+	Handle(r, "/Game/{game_id}/GIF", []string{"GET"}, RenderGameGIFRoute, auth.ScopedHandler(auth.ReadGamesScope, renderGameGIF))
+	Handle(r, "/Game/{game_id}/Sprites", []string{"GET"}, RenderGameSpritesRoute, auth.ScopedHandler(auth.ReadGamesScope, renderGameSprites))
+	Handle(r, "/Game/{game_id}/Export", []string{"GET"}, ExportGameRoute, auth.ScopedHandler(auth.ReadGamesScope, exportGame))
+	Handle(r, "/Game/{game_id}/Events", []string{"GET"}, ListGameEventsRoute, auth.ScopedHandler(auth.ReadGamesScope, listGameEvents))
+	Handle(r, "/Games/Import", []string{"POST"}, ImportGameRoute, auth.ScopedHandler(auth.WriteGamesScope, importGame))
+	Handle(r, "/Admin/Game/{game_id}", []string{"DELETE"}, AdminDeleteGameRoute, adminDeleteGame)
+	Handle(r, "/Admin/Game/{game_id}/Cancel", []string{"POST"}, AdminCancelGameRoute, adminCancelGame)
+	Handle(r, "/Admin/Game/{game_id}/Member/{user_id}", []string{"DELETE"}, AdminRemoveMemberRoute, adminRemoveMember)
+	Handle(r, "/Admin/Game/{game_id}/Member/{user_id}/Replace", []string{"POST"}, AdminReplaceMemberRoute, adminReplaceMember)
+	Handle(r, "/Admin/Game/{game_id}/Phase/{phase_ordinal}/Resolve", []string{"POST"}, AdminResolvePhaseRoute, adminResolvePhase)
+	Handle(r, "/Admin/Game/{game_id}/Phase/{phase_ordinal}/PhaseState/{nation}/Reset", []string{"POST"}, AdminResetPhaseStateRoute, adminResetPhaseState)
+	Handle(r, "/Admin/User/{user_id}/Stats/Recompute", []string{"POST"}, AdminRecomputeUserStatsRoute, adminRecomputeUserStats)
+	Handle(r, "/Admin/Users/Stats/Recompute", []string{"POST"}, AdminRecomputeAllUserStatsRoute, adminRecomputeAllUserStats)
+	Handle(r, "/Admin/User/{user_id}/Disable", []string{"POST"}, AdminDisableUserRoute, adminDisableUser)
+	Handle(r, "/Admin/User/{user_id}/Enable", []string{"POST"}, AdminEnableUserRoute, adminEnableUser)
+	Handle(r, "/User/{user_id}/Export/{export_id}/Archive", []string{"GET"}, DownloadUserExportRoute, auth.ScopedHandler(auth.ManageConfigScope, downloadUserExport))
+	Handle(r, "/User/{user_id}", []string{"DELETE"}, DeleteUserRoute, deleteUser)
+	Handle(r, "/User/{user_id}/Updates", []string{"GET"}, ListUserUpdatesRoute, auth.ScopedHandler(auth.ReadPressScope, listUserUpdates))
 	HandleResource(r, GameResource)
 	HandleResource(r, MemberResource)
 	HandleResource(r, PhaseResource)
@@ -451,6 +535,9 @@ func SetupRouter(r *mux.Router) {
 	HandleResource(r, BanResource)
 	HandleResource(r, PhaseResultResource)
 	HandleResource(r, UserStatsResource)
+	HandleResource(r, UserExportResource)
+	HandleResource(r, VariantStatsResource)
+	HandleResource(r, VersusResource)
 	HandleResource(r, MessageFlagResource)
 	HandleResource(r, FlaggedMessagesResource)
 	HeadCallback(func(head *Node) error {
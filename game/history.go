@@ -0,0 +1,168 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip/variants"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	. "github.com/zond/goaeoas"
+	dip "github.com/zond/godip/common"
+)
+
+type NationCounts struct {
+	Nation dip.Nation
+	SCs    int
+	Units  int
+}
+
+type HistoryPoint struct {
+	PhaseOrdinal int64
+	Season       dip.Season
+	Year         int
+	Type         dip.PhaseType
+	Nations      []NationCounts
+}
+
+// GameHistory contains the number of supply centers and units of each nation, for each phase of a game.
+type GameHistory struct {
+	GameID *datastore.Key
+	Points []HistoryPoint
+}
+
+func (h *GameHistory) Item(r Request) *Item {
+	return NewItem(h).SetName("game-history").AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       GameHistoryRoute,
+		RouteParams: []string{"game_id", h.GameID.Encode()},
+	}))
+}
+
+// NewGameHistory counts the supply centers and units of all phases of game.
+func NewGameHistory(ctx context.Context, game *Game) (*GameHistory, error) {
+	variant, found := variants.Variants[game.Variant]
+	if !found {
+		return nil, fmt.Errorf("unknown variant %q", game.Variant)
+	}
+
+	// Phase keys are their ordinals, so ancestor queries return them in order.
+	phases := Phases{}
+	if _, err := datastore.NewQuery(phaseKind).Ancestor(game.ID).GetAll(ctx, &phases); err != nil {
+		return nil, err
+	}
+
+	history := &GameHistory{
+		GameID: game.ID,
+		Points: make([]HistoryPoint, 0, len(phases)),
+	}
+	for _, phase := range phases {
+		scs := map[dip.Nation]int{}
+		for _, sc := range phase.SCs {
+			scs[sc.Owner]++
+		}
+		units := map[dip.Nation]int{}
+		for _, unit := range phase.Units {
+			units[unit.Unit.Nation]++
+		}
+		point := HistoryPoint{
+			PhaseOrdinal: phase.PhaseOrdinal,
+			Season:       phase.Season,
+			Year:         phase.Year,
+			Type:         phase.Type,
+			Nations:      make([]NationCounts, 0, len(variant.Nations)),
+		}
+		for _, nat := range variant.Nations {
+			point.Nations = append(point.Nations, NationCounts{
+				Nation: nat,
+				SCs:    scs[nat],
+				Units:  units[nat],
+			})
+		}
+		history.Points = append(history.Points, point)
+	}
+
+	return history, nil
+}
+
+// finishedGameHistory returns the history cached in the result of the finished game, computing and caching it if necessary.
+// Games without results, like imported games, get their history computed every time.
+func finishedGameHistory(ctx context.Context, game *Game) (*GameHistory, error) {
+	gameResult := &GameResult{}
+	if err := datastore.Get(ctx, GameResultID(ctx, game.ID), gameResult); err == datastore.ErrNoSuchEntity {
+		return NewGameHistory(ctx, game)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if gameResult.HistoryJSON != "" {
+		history := &GameHistory{}
+		err := json.Unmarshal([]byte(gameResult.HistoryJSON), history)
+		if err == nil {
+			return history, nil
+		}
+		log.Warningf(ctx, "Unable to parse history cached in %v: %v; computing it again", PP(gameResult), err)
+	}
+
+	history, err := NewGameHistory(ctx, game)
+	if err != nil {
+		return nil, err
+	}
+	historyJSON, err := json.Marshal(history)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		gameResult := &GameResult{}
+		if err := datastore.Get(ctx, GameResultID(ctx, game.ID), gameResult); err != nil {
+			return err
+		}
+		gameResult.HistoryJSON = string(historyJSON)
+		return gameResult.Save(ctx)
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		log.Warningf(ctx, "Unable to cache history of %v: %v; will compute it again next time", game.ID, err)
+	}
+
+	return history, nil
+}
+
+func loadGameHistory(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if _, ok := r.Values()["user"].(*auth.User); !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		return err
+	}
+	game.ID = gameID
+
+	if !game.Started {
+		return HTTPErr{"can only show the history of started games", 412}
+	}
+
+	var history *GameHistory
+	if game.Finished {
+		history, err = finishedGameHistory(ctx, game)
+	} else {
+		history, err = NewGameHistory(ctx, game)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.SetContent(history.Item(r))
+	return nil
+}
@@ -0,0 +1,261 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip/variants"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	. "github.com/zond/goaeoas"
+	dip "github.com/zond/godip/common"
+)
+
+const (
+	// Datastore refuses to write more entities than this in one call.
+	maxPutMulti = 500
+)
+
+// canImportGames returns whether user is allowed to upload game records, which superusers and users in sandbox mode are.
+func canImportGames(ctx context.Context, user *auth.User) (bool, error) {
+	userConfig := &auth.UserConfig{}
+	if err := datastore.Get(ctx, auth.UserConfigID(ctx, auth.UserID(ctx, user.Id)), userConfig); err == nil {
+		if userConfig.SandboxMode {
+			return true, nil
+		}
+	} else if err != datastore.ErrNoSuchEntity {
+		return false, err
+	}
+	superusers, err := auth.GetSuperusers(ctx)
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return superusers.Includes(user.Id), nil
+}
+
+// verifyPhase returns an error if the units or supply centers recorded in the record differ from the ones in the generated phase.
+// Records without units or supply centers are trusted to mean "whatever godip says".
+func verifyPhase(record *PhaseRecord, generated *Phase) error {
+	if record.Season != generated.Season || record.Year != generated.Year || record.Type != generated.Type {
+		return fmt.Errorf("phase %d is %s %d, %s, but godip expected %s %d, %s", record.PhaseOrdinal, record.Season, record.Year, record.Type, generated.Season, generated.Year, generated.Type)
+	}
+	if len(record.Units) > 0 {
+		want := map[dip.Province]dip.Unit{}
+		for _, unit := range generated.Units {
+			want[unit.Province] = unit.Unit
+		}
+		if len(want) != len(record.Units) {
+			return fmt.Errorf("phase %d has %d units, but godip expected %d", record.PhaseOrdinal, len(record.Units), len(want))
+		}
+		for _, unit := range record.Units {
+			if found, ok := want[unit.Province]; !ok || found != unit.Unit {
+				return fmt.Errorf("phase %d has %v in %v, but godip expected %v", record.PhaseOrdinal, unit.Unit, unit.Province, found)
+			}
+		}
+	}
+	if len(record.SCs) > 0 {
+		want := map[dip.Province]dip.Nation{}
+		for _, sc := range generated.SCs {
+			want[sc.Province] = sc.Owner
+		}
+		if len(want) != len(record.SCs) {
+			return fmt.Errorf("phase %d has %d owned supply centers, but godip expected %d", record.PhaseOrdinal, len(record.SCs), len(want))
+		}
+		for _, sc := range record.SCs {
+			if want[sc.Province] != sc.Owner {
+				return fmt.Errorf("phase %d has %v owned by %q, but godip expected %q", record.PhaseOrdinal, sc.Province, sc.Owner, want[sc.Province])
+			}
+		}
+	}
+	return nil
+}
+
+// replayRecord runs the orders of the record through godip, phase by phase, and returns the resulting phases and orders.
+func replayRecord(ctx context.Context, record *GameRecord, gameID *datastore.Key, host, scheme string) (Phases, Orders, error) {
+	variant, found := variants.Variants[record.Variant]
+	if !found {
+		return nil, nil, HTTPErr{fmt.Sprintf("unknown variant %q", record.Variant), 400}
+	}
+	if len(record.Phases) == 0 {
+		return nil, nil, HTTPErr{"can't import games without phases", 400}
+	}
+	sort.Sort(phaseRecords(record.Phases))
+
+	s, err := variant.Start()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	phases := Phases{}
+	orders := Orders{}
+	for i := range record.Phases {
+		phaseRecord := &record.Phases[i]
+		if phaseRecord.PhaseOrdinal != int64(i+1) {
+			return nil, nil, HTTPErr{fmt.Sprintf("phase ordinal %d found where %d was expected", phaseRecord.PhaseOrdinal, i+1), 400}
+		}
+
+		phase := NewPhase(s, gameID, phaseRecord.PhaseOrdinal, host, scheme)
+		if err := verifyPhase(phaseRecord, phase); err != nil {
+			return nil, nil, HTTPErr{err.Error(), 400}
+		}
+		phase.Resolved = true
+		phase.Imported = true
+
+		if i+1 == len(record.Phases) {
+			// The last phase of a record is where the game ended, so orders in it would never be resolved.
+			if len(phaseRecord.Orders) > 0 {
+				return nil, nil, HTTPErr{fmt.Sprintf("phase %d is the last phase, and can't have orders", phaseRecord.PhaseOrdinal), 400}
+			}
+			phases = append(phases, *phase)
+			break
+		}
+
+		orderMap := map[dip.Nation]map[dip.Province][]string{}
+		for _, orderRecord := range phaseRecord.Orders {
+			if len(orderRecord.Parts) < 2 {
+				return nil, nil, HTTPErr{fmt.Sprintf("phase %d has a malformed order %+v", phaseRecord.PhaseOrdinal, orderRecord), 400}
+			}
+			nationMap, found := orderMap[orderRecord.Nation]
+			if !found {
+				nationMap = map[dip.Province][]string{}
+				orderMap[orderRecord.Nation] = nationMap
+			}
+			nationMap[dip.Province(orderRecord.Parts[0])] = orderRecord.Parts[1:]
+			orders = append(orders, Order{
+				GameID:       gameID,
+				PhaseOrdinal: phaseRecord.PhaseOrdinal,
+				Nation:       orderRecord.Nation,
+				Parts:        orderRecord.Parts,
+				Imported:     true,
+			})
+		}
+
+		if s, err = phase.State(ctx, variant, orderMap); err != nil {
+			return nil, nil, HTTPErr{fmt.Sprintf("phase %d has invalid orders: %v", phaseRecord.PhaseOrdinal, err), 400}
+		}
+		if err := s.Next(); err != nil {
+			return nil, nil, HTTPErr{fmt.Sprintf("phase %d can't be resolved: %v", phaseRecord.PhaseOrdinal, err), 400}
+		}
+		for prov, err := range s.Resolutions() {
+			if err == nil {
+				phase.Resolutions = append(phase.Resolutions, Resolution{prov, "OK"})
+			} else {
+				phase.Resolutions = append(phase.Resolutions, Resolution{prov, err.Error()})
+			}
+		}
+
+		phases = append(phases, *phase)
+	}
+
+	return phases, orders, nil
+}
+
+func importGame(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	allowed, err := canImportGames(ctx, user)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return HTTPErr{"unauthorized", 403}
+	}
+
+	record := &GameRecord{}
+	if err := json.NewDecoder(r.Req().Body).Decode(record); err != nil {
+		return HTTPErr{fmt.Sprintf("unable to parse game record: %v", err), 400}
+	}
+
+	// Allocate the ID up front, and save the game last, so that a failed import leaves nothing reachable behind.
+	low, _, err := datastore.AllocateIDs(ctx, gameKind, nil, 1)
+	if err != nil {
+		return err
+	}
+	gameID := datastore.NewKey(ctx, gameKind, "", low, nil)
+
+	scheme := "http"
+	if r.Req().TLS != nil {
+		scheme = "https"
+	}
+	phases, orders, err := replayRecord(ctx, record, gameID, r.Req().Host, scheme)
+	if err != nil {
+		return err
+	}
+
+	phaseIDs := make([]*datastore.Key, len(phases))
+	for i := range phases {
+		if err := phases[i].Recalc(); err != nil {
+			return err
+		}
+		if phaseIDs[i], err = phases[i].ID(ctx); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < len(phases); i += maxPutMulti {
+		end := i + maxPutMulti
+		if end > len(phases) {
+			end = len(phases)
+		}
+		if _, err := datastore.PutMulti(ctx, phaseIDs[i:end], phases[i:end]); err != nil {
+			return err
+		}
+	}
+
+	for len(orders) > 0 {
+		batch := orders
+		if len(batch) > maxPutMulti {
+			batch = batch[:maxPutMulti]
+		}
+		orderIDs := make([]*datastore.Key, len(batch))
+		for i := range batch {
+			if orderIDs[i], err = batch[i].ID(ctx); err != nil {
+				return err
+			}
+		}
+		if _, err := datastore.PutMulti(ctx, orderIDs, batch); err != nil {
+			return err
+		}
+		orders = orders[len(batch):]
+	}
+
+	lastPhase := &phases[len(phases)-1]
+
+	desc := record.Desc
+	if desc == "" {
+		desc = fmt.Sprintf("Imported %s game", record.Variant)
+	}
+	game := &Game{
+		ID:                 gameID,
+		Started:            true,
+		Closed:             true,
+		Finished:           true,
+		Imported:           true,
+		Desc:               desc,
+		Variant:            record.Variant,
+		PhaseLengthMinutes: record.PhaseLengthMinutes,
+		NewestPhaseMeta:    []PhaseMeta{lastPhase.PhaseMeta},
+		CreatedAt:          time.Now(),
+		FinishedAt:         time.Now(),
+	}
+	if err := game.Save(ctx); err != nil {
+		return err
+	}
+
+	log.Infof(ctx, "%q imported %v with %d phases", user.Id, gameID, len(phases))
+
+	w.SetContent(game.Item(r))
+	return nil
+}
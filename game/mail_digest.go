@@ -0,0 +1,379 @@
+package game
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"sort"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+	"gopkg.in/sendgrid/sendgrid-go.v2"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	pendingNotificationKind  = "PendingNotification"
+	pendingNotificationsKind = "PendingNotifications"
+	mailDigestKind           = "MailDigest"
+)
+
+var (
+	sendMailDigestFunc *DelayFunc
+)
+
+func init() {
+	sendMailDigestFunc = NewDelayFunc("game-sendMailDigest", sendMailDigest)
+}
+
+// PendingNotification is a message waiting to be mailed to a user in a digest.
+// They are stored under a per user parent outside the user entity group, so that they don't contend with everything else stored about the user,
+// while ancestor queries still find all of them.
+type PendingNotification struct {
+	UserId         string
+	GameID         *datastore.Key
+	ChannelMembers Nations
+	MessageID      *datastore.Key
+	CreatedAt      time.Time
+}
+
+// MailDigest marks that a digest is scheduled for a user, so that only one is scheduled at a time.
+type MailDigest struct {
+	ScheduledAt time.Time
+}
+
+// PendingNotificationsID is the parent of the pending notifications of a user. It's never stored.
+func PendingNotificationsID(ctx context.Context, userId string) *datastore.Key {
+	return datastore.NewKey(ctx, pendingNotificationsKind, userId, 0, nil)
+}
+
+func MailDigestID(ctx context.Context, userId string) *datastore.Key {
+	return datastore.NewKey(ctx, mailDigestKind, "digest", 0, auth.UserID(ctx, userId))
+}
+
+// queueMsgNotificationForDigest stores a message notification to be mailed in the next digest of the user,
+// and schedules the digest unless it's already scheduled.
+func queueMsgNotificationForDigest(ctx context.Context, host, scheme string, gameID *datastore.Key, channelMembers Nations, messageID *datastore.Key, userId string, interval time.Duration) error {
+	pending := &PendingNotification{
+		UserId:         userId,
+		GameID:         gameID,
+		ChannelMembers: channelMembers,
+		MessageID:      messageID,
+		CreatedAt:      time.Now(),
+	}
+	if _, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, pendingNotificationKind, PendingNotificationsID(ctx, userId)), pending); err != nil {
+		return err
+	}
+	return ensureMailDigest(ctx, host, scheme, userId, interval)
+}
+
+// ensureMailDigest schedules a digest for the user unless one is already scheduled.
+// Only scheduling writes to the user entity group, so the many notifications joining a scheduled digest don't contend.
+func ensureMailDigest(ctx context.Context, host, scheme, userId string, interval time.Duration) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		digestID := MailDigestID(ctx, userId)
+		if err := datastore.Get(ctx, digestID, &MailDigest{}); err == nil {
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if _, err := datastore.Put(ctx, digestID, &MailDigest{ScheduledAt: time.Now().Add(interval)}); err != nil {
+			return err
+		}
+		return sendMailDigestFunc.EnqueueIn(ctx, interval, host, scheme, userId)
+	}, &datastore.TransactionOptions{XG: false})
+}
+
+type digestChannel struct {
+	members  Nations
+	messages Messages
+}
+
+type messagesByCreatedAt Messages
+
+func (m messagesByCreatedAt) Len() int           { return len(m) }
+func (m messagesByCreatedAt) Less(i, j int) bool { return m[i].CreatedAt.Before(m[j].CreatedAt) }
+func (m messagesByCreatedAt) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// groupDigestMessages groups the messages of pending by game and channel, with games[i], messages[i] and messageErrs[i]
+// being the loaded game and message of pending[i]. Messages and games that no longer exist are skipped.
+func groupDigestMessages(games []*Game, pending []PendingNotification, messages Messages, messageErrs appengine.MultiError) map[*Game]map[string]*digestChannel {
+	channelsByGame := map[*Game]map[string]*digestChannel{}
+	for i := range pending {
+		game := games[i]
+		if messageErrs[i] != nil || game == nil || game.Variant == "" {
+			continue
+		}
+		channels, found := channelsByGame[game]
+		if !found {
+			channels = map[string]*digestChannel{}
+			channelsByGame[game] = channels
+		}
+		channel, found := channels[pending[i].ChannelMembers.String()]
+		if !found {
+			channel = &digestChannel{members: pending[i].ChannelMembers}
+			channels[pending[i].ChannelMembers.String()] = channel
+		}
+		channel.messages = append(channel.messages, messages[i])
+	}
+	for _, channels := range channelsByGame {
+		for _, channel := range channels {
+			sort.Sort(messagesByCreatedAt(channel.messages))
+		}
+	}
+	return channelsByGame
+}
+
+// renderMailDigest returns the text body and template data of a digest of pending, the number of messages in it,
+// and the reply address of the channel if all messages are in the same channel.
+func renderMailDigest(ctx context.Context, userId string, pending []PendingNotification) (string, map[string]interface{}, int, string, error) {
+	gameIDs := []*datastore.Key{}
+	gamesByID := map[string]*Game{}
+	for _, notification := range pending {
+		if _, found := gamesByID[notification.GameID.Encode()]; !found {
+			gamesByID[notification.GameID.Encode()] = nil
+			gameIDs = append(gameIDs, notification.GameID)
+		}
+	}
+	games := make(Games, len(gameIDs))
+	if err := datastore.GetMulti(ctx, gameIDs, games); err != nil {
+		if merr, ok := err.(appengine.MultiError); ok {
+			for _, serr := range merr {
+				if serr != nil && serr != datastore.ErrNoSuchEntity {
+					return "", nil, 0, "", err
+				}
+			}
+		} else {
+			return "", nil, 0, "", err
+		}
+	}
+	for i := range games {
+		games[i].ID = gameIDs[i]
+		gamesByID[gameIDs[i].Encode()] = &games[i]
+	}
+
+	messageIDs := make([]*datastore.Key, len(pending))
+	for i := range pending {
+		messageIDs[i] = pending[i].MessageID
+	}
+	messages := make(Messages, len(messageIDs))
+	messageErrs := make(appengine.MultiError, len(messageIDs))
+	if err := datastore.GetMulti(ctx, messageIDs, messages); err != nil {
+		if merr, ok := err.(appengine.MultiError); ok {
+			messageErrs = merr
+			for _, serr := range merr {
+				if serr != nil && serr != datastore.ErrNoSuchEntity {
+					return "", nil, 0, "", err
+				}
+			}
+		} else {
+			return "", nil, 0, "", err
+		}
+	}
+
+	pendingGames := make([]*Game, len(pending))
+	for i := range pending {
+		messages[i].ID = messageIDs[i]
+		pendingGames[i] = gamesByID[pending[i].GameID.Encode()]
+	}
+	channelsByGame := groupDigestMessages(pendingGames, pending, messages, messageErrs)
+
+	buf := &bytes.Buffer{}
+	gameData := []map[string]interface{}{}
+	replyAddresses := []string{}
+	count := 0
+	for _, gameID := range gameIDs {
+		game := gamesByID[gameID.Encode()]
+		channels := channelsByGame[game]
+		member, isMember := game.GetMember(userId)
+		if len(channels) == 0 || !isMember {
+			continue
+		}
+		desc := game.DescFor(member.Nation)
+		fmt.Fprintf(buf, "%s\n\n", desc)
+		channelKeys := []string{}
+		for key := range channels {
+			channelKeys = append(channelKeys, key)
+		}
+		sort.Strings(channelKeys)
+		channelData := []map[string]interface{}{}
+		for _, key := range channelKeys {
+			channel := channels[key]
+			count += len(channel.messages)
+			newest := channel.messages[len(channel.messages)-1]
+			fromToken, err := auth.EncodeString(ctx, fmt.Sprintf("%s,%s", member.Nation, newest.ID.Encode()))
+			if err != nil {
+				return "", nil, 0, "", err
+			}
+			replyAddress := fmt.Sprintf(fromAddressPattern, fromToken)
+			replyAddresses = append(replyAddresses, replyAddress)
+			fmt.Fprintf(buf, "  %s\n", game.AbbrNats(channel.members).String())
+			for _, message := range channel.messages {
+				fmt.Fprintf(buf, "    %s (%s): %s\n", game.AbbrNat(message.Sender), message.CreatedAt.UTC().Format(time.RFC822), message.Body)
+			}
+			fmt.Fprintf(buf, "  Reply to %s to post in this channel.\n\n", replyAddress)
+			channelData = append(channelData, map[string]interface{}{
+				"channel":      channel.members,
+				"replyAddress": replyAddress,
+				"messages":     channel.messages,
+			})
+		}
+		gameData = append(gameData, map[string]interface{}{
+			"game":     game,
+			"desc":     desc,
+			"channels": channelData,
+		})
+	}
+
+	if len(gameData) == 0 {
+		return "", nil, 0, "", nil
+	}
+	singleReplyAddress := ""
+	if len(replyAddresses) == 1 {
+		singleReplyAddress = replyAddresses[0]
+	}
+	return buf.String(), map[string]interface{}{"games": gameData}, count, singleReplyAddress, nil
+}
+
+func sendMailDigest(ctx context.Context, host, scheme, userId string) error {
+	log.Infof(ctx, "sendMailDigest(..., %q, %q, %q)", host, scheme, userId)
+
+	userID := auth.UserID(ctx, userId)
+
+	pending := []PendingNotification{}
+	pendingIDs, err := datastore.NewQuery(pendingNotificationKind).Ancestor(PendingNotificationsID(ctx, userId)).GetAll(ctx, &pending)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load pending notifications of %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+
+	user := &auth.User{}
+	userConfig := &auth.UserConfig{}
+	if err := datastore.GetMulti(ctx, []*datastore.Key{userID, auth.UserConfigID(ctx, userID)}, []interface{}{user, userConfig}); err != nil {
+		log.Infof(ctx, "Unable to load user and user config of %q: %v; dropping the digest", userId, err)
+		userConfig.MailConfig.Enabled = false
+	}
+
+	if len(pending) > 0 && userConfig.MailConfig.Enabled {
+		quietUntil, err := userConfig.QuietUntil(ctx, time.Now())
+		if err != nil {
+			log.Errorf(ctx, "Unable to check quiet hours of %q: %v; hope datastore gets fixed", userId, err)
+			return err
+		}
+		if !quietUntil.IsZero() {
+			// Keeping the digest marker makes new notifications join the deferred digest.
+			if err := sendMailDigestFunc.EnqueueAt(ctx, quietUntil, host, scheme, userId); err != nil {
+				log.Errorf(ctx, "Unable to defer the digest to %q until %v: %v; hope datastore gets fixed", userId, quietUntil, err)
+				return err
+			}
+			log.Infof(ctx, "sendMailDigest(..., %q, %q, %q) *** DEFERRED UNTIL %v ***", host, scheme, userId, quietUntil)
+			return nil
+		}
+		if err := mailDigest(ctx, host, scheme, user, userConfig, pending); err != nil {
+			return err
+		}
+	}
+
+	if err := datastore.DeleteMulti(ctx, pendingIDs); err != nil {
+		log.Errorf(ctx, "Unable to delete sent notifications to %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+	if err := datastore.Delete(ctx, MailDigestID(ctx, userId)); err != nil {
+		log.Errorf(ctx, "Unable to delete the digest marker of %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+
+	// Notifications queued while the digest was sent are left for the next digest.
+	// The ancestor query is strongly consistent, so it finds notifications that saw the marker and didn't schedule a digest.
+	remaining, err := datastore.NewQuery(pendingNotificationKind).Ancestor(PendingNotificationsID(ctx, userId)).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load remaining notifications to %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+	sent := map[string]bool{}
+	for _, id := range pendingIDs {
+		sent[id.Encode()] = true
+	}
+	for _, id := range remaining {
+		if !sent[id.Encode()] {
+			if err := ensureMailDigest(ctx, host, scheme, userId, userConfig.MailConfig.DigestInterval()); err != nil {
+				log.Errorf(ctx, "Unable to schedule the next digest to %q: %v; hope datastore gets fixed", userId, err)
+				return err
+			}
+			break
+		}
+	}
+
+	log.Infof(ctx, "sendMailDigest(..., %q, %q, %q) *** SUCCESS ***", host, scheme, userId)
+
+	return nil
+}
+
+func mailDigest(ctx context.Context, host, scheme string, user *auth.User, userConfig *auth.UserConfig, pending []PendingNotification) error {
+	body, mailData, count, replyAddress, err := renderMailDigest(ctx, user.Id, pending)
+	if err != nil {
+		log.Errorf(ctx, "Unable to render digest for %q: %v; hope datastore gets fixed", user.Id, err)
+		return err
+	}
+	if body == "" {
+		log.Infof(ctx, "Nothing left to mail to %q in the digest, will skip sending it", user.Id)
+		return nil
+	}
+
+	sendGridConf, err := GetSendGrid(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load sendgrid API key: %v; upload one or hope datastore gets fixed", err)
+		return err
+	}
+
+	unsubscribeURL, err := auth.GetUnsubscribeURL(ctx, router, host, scheme, user.Id)
+	if err != nil {
+		log.Errorf(ctx, "Unable to create unsubscribe URL for %q: %v; fix auth.GetUnsubscribeURL", user.Id, err)
+		return err
+	}
+
+	mailData["unsubscribeURL"] = unsubscribeURL.String()
+	mailData["user"] = user
+
+	msg := sendgrid.NewMail()
+	msg.SetText(fmt.Sprintf("%s\nVisit %s to stop receiving email like this.", body, unsubscribeURL.String()))
+	msg.SetSubject(fmt.Sprintf("Diplicity: %d new messages", count))
+	msg.AddHeader("List-Unsubscribe", fmt.Sprintf("<%s>", unsubscribeURL.String()))
+
+	userConfig.MailConfig.DigestConfig.Customize(ctx, msg, mailData)
+
+	recipEmail, err := mail.ParseAddress(user.Email)
+	if err != nil {
+		log.Errorf(ctx, "Unable to parse email address of %v: %v; unable to recover, exiting", PP(user), err)
+		return nil
+	}
+	msg.AddRecipient(recipEmail)
+
+	if replyAddress != "" {
+		fromEmail, err := mail.ParseAddress(replyAddress)
+		if err != nil {
+			log.Errorf(ctx, "Unable to parse reply email address %q: %v; fix the address generation", replyAddress, err)
+			return err
+		}
+		msg.SetFromEmail(fromEmail)
+	} else {
+		msg.SetFrom(noreplyFromAddr)
+	}
+	msg.SetFromName("Diplicity")
+
+	client := sendgrid.NewSendGridClientWithApiKey(sendGridConf.APIKey)
+	client.Client = urlfetch.Client(ctx)
+	if err := client.Send(msg); err != nil {
+		log.Errorf(ctx, "Unable to send %v: %v; hope sendgrid gets fixed", msg, err)
+		return err
+	}
+	log.Infof(ctx, "Successfully sent %v", PP(msg))
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package game
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestGroupDigestMessages(t *testing.T) {
+	game := &Game{Variant: "Classical"}
+	otherGame := &Game{Variant: "Classical"}
+	deletedGame := &Game{}
+
+	austriaEngland := Nations{"Austria", "England"}
+	austriaFrance := Nations{"Austria", "France"}
+	now := time.Now()
+
+	pending := []PendingNotification{
+		{ChannelMembers: austriaEngland},
+		{ChannelMembers: austriaFrance},
+		{ChannelMembers: austriaEngland},
+		{ChannelMembers: austriaEngland},
+		{ChannelMembers: austriaEngland},
+		{ChannelMembers: austriaEngland},
+	}
+	games := []*Game{game, game, game, game, otherGame, deletedGame}
+	messages := Messages{
+		{Body: "second", CreatedAt: now.Add(time.Second)},
+		{Body: "to france", CreatedAt: now},
+		{Body: "first", CreatedAt: now},
+		{},
+		{Body: "other game", CreatedAt: now},
+		{Body: "deleted game", CreatedAt: now},
+	}
+	messageErrs := make(appengine.MultiError, len(pending))
+	messageErrs[3] = datastore.ErrNoSuchEntity
+
+	channelsByGame := groupDigestMessages(games, pending, messages, messageErrs)
+	if len(channelsByGame) != 2 {
+		t.Fatalf("got %v games, wanted 2", len(channelsByGame))
+	}
+	if _, found := channelsByGame[deletedGame]; found {
+		t.Errorf("got channels for deleted game")
+	}
+
+	channels := channelsByGame[game]
+	if len(channels) != 2 {
+		t.Fatalf("got %v channels, wanted 2", len(channels))
+	}
+	bodies := []string{}
+	for _, message := range channels[austriaEngland.String()].messages {
+		bodies = append(bodies, message.Body)
+	}
+	if len(bodies) != 2 || bodies[0] != "first" || bodies[1] != "second" {
+		t.Errorf("got %+v, wanted the existing messages oldest first", bodies)
+	}
+	if l := len(channels[austriaFrance.String()].messages); l != 1 {
+		t.Errorf("got %v messages to France, wanted 1", l)
+	}
+	if l := len(channelsByGame[otherGame][austriaEngland.String()].messages); l != 1 {
+		t.Errorf("got %v messages in the other game, wanted 1", l)
+	}
+}
@@ -0,0 +1,465 @@
+package game
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip/variants"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+
+	dvars "github.com/zond/diplicity/variants"
+	. "github.com/zond/goaeoas"
+	dip "github.com/zond/godip/common"
+)
+
+const (
+	mapImageKind = "MapImage"
+
+	// Datastore entities and memcache items can't be larger than 1MB, so images are stored in chunks smaller than that.
+	mapImageChunkSize = 900 * 1024
+
+	// Hundredths of a second each phase is shown in animated game maps, unless the client asks for something else.
+	defaultGIFDelay = 150
+
+	gameGIFFormat     = "gif"
+	gameSpritesFormat = "sprites"
+
+	// How long a requested game animation is assumed to be rendering, before another request may enqueue it again.
+	gameAnimationRenderTimeout = 10 * time.Minute
+	// How long clients are asked to wait before asking for an animation being rendered again.
+	gameAnimationRetryAfter = 10 * time.Second
+
+	// Sprite sheets are scaled down to at most this many pixels, so that long games fit in instance memory.
+	maxSpriteSheetPixels = 4096 * 4096
+)
+
+var (
+	renderGameAnimationFunc *DelayFunc
+
+	// The delays clients can ask animated game maps to have. Each one is rendered and stored separately, so they are few.
+	gifDelays = []int{50, 100, defaultGIFDelay, 300}
+)
+
+func init() {
+	renderGameAnimationFunc = NewDelayFunc("game-renderGameAnimation", renderGameAnimation)
+}
+
+// MapImage is one chunk of a rendered image, stored under the phase or game it shows.
+type MapImage struct {
+	Chunks int
+	Data   []byte `datastore:",noindex"`
+}
+
+func MapImageID(ctx context.Context, parent *datastore.Key, name string, chunk int) *datastore.Key {
+	return datastore.NewKey(ctx, mapImageKind, fmt.Sprintf("%s/%d", name, chunk), 0, parent)
+}
+
+func splitMapImage(data []byte) [][]byte {
+	chunks := [][]byte{}
+	for len(data) > mapImageChunkSize {
+		chunks = append(chunks, data[:mapImageChunkSize])
+		data = data[mapImageChunkSize:]
+	}
+	return append(chunks, data)
+}
+
+// loadMapImage returns the image stored with the name under parent, or nil if there is none.
+func loadMapImage(ctx context.Context, parent *datastore.Key, name string) ([]byte, error) {
+	first := &MapImage{}
+	if err := datastore.Get(ctx, MapImageID(ctx, parent, name, 0), first); err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if first.Chunks < 2 {
+		return first.Data, nil
+	}
+	ids := make([]*datastore.Key, first.Chunks-1)
+	for i := range ids {
+		ids[i] = MapImageID(ctx, parent, name, i+1)
+	}
+	rest := make([]MapImage, len(ids))
+	if err := datastore.GetMulti(ctx, ids, rest); err != nil {
+		if merr, ok := err.(appengine.MultiError); ok {
+			for _, serr := range merr {
+				if serr == datastore.ErrNoSuchEntity {
+					// A previous store failed halfway, render it again.
+					return nil, nil
+				}
+			}
+		}
+		return nil, err
+	}
+	data := first.Data
+	for i := range rest {
+		data = append(data, rest[i].Data...)
+	}
+	return data, nil
+}
+
+func storeMapImage(ctx context.Context, parent *datastore.Key, name string, data []byte) error {
+	chunks := splitMapImage(data)
+	ids := make([]*datastore.Key, len(chunks))
+	images := make([]MapImage, len(chunks))
+	for i := range chunks {
+		ids[i] = MapImageID(ctx, parent, name, i)
+		images[i] = MapImage{
+			Chunks: len(chunks),
+			Data:   chunks[i],
+		}
+	}
+	_, err := datastore.PutMulti(ctx, ids, images)
+	return err
+}
+
+// getCachedMapImage returns the image stored in memcache with the key, or nil if there is none.
+// The number of chunks is stored in the flags of the first chunk.
+func getCachedMapImage(ctx context.Context, key string) ([]byte, error) {
+	first, err := memcache.Get(ctx, fmt.Sprintf("%s/0", key))
+	if err == memcache.ErrCacheMiss {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	data := first.Value
+	if first.Flags < 2 {
+		return data, nil
+	}
+	keys := make([]string, first.Flags-1)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s/%d", key, i+1)
+	}
+	items, err := memcache.GetMulti(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, chunkKey := range keys {
+		item, found := items[chunkKey]
+		if !found {
+			return nil, nil
+		}
+		data = append(data, item.Value...)
+	}
+	return data, nil
+}
+
+func setCachedMapImage(ctx context.Context, key string, data []byte) error {
+	chunks := splitMapImage(data)
+	items := make([]*memcache.Item, len(chunks))
+	for i := range chunks {
+		items[i] = &memcache.Item{
+			Key:   fmt.Sprintf("%s/%d", key, i),
+			Value: chunks[i],
+			Flags: uint32(len(chunks)),
+		}
+	}
+	return memcache.SetMulti(ctx, items)
+}
+
+// phaseMapPNG renders the phase as a PNG showing the orders viewer is allowed to see.
+// Resolved phases look the same to everyone, and are stored per phase and variant SVG version.
+// Unresolved phases change with their orders, and are cached in memcache per phase, variant SVG version and visible orders.
+func phaseMapPNG(ctx context.Context, phase *Phase, variantName string, viewer dip.Nation) ([]byte, error) {
+	variant, found := variants.Variants[variantName]
+	if !found {
+		return nil, fmt.Errorf("unknown variant %q", variantName)
+	}
+	phaseID, err := phase.ID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	vPhase, err := phase.variantsPhase(ctx, variantName, viewer)
+	if err != nil {
+		return nil, err
+	}
+
+	storedName := fmt.Sprintf("png/%s", variant.SVGVersion)
+	cacheKey := ""
+	if phase.Resolved {
+		if pngBytes, err := loadMapImage(ctx, phaseID, storedName); err != nil {
+			log.Warningf(ctx, "Unable to load %q of %v: %v; rendering it instead", storedName, phaseID, err)
+		} else if pngBytes != nil {
+			return pngBytes, nil
+		}
+	} else {
+		b, err := json.Marshal(vPhase.Orders)
+		if err != nil {
+			return nil, err
+		}
+		cacheKey = fmt.Sprintf("phase-map-png/%s/%s/%x", phaseID.Encode(), variant.SVGVersion, sha256.Sum256(b))
+		if pngBytes, err := getCachedMapImage(ctx, cacheKey); err != nil {
+			log.Warningf(ctx, "Unable to load %q from memcache: %v; rendering it instead", cacheKey, err)
+		} else if pngBytes != nil {
+			return pngBytes, nil
+		}
+	}
+
+	pngBytes, err := dvars.PhaseMapPNG(vPhase)
+	if err != nil {
+		return nil, err
+	}
+
+	// Failing to store only costs us a new rendering next time.
+	if phase.Resolved {
+		if err := storeMapImage(ctx, phaseID, storedName, pngBytes); err != nil {
+			log.Warningf(ctx, "Unable to store %q of %v: %v", storedName, phaseID, err)
+		}
+	} else if err := setCachedMapImage(ctx, cacheKey, pngBytes); err != nil {
+		log.Warningf(ctx, "Unable to store %q in memcache: %v", cacheKey, err)
+	}
+
+	return pngBytes, nil
+}
+
+// resolvedPhases returns the number of resolved phases of the game, which are the phases shown in animations of it.
+func (g *Game) resolvedPhases() int64 {
+	if len(g.NewestPhaseMeta) == 0 {
+		return 0
+	}
+	if g.NewestPhaseMeta[0].Resolved {
+		return g.NewestPhaseMeta[0].PhaseOrdinal
+	}
+	return g.NewestPhaseMeta[0].PhaseOrdinal - 1
+}
+
+func gameAnimationName(variantName, format string, resolvedPhases int64, delay int) string {
+	svgVersion := ""
+	if variant, found := variants.Variants[variantName]; found {
+		svgVersion = variant.SVGVersion
+	}
+	return fmt.Sprintf("%s/%s/%d/%d", format, svgVersion, resolvedPhases, delay)
+}
+
+// spriteCellSize returns the size of the cells of a sprite sheet with cells cells of maps of size, scaled down to fit maxSpriteSheetPixels.
+func spriteCellSize(size image.Point, cells int) image.Point {
+	scale := math.Sqrt(float64(maxSpriteSheetPixels) / float64(cells*size.X*size.Y))
+	if scale >= 1 {
+		return size
+	}
+	cell := image.Pt(int(float64(size.X)*scale), int(float64(size.Y)*scale))
+	if cell.X < 1 {
+		cell.X = 1
+	}
+	if cell.Y < 1 {
+		cell.Y = 1
+	}
+	return cell
+}
+
+// drawScaled draws src scaled to fill r of dst, picking the nearest pixel of src for each pixel of dst.
+func drawScaled(dst *image.RGBA, r image.Rectangle, src image.Image) {
+	bounds := src.Bounds()
+	if r.Size() == bounds.Size() {
+		draw.Draw(dst, r, src, bounds.Min, draw.Src)
+		return
+	}
+	for y := 0; y < r.Dy(); y++ {
+		srcY := bounds.Min.Y + y*bounds.Dy()/r.Dy()
+		for x := 0; x < r.Dx(); x++ {
+			dst.Set(r.Min.X+x, r.Min.Y+y, src.At(bounds.Min.X+x*bounds.Dx()/r.Dx(), srcY))
+		}
+	}
+}
+
+// renderGameAnimation renders the first resolvedPhases phases of the game as an animated GIF or a sprite sheet, and stores it under the game.
+func renderGameAnimation(ctx context.Context, gameID *datastore.Key, format string, resolvedPhases int64, delay int) error {
+	log.Infof(ctx, "renderGameAnimation(..., %v, %q, %v, %v)", gameID, format, resolvedPhases, delay)
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err == datastore.ErrNoSuchEntity {
+		log.Infof(ctx, "%v doesn't exist anymore, exiting", gameID)
+		return nil
+	} else if err != nil {
+		log.Errorf(ctx, "Unable to load %v: %v; hope datastore gets fixed", gameID, err)
+		return err
+	}
+	game.ID = gameID
+
+	// Phase keys are their ordinals, so ancestor queries return them in order.
+	phases := Phases{}
+	if _, err := datastore.NewQuery(phaseKind).Ancestor(gameID).GetAll(ctx, &phases); err != nil {
+		log.Errorf(ctx, "Unable to load phases of %v: %v; hope datastore gets fixed", gameID, err)
+		return err
+	}
+	if int64(len(phases)) < resolvedPhases {
+		log.Errorf(ctx, "%v has only %v phases, but %v were asked for; unable to recover, exiting", gameID, len(phases), resolvedPhases)
+		return nil
+	}
+	phases = phases[:resolvedPhases]
+
+	if format != gameGIFFormat && format != gameSpritesFormat {
+		log.Errorf(ctx, "Unknown animation format %q; unable to recover, exiting", format)
+		return nil
+	}
+
+	// Each map is added to the animation as soon as it's decoded, to not keep every decoded map in memory.
+	anim := &gif.GIF{}
+	var sheet *image.RGBA
+	var cell image.Point
+	cols := int(math.Ceil(math.Sqrt(float64(len(phases)))))
+	rows := (len(phases) + cols - 1) / cols
+	for i := range phases {
+		pngBytes, err := phaseMapPNG(ctx, &phases[i], game.Variant, "")
+		if err != nil {
+			log.Errorf(ctx, "Unable to render %v: %v; fix the renderer", PP(phases[i]), err)
+			return err
+		}
+		img, err := png.Decode(bytes.NewReader(pngBytes))
+		if err != nil {
+			log.Errorf(ctx, "Unable to decode map of %v: %v; fix the renderer", PP(phases[i]), err)
+			return err
+		}
+		switch format {
+		case gameGIFFormat:
+			paletted := image.NewPaletted(img.Bounds(), palette.Plan9)
+			draw.FloydSteinberg.Draw(paletted, img.Bounds(), img, img.Bounds().Min)
+			anim.Image = append(anim.Image, paletted)
+			anim.Delay = append(anim.Delay, delay)
+		case gameSpritesFormat:
+			if sheet == nil {
+				// All phases share the variant map, so the first image decides the size of every cell.
+				cell = spriteCellSize(img.Bounds().Size(), cols*rows)
+				sheet = image.NewRGBA(image.Rect(0, 0, cols*cell.X, rows*cell.Y))
+			}
+			min := image.Pt((i%cols)*cell.X, (i/cols)*cell.Y)
+			drawScaled(sheet, image.Rectangle{min, min.Add(cell)}, img)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if format == gameGIFFormat {
+		if err := gif.EncodeAll(buf, anim); err != nil {
+			log.Errorf(ctx, "Unable to encode GIF of %v: %v; fix the renderer", gameID, err)
+			return err
+		}
+	} else {
+		if err := png.Encode(buf, sheet); err != nil {
+			log.Errorf(ctx, "Unable to encode sprite sheet of %v: %v; fix the renderer", gameID, err)
+			return err
+		}
+	}
+
+	name := gameAnimationName(game.Variant, format, resolvedPhases, delay)
+	if err := storeMapImage(ctx, gameID, name, buf.Bytes()); err != nil {
+		log.Errorf(ctx, "Unable to store %q of %v: %v; hope datastore gets fixed", name, gameID, err)
+		return err
+	}
+
+	log.Infof(ctx, "renderGameAnimation(..., %v, %q, %v, %v) *** SUCCESS ***", gameID, format, resolvedPhases, delay)
+
+	return nil
+}
+
+// serveGameAnimation serves the stored animation of the resolved phases of the game in the request.
+// Animations that aren't stored yet get rendered in a task, while the client is told to try again later.
+func serveGameAnimation(w ResponseWriter, r Request, format, contentType string, delay int) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if _, ok := r.Values()["user"].(*auth.User); !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err != nil {
+		return err
+	}
+	game.ID = gameID
+
+	resolvedPhases := game.resolvedPhases()
+	if resolvedPhases == 0 {
+		return HTTPErr{"game has no resolved phases", 412}
+	}
+
+	name := gameAnimationName(game.Variant, format, resolvedPhases, delay)
+	data, err := loadMapImage(ctx, gameID, name)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		w.Header().Set("Content-Type", contentType)
+		_, err = w.Write(data)
+		return err
+	}
+
+	// Only enqueue one rendering of each animation at a time.
+	if err := memcache.Add(ctx, &memcache.Item{
+		Key:        fmt.Sprintf("rendering/%s/%s", gameID.Encode(), name),
+		Value:      []byte{1},
+		Expiration: gameAnimationRenderTimeout,
+	}); err == nil {
+		if err := renderGameAnimationFunc.EnqueueIn(ctx, 0, gameID, format, resolvedPhases, delay); err != nil {
+			return err
+		}
+	} else if err != memcache.ErrNotStored {
+		return err
+	}
+
+	w.Header().Set("Retry-After", fmt.Sprint(int(gameAnimationRetryAfter/time.Second)))
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.WriteHeader(http.StatusAccepted)
+	_, err = fmt.Fprintf(w, "The animation is being rendered, try again in %v.", gameAnimationRetryAfter)
+	return err
+}
+
+func renderPhaseMapPNG(w ResponseWriter, r Request) error {
+	game, phase, nation, err := loadViewedPhase(r)
+	if err != nil {
+		return err
+	}
+
+	pngBytes, err := phaseMapPNG(appengine.NewContext(r.Req()), phase, game.Variant, nation)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	_, err = w.Write(pngBytes)
+	return err
+}
+
+func validGIFDelay(delay int) bool {
+	for _, valid := range gifDelays {
+		if delay == valid {
+			return true
+		}
+	}
+	return false
+}
+
+func renderGameGIF(w ResponseWriter, r Request) error {
+	delay := defaultGIFDelay
+	if delayParam := r.Req().URL.Query().Get("delay"); delayParam != "" {
+		var err error
+		if delay, err = strconv.Atoi(delayParam); err != nil || !validGIFDelay(delay) {
+			return HTTPErr{fmt.Sprintf("delay must be one of %v hundredths of a second, not %q", gifDelays, delayParam), 400}
+		}
+	}
+
+	return serveGameAnimation(w, r, gameGIFFormat, "image/gif", delay)
+}
+
+func renderGameSprites(w ResponseWriter, r Request) error {
+	return serveGameAnimation(w, r, gameSpritesFormat, "image/png", 0)
+}
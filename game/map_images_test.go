@@ -0,0 +1,42 @@
+package game
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestSpriteCellSize(t *testing.T) {
+	size := image.Pt(1000, 800)
+	if cell := spriteCellSize(size, 4); cell != size {
+		t.Errorf("got cells of %v for a small sheet, wanted unscaled %v", cell, size)
+	}
+	cell := spriteCellSize(size, 400)
+	if cell.X*cell.Y*400 > maxSpriteSheetPixels {
+		t.Errorf("got cells of %v, making a sheet of %v pixels larger than %v", cell, cell.X*cell.Y*400, maxSpriteSheetPixels)
+	}
+	if cell.X < 1 || cell.Y < 1 {
+		t.Errorf("got empty cells of %v", cell)
+	}
+}
+
+func TestDrawScaled(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	red := color.RGBA{255, 0, 0, 255}
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			src.Set(x, y, red)
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	drawScaled(dst, image.Rect(2, 0, 4, 2), src)
+	if got := dst.RGBAAt(2, 0); got != red {
+		t.Errorf("got %v at the top left of the scaled image, wanted %v", got, red)
+	}
+	if got := dst.RGBAAt(3, 1); got == red {
+		t.Errorf("got %v at the bottom right of the scaled image, wanted it empty", got)
+	}
+	if got := dst.RGBAAt(0, 0); got == red {
+		t.Errorf("got %v outside the scaled image, wanted it empty", got)
+	}
+}
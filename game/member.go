@@ -16,9 +16,9 @@ import (
 )
 
 var MemberResource = &Resource{
-	Create:     createMember,
-	Delete:     deleteMember,
-	Update:     updateMember,
+	Create:     auth.Scoped(auth.WriteGamesScope, createMember),
+	Delete:     auth.Scoped(auth.WriteGamesScope, deleteMember),
+	Update:     auth.Scoped(auth.WriteGamesScope, updateMember),
 	CreatePath: "/Game/{game_id}/Member",
 	FullPath:   "/Game/{game_id}/Member/{user_id}",
 }
@@ -46,6 +46,11 @@ func (m *Member) Redact(viewer *auth.User, isMember bool) {
 	}
 }
 
+// ApplyProfile replaces the Google details of the user of the member with the ones in the profile of the user.
+func (m *Member) ApplyProfile(ctx context.Context) error {
+	return auth.ApplyProfiles(ctx, []*auth.User{&m.User})
+}
+
 func updateMember(w ResponseWriter, r Request) (*Member, error) {
 	ctx := appengine.NewContext(r.Req())
 
@@ -98,6 +103,10 @@ func updateMember(w ResponseWriter, r Request) (*Member, error) {
 		return nil, err
 	}
 
+	if err := member.ApplyProfile(ctx); err != nil {
+		return nil, err
+	}
+
 	return member, nil
 }
 
@@ -142,12 +151,24 @@ func deleteMember(w ResponseWriter, r Request) (*Member, error) {
 		if len(newMembers) == 0 && !game.Started {
 			return datastore.Delete(ctx, gameID)
 		}
+		if err := recordGameEvent(ctx, game, &GameEvent{
+			GameID: gameID,
+			Type:   MemberLeftEvent,
+			UserId: member.User.Id,
+			Nation: member.Nation,
+		}); err != nil {
+			return err
+		}
 		game.Members = newMembers
 		return game.Save(ctx)
 	}, &datastore.TransactionOptions{XG: false}); err != nil {
 		return nil, err
 	}
 
+	if err := member.ApplyProfile(ctx); err != nil {
+		return nil, err
+	}
+
 	return member, nil
 }
 
@@ -200,6 +221,13 @@ func createMember(w ResponseWriter, r Request) (*Member, error) {
 			GameID: gameID,
 		}
 		game.Members = append(game.Members, *member)
+		if err := recordGameEvent(ctx, game, &GameEvent{
+			GameID: gameID,
+			Type:   MemberJoinedEvent,
+			UserId: user.Id,
+		}); err != nil {
+			return err
+		}
 		if len(game.Members) == len(variants.Variants[game.Variant].Nations) {
 			if err := game.Start(ctx, r); err != nil {
 				return err
@@ -210,5 +238,9 @@ func createMember(w ResponseWriter, r Request) (*Member, error) {
 		return nil, err
 	}
 
+	if err := member.ApplyProfile(ctx); err != nil {
+		return nil, err
+	}
+
 	return member, nil
 }
@@ -27,7 +27,7 @@ var (
 
 func init() {
 	MessageFlagResource = &Resource{
-		Create:     createMessageFlag,
+		Create:     auth.Scoped(auth.WritePressScope, createMessageFlag),
 		CreatePath: "/Game/{game_id}/Channel/{channel_members}/MessageFlag",
 	}
 	FlaggedMessagesResource = &Resource{
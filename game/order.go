@@ -24,16 +24,16 @@ var OrderResource *Resource
 
 func init() {
 	OrderResource = &Resource{
-		Create:     createOrder,
-		Update:     updateOrder,
-		Delete:     deleteOrder,
+		Create:     auth.Scoped(auth.WriteOrdersScope, createOrder),
+		Update:     auth.Scoped(auth.WriteOrdersScope, updateOrder),
+		Delete:     auth.Scoped(auth.WriteOrdersScope, deleteOrder),
 		CreatePath: "/Game/{game_id}/Phase/{phase_ordinal}/Order",
 		FullPath:   "/Game/{game_id}/Phase/{phase_ordinal}/Order/{src_province}",
 		Listers: []Lister{
 			{
 				Path:    "/Game/{game_id}/Phase/{phase_ordinal}/Orders",
 				Route:   ListOrdersRoute,
-				Handler: listOrders,
+				Handler: auth.ScopedHandler(auth.ReadGamesScope, listOrders),
 			},
 		},
 	}
@@ -62,6 +62,7 @@ type Order struct {
 	PhaseOrdinal int64
 	Nation       dip.Nation
 	Parts        []string `methods:"POST,PUT" separator:" "`
+	Imported     bool
 }
 
 func OrderID(ctx context.Context, phaseID *datastore.Key, srcProvince dip.Province) (*datastore.Key, error) {
@@ -1,6 +1,7 @@
 package game
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/mail"
@@ -41,13 +42,13 @@ func init() {
 	sendPhaseNotificationsToMailFunc = NewDelayFunc("game-sendPhaseNotificationsToMail", sendPhaseNotificationsToMail)
 
 	PhaseResource = &Resource{
-		Load:     loadPhase,
+		Load:     auth.Scoped(auth.ReadGamesScope, loadPhase),
 		FullPath: "/Game/{game_id}/Phase/{phase_ordinal}",
 		Listers: []Lister{
 			{
 				Path:    "/Game/{game_id}/Phases",
 				Route:   ListPhasesRoute,
-				Handler: listPhases,
+				Handler: auth.ScopedHandler(auth.ReadGamesScope, listPhases),
 			},
 		},
 	}
@@ -61,9 +62,12 @@ type phaseNotificationContext struct {
 	game         *Game
 	phase        *Phase
 	member       *Member
+	gameState    *GameState
 	user         *auth.User
 	userConfig   *auth.UserConfig
 	mapURL       *url.URL
+	pngMapURL    *url.URL
+	summary      string
 	fcmData      map[string]interface{}
 	mailData     map[string]interface{}
 }
@@ -89,6 +93,10 @@ func getPhaseNotificationContext(ctx context.Context, host, scheme string, gameI
 	err = datastore.GetMulti(ctx, []*datastore.Key{gameID, res.phaseID, res.userConfigID, res.userID}, []interface{}{res.game, res.phase, res.userConfig, res.user})
 	if err != nil {
 		if merr, ok := err.(appengine.MultiError); ok {
+			if merr[0] == datastore.ErrNoSuchEntity || merr[1] == datastore.ErrNoSuchEntity {
+				log.Infof(ctx, "%v or %v doesn't exist anymore, will skip sending notification", gameID, res.phaseID)
+				return nil, noConfigError
+			}
 			if merr[2] == datastore.ErrNoSuchEntity {
 				log.Infof(ctx, "%q has no configuration, will skip sending notification", userId)
 				return nil, noConfigError
@@ -109,6 +117,17 @@ func getPhaseNotificationContext(ctx context.Context, host, scheme string, gameI
 		return nil, noConfigError
 	}
 
+	res.gameState, err = GetGameState(ctx, gameID, res.member.Nation)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load game state of %v in %v: %v; hope datastore gets fixed", res.member.Nation, gameID, err)
+		return nil, err
+	}
+
+	if err := (Games{*res.game}).ApplyProfiles(ctx); err != nil {
+		log.Errorf(ctx, "Unable to apply the profiles of the members of %v: %v; hope datastore gets fixed", gameID, err)
+		return nil, err
+	}
+
 	res.mapURL, err = router.Get(RenderPhaseMapRoute).URL("game_id", res.game.ID.Encode(), "phase_ordinal", fmt.Sprint(res.phase.PhaseOrdinal))
 	if err != nil {
 		log.Errorf(ctx, "Unable to create map URL for game %v and phase %v: %v; wtf?", res.game.ID, res.phase.PhaseOrdinal, err)
@@ -117,16 +136,34 @@ func getPhaseNotificationContext(ctx context.Context, host, scheme string, gameI
 	res.mapURL.Host = host
 	res.mapURL.Scheme = scheme
 
+	res.pngMapURL, err = router.Get(RenderPhaseMapPNGRoute).URL("game_id", res.game.ID.Encode(), "phase_ordinal", fmt.Sprint(res.phase.PhaseOrdinal))
+	if err != nil {
+		log.Errorf(ctx, "Unable to create PNG map URL for game %v and phase %v: %v; wtf?", res.game.ID, res.phase.PhaseOrdinal, err)
+		return nil, err
+	}
+	res.pngMapURL.Host = host
+	res.pngMapURL.Scheme = scheme
+
+	if diff, err := NewPhaseDiff(ctx, res.phase); err == nil {
+		res.summary = diff.summarize(res.game.Variant, res.member.Nation)
+	} else {
+		log.Warningf(ctx, "Unable to diff %v with the phase before it: %v; notifying without summary", PP(res.phase), err)
+	}
+
 	res.mailData = map[string]interface{}{
-		"phaseMeta": res.phase.PhaseMeta,
-		"game":      res.game,
-		"user":      res.user,
-		"mapLink":   res.mapURL.String(),
+		"summary":    res.summary,
+		"phaseMeta":  res.phase.PhaseMeta,
+		"game":       res.game,
+		"user":       res.user,
+		"mapLink":    res.mapURL.String(),
+		"pngMapLink": res.pngMapURL.String(),
 	}
 	res.fcmData = map[string]interface{}{
 		"type":      "phase",
 		"gameID":    res.game.ID,
 		"phaseMeta": res.phase.PhaseMeta,
+		"pngMapURL": res.pngMapURL.String(),
+		"summary":   res.summary,
 	}
 
 	return res, nil
@@ -149,6 +186,25 @@ func sendPhaseNotificationsToMail(ctx context.Context, host, scheme string, game
 		return nil
 	}
 
+	if msgContext.gameState.MutePhaseNotifications {
+		log.Infof(ctx, "%q has muted phase notifications for %v, will skip sending notification", userId, gameID)
+		return nil
+	}
+
+	quietUntil, err := msgContext.userConfig.QuietUntil(ctx, time.Now())
+	if err != nil {
+		log.Errorf(ctx, "Unable to check quiet hours of %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+	if !quietUntil.IsZero() {
+		if err := sendPhaseNotificationsToMailFunc.EnqueueAt(ctx, quietUntil, host, scheme, gameID, phaseOrdinal, userId); err != nil {
+			log.Errorf(ctx, "Unable to defer mail to %q until %v: %v; hope datastore gets fixed", userId, quietUntil, err)
+			return err
+		}
+		log.Infof(ctx, "sendPhaseNotificationsToMail(..., %q, %q, %v, %v, %q) *** DEFERRED UNTIL %v ***", host, scheme, gameID, phaseOrdinal, userId, quietUntil)
+		return nil
+	}
+
 	sendGridConf, err := GetSendGrid(ctx)
 	if err != nil {
 		log.Errorf(ctx, "Unable to load sendgrid API key: %v; upload one or hope datastore gets fixed", err)
@@ -163,11 +219,23 @@ func sendPhaseNotificationsToMail(ctx context.Context, host, scheme string, game
 
 	msgContext.mailData["unsubscribeURL"] = unsubscribeURL.String()
 
+	phaseText, err := msgContext.phase.Text(ctx, msgContext.game.Variant)
+	if err != nil {
+		log.Warningf(ctx, "Unable to render %v as text: %v; sending mail without it", PP(msgContext.phase), err)
+	}
+	msgContext.mailData["phaseText"] = phaseText
+
 	msg := sendgrid.NewMail()
+	summary := ""
+	if msgContext.summary != "" {
+		summary = fmt.Sprintf("%s.\n\n", msgContext.summary)
+	}
 	msg.SetText(fmt.Sprintf(
-		"%s has a new phase: %s.\n\nVisit %s to stop receiving email like this.",
+		"%s has a new phase: %s.\n\n%s%s\nVisit %s to stop receiving email like this.",
 		msgContext.game.Desc,
 		msgContext.mapURL.String(),
+		summary,
+		phaseText,
 		unsubscribeURL.String()))
 	msg.SetSubject(
 		fmt.Sprintf(
@@ -182,6 +250,12 @@ func sendPhaseNotificationsToMail(ctx context.Context, host, scheme string, game
 
 	msgContext.userConfig.MailConfig.MessageConfig.Customize(ctx, msg, msgContext.mailData)
 
+	if pngBytes, err := phaseMapPNG(ctx, msgContext.phase, msgContext.game.Variant, msgContext.member.Nation); err != nil {
+		log.Warningf(ctx, "Unable to render map for %v: %v; sending mail without map", PP(msgContext.phase), err)
+	} else if err := msg.AddAttachment("map.png", bytes.NewReader(pngBytes)); err != nil {
+		log.Warningf(ctx, "Unable to attach map to %v: %v; sending mail without map", PP(msg), err)
+	}
+
 	recipEmail, err := mail.ParseAddress(msgContext.user.Email)
 	if err != nil {
 		log.Errorf(ctx, "Unable to parse email address of %v: %v; unable to recover, exiting", PP(msgContext.user), err)
@@ -217,6 +291,25 @@ func sendPhaseNotificationsToFCM(ctx context.Context, host, scheme string, gameI
 		return err
 	}
 
+	if msgContext.gameState.MutePhaseNotifications {
+		log.Infof(ctx, "%q has muted phase notifications for %v, will skip sending notifications", userId, gameID)
+		return nil
+	}
+
+	quietUntil, err := msgContext.userConfig.QuietUntil(ctx, time.Now())
+	if err != nil {
+		log.Errorf(ctx, "Unable to check quiet hours of %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+	if !quietUntil.IsZero() {
+		if err := sendPhaseNotificationsToFCMFunc.EnqueueAt(ctx, quietUntil, host, scheme, gameID, phaseOrdinal, userId, finishedTokens); err != nil {
+			log.Errorf(ctx, "Unable to defer notifications to %q until %v: %v; hope datastore gets fixed", userId, quietUntil, err)
+			return err
+		}
+		log.Infof(ctx, "sendPhaseNotificationsToFCM(..., %q, %q, %v, %v, %q, %+v) *** DEFERRED UNTIL %v ***", host, scheme, gameID, phaseOrdinal, userId, finishedTokens, quietUntil)
+		return nil
+	}
+
 	dataPayload, err := NewFCMData(msgContext.fcmData)
 	if err != nil {
 		log.Errorf(ctx, "Unable to encode FCM data payload %v: %v; fix NewFCMData", msgContext.fcmData, err)
@@ -285,7 +378,30 @@ func sendPhaseNotificationsToFCM(ctx context.Context, host, scheme string, gameI
 func sendPhaseNotificationsToUsers(ctx context.Context, host, scheme string, gameID *datastore.Key, phaseOrdinal int64, uids []string) error {
 	log.Infof(ctx, "sendPhaseNotificationsToUsers(..., %q, %q, %v, %v, %+v)", host, scheme, gameID, phaseOrdinal, uids)
 
+	phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
+	if err != nil {
+		log.Errorf(ctx, "PhaseID(..., %v, %v): %v; fix the PhaseID func", gameID, phaseOrdinal, err)
+		return err
+	}
+
 	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		phase := &Phase{}
+		if err := datastore.Get(ctx, phaseID, phase); err == datastore.ErrNoSuchEntity {
+			log.Infof(ctx, "%v doesn't exist anymore, exiting", phaseID)
+			return nil
+		} else if err != nil {
+			log.Errorf(ctx, "Unable to load phase %v: %v; hope datastore gets fixed", phaseID, err)
+			return err
+		}
+		if err := recordUserUpdate(ctx, uids[0], &UserUpdate{
+			Type:         PhaseUserUpdate,
+			GameID:       gameID,
+			PhaseOrdinal: phaseOrdinal,
+			DeadlineAt:   phase.DeadlineAt,
+		}); err != nil {
+			log.Errorf(ctx, "Unable to record update to %q: %v; hope datastore gets fixed", uids[0], err)
+			return err
+		}
 		if err := sendPhaseNotificationsToFCMFunc.EnqueueIn(ctx, 0, host, scheme, gameID, phaseOrdinal, uids[0], map[string]struct{}{}); err != nil {
 			log.Errorf(ctx, "Unable to enqueue sending to %q: %v; hope datastore gets fixed", uids[0], err)
 			return err
@@ -294,6 +410,10 @@ func sendPhaseNotificationsToUsers(ctx context.Context, host, scheme string, gam
 			log.Errorf(ctx, "Unable to enqueue sending mail to %q: %v; hope datastore gets fixed", uids[0], err)
 			return err
 		}
+		if err := sendPhaseWebhooksFunc.EnqueueIn(ctx, 0, host, scheme, gameID, phaseOrdinal, uids[0]); err != nil {
+			log.Errorf(ctx, "Unable to enqueue sending webhooks to %q: %v; hope datastore gets fixed", uids[0], err)
+			return err
+		}
 		if len(uids) > 1 {
 			if err := sendPhaseNotificationsToUsersFunc.EnqueueIn(ctx, 0, host, scheme, gameID, phaseOrdinal, uids[1:]); err != nil {
 				log.Errorf(ctx, "Unable to enqueue sending to rest: %v; hope datastore gets fixed", err)
@@ -305,6 +425,7 @@ func sendPhaseNotificationsToUsers(ctx context.Context, host, scheme string, gam
 		log.Errorf(ctx, "Unable to commit send tx: %v", err)
 		return err
 	}
+	signalUserUpdate(ctx, uids[0])
 
 	log.Infof(ctx, "sendPhaseNotificationsToUsers(..., %q, %q, %v, %v, %+v) *** SUCCESS ***", host, scheme, gameID, phaseOrdinal, uids)
 
@@ -326,6 +447,10 @@ func timeoutResolvePhase(ctx context.Context, gameID *datastore.Key, phaseOrdina
 		keys := []*datastore.Key{gameID, phaseID}
 		values := []interface{}{game, phase}
 		if err := datastore.GetMulti(ctx, keys, values); err != nil {
+			if merr, ok := err.(appengine.MultiError); ok && (merr[0] == datastore.ErrNoSuchEntity || merr[1] == datastore.ErrNoSuchEntity) {
+				log.Infof(ctx, "%v or %v doesn't exist anymore, exiting", gameID, phaseID)
+				return nil
+			}
 			log.Errorf(ctx, "datastore.GetMulti(..., %v, %v): %v; hope datastore will get fixed", keys, values, err)
 			return err
 		}
@@ -402,6 +527,11 @@ func (p *PhaseResolver) Act() error {
 		return nil
 	}
 
+	if p.Game.Finished {
+		log.Infof(p.Context, "Game already finished; %v; skipping resolution", PP(p.Game))
+		return nil
+	}
+
 	// Roll forward the game state.
 
 	log.Infof(p.Context, "PhaseStates at resolve time: %v", PP(p.PhaseStates))
@@ -591,6 +721,15 @@ func (p *PhaseResolver) Act() error {
 		return err
 	}
 
+	if err := recordGameEvent(p.Context, p.Game, &GameEvent{
+		GameID:       p.Game.ID,
+		Type:         PhaseResolvedEvent,
+		PhaseOrdinal: p.Phase.PhaseOrdinal,
+	}); err != nil {
+		log.Errorf(p.Context, "Unable to record resolution of %v: %v; hope datastore will get fixed", PP(p.Phase), err)
+		return err
+	}
+
 	if err = newPhase.Recalc(); err != nil {
 		return err
 	}
@@ -605,6 +744,15 @@ func (p *PhaseResolver) Act() error {
 		p.Game.FinishedAt = time.Now()
 		p.Game.Closed = true
 
+		if err := recordGameEvent(p.Context, p.Game, &GameEvent{
+			GameID:       p.Game.ID,
+			Type:         GameFinishedEvent,
+			PhaseOrdinal: newPhase.PhaseOrdinal,
+		}); err != nil {
+			log.Errorf(p.Context, "Unable to record finishing of %v: %v; hope datastore will get fixed", PP(p.Game), err)
+			return err
+		}
+
 		diasMembers := []dip.Nation{}
 		diasUsers := []string{}
 		nmrMembers := []dip.Nation{}
@@ -846,6 +994,7 @@ type Phase struct {
 	Resolutions []Resolution
 	Host        string
 	Scheme      string
+	Imported    bool
 }
 
 func (p *Phase) toVariantsPhase(variant string, orderMap map[dip.Nation]map[dip.Province][]string) *dvars.Phase {
@@ -912,22 +1061,7 @@ func devResolvePhaseTimeout(w ResponseWriter, r Request) error {
 		return err
 	}
 
-	phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
-	if err != nil {
-		return err
-	}
-
-	phase := &Phase{}
-	if err := datastore.Get(ctx, phaseID, phase); err != nil {
-		return err
-	}
-
-	phase.DeadlineAt = time.Now()
-	if _, err := datastore.Put(ctx, phaseID, phase); err != nil {
-		return err
-	}
-
-	return timeoutResolvePhase(ctx, gameID, phaseOrdinal)
+	return forceResolvePhase(ctx, gameID, phaseOrdinal)
 }
 
 func loadPhase(w ResponseWriter, r Request) (*Phase, error) {
@@ -977,7 +1111,28 @@ func (p *Phase) Item(r Request) *Item {
 			Rel:         "map",
 			Route:       RenderPhaseMapRoute,
 			RouteParams: []string{"game_id", p.GameID.Encode(), "phase_ordinal", fmt.Sprint(p.PhaseOrdinal)},
-		}))
+		})).
+		AddLink(r.NewLink(Link{
+			Rel:         "svg-map",
+			Route:       RenderPhaseMapSVGRoute,
+			RouteParams: []string{"game_id", p.GameID.Encode(), "phase_ordinal", fmt.Sprint(p.PhaseOrdinal)},
+		})).
+		AddLink(r.NewLink(Link{
+			Rel:         "png-map",
+			Route:       RenderPhaseMapPNGRoute,
+			RouteParams: []string{"game_id", p.GameID.Encode(), "phase_ordinal", fmt.Sprint(p.PhaseOrdinal)},
+		})).
+		AddLink(r.NewLink(Link{
+			Rel:         "diff",
+			Route:       PhaseDiffRoute,
+			RouteParams: []string{"game_id", p.GameID.Encode(), "phase_ordinal", fmt.Sprint(p.PhaseOrdinal)},
+		})).
+		SetDesc([][]string{
+			[]string{
+				"Plain text",
+				"Load a phase with `text/plain` preferred in the `Accept` header to get it rendered as plain text, listing units, supply centers and dislodged units per nation, followed by the resolutions.",
+			},
+		})
 	_, isMember := r.Values()[memberNationFlag]
 	if isMember || p.Resolved {
 		phaseItem.AddLink(r.NewLink(Link{
@@ -1008,7 +1163,10 @@ func (p *Phase) Item(r Request) *Item {
 }
 
 func (p *Phase) ScheduleResolution(ctx context.Context) error {
-	return timeoutResolvePhaseFunc.EnqueueAt(ctx, p.DeadlineAt, p.GameID, p.PhaseOrdinal)
+	if err := timeoutResolvePhaseFunc.EnqueueAt(ctx, p.DeadlineAt, p.GameID, p.PhaseOrdinal); err != nil {
+		return err
+	}
+	return p.ScheduleReminders(ctx)
 }
 
 func PhaseID(ctx context.Context, gameID *datastore.Key, phaseOrdinal int64) (*datastore.Key, error) {
@@ -1222,33 +1380,34 @@ func (p *Phase) State(ctx context.Context, variant vrt.Variant, orderMap map[dip
 	return variant.Blank(variant.Phase(p.Year, p.Season, p.Type)).Load(units, supplyCenters, dislodgeds, dislodgers, bounces, parsedOrders), nil
 }
 
-func renderPhaseMap(w ResponseWriter, r Request) error {
+// loadViewedPhase loads the game and phase in the request, and returns them along with the nation of the requesting user, if a member.
+func loadViewedPhase(r Request) (*Game, *Phase, dip.Nation, error) {
 	ctx := appengine.NewContext(r.Req())
 
 	user, ok := r.Values()["user"].(*auth.User)
 	if !ok {
-		return HTTPErr{"unauthorized", 401}
+		return nil, nil, "", HTTPErr{"unauthorized", 401}
 	}
 
 	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
 	if err != nil {
-		return err
+		return nil, nil, "", err
 	}
 
 	phaseOrdinal, err := strconv.ParseInt(r.Vars()["phase_ordinal"], 10, 64)
 	if err != nil {
-		return err
+		return nil, nil, "", err
 	}
 
 	phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
 	if err != nil {
-		return err
+		return nil, nil, "", err
 	}
 
 	game := &Game{}
 	phase := &Phase{}
 	if err := datastore.GetMulti(ctx, []*datastore.Key{gameID, phaseID}, []interface{}{game, phase}); err != nil {
-		return err
+		return nil, nil, "", err
 	}
 	game.ID = gameID
 
@@ -1258,24 +1417,55 @@ func renderPhaseMap(w ResponseWriter, r Request) error {
 		nation = member.Nation
 	}
 
-	foundOrders, err := phase.Orders(ctx)
+	return game, phase, nation, nil
+}
+
+// loadVariantsPhase loads the phase of the request, with the orders the user is allowed to see.
+func loadVariantsPhase(r Request) (*dvars.Phase, error) {
+	game, phase, nation, err := loadViewedPhase(r)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	return phase.variantsPhase(appengine.NewContext(r.Req()), game.Variant, nation)
+}
+
+// variantsPhase returns the phase with the orders viewer is allowed to see.
+func (p *Phase) variantsPhase(ctx context.Context, variant string, viewer dip.Nation) (*dvars.Phase, error) {
+	foundOrders, err := p.Orders(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	ordersToDisplay := map[dip.Nation]map[dip.Province][]string{}
 	for nat, orders := range foundOrders {
-		log.Infof(ctx, "%#v == %#v => %v", nat, nation, nat == nation)
-		if nat == nation || phase.Resolved {
+		log.Infof(ctx, "%#v == %#v => %v", nat, viewer, nat == viewer)
+		if nat == viewer || p.Resolved {
 			ordersToDisplay[nat] = orders
 		}
 	}
 
-	vPhase := phase.toVariantsPhase(game.Variant, ordersToDisplay)
+	return p.toVariantsPhase(variant, ordersToDisplay), nil
+}
+
+func renderPhaseMap(w ResponseWriter, r Request) error {
+	vPhase, err := loadVariantsPhase(r)
+	if err != nil {
+		return err
+	}
 
 	return dvars.RenderPhaseMap(w, r, vPhase)
 }
 
+func renderPhaseMapSVG(w ResponseWriter, r Request) error {
+	vPhase, err := loadVariantsPhase(r)
+	if err != nil {
+		return err
+	}
+
+	return dvars.RenderPhaseMapSVG(w, r, vPhase)
+}
+
 func listPhases(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
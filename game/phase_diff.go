@@ -0,0 +1,344 @@
+package game
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zond/diplicity/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	. "github.com/zond/goaeoas"
+	dip "github.com/zond/godip/common"
+)
+
+const (
+	MoveEvent      = "Move"
+	BounceEvent    = "Bounce"
+	DislodgedEvent = "Dislodged"
+	RetreatEvent   = "Retreat"
+	DisbandEvent   = "Disband"
+	BuildEvent     = "Build"
+	SCCaptureEvent = "SCCapture"
+	SCLossEvent    = "SCLoss"
+)
+
+// PhaseEvent describes one thing that happened to a nation between two phases.
+type PhaseEvent struct {
+	Type        string
+	Nation      dip.Nation
+	UnitType    dip.UnitType `json:",omitempty"`
+	Province    dip.Province
+	Destination dip.Province `json:",omitempty"`
+	// The resolution of failed orders, the dislodging province of dislodgements, and the previous owner of captured supply centers.
+	Detail string `json:",omitempty"`
+}
+
+type PhaseEvents []PhaseEvent
+
+func (p PhaseEvents) Len() int {
+	return len(p)
+}
+
+func (p PhaseEvents) Less(i, j int) bool {
+	if p[i].Nation != p[j].Nation {
+		return p[i].Nation < p[j].Nation
+	}
+	if p[i].Type != p[j].Type {
+		return p[i].Type < p[j].Type
+	}
+	return p[i].Province < p[j].Province
+}
+
+func (p PhaseEvents) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+
+// PhaseDiff describes what happened when the phase before PhaseOrdinal was resolved.
+type PhaseDiff struct {
+	GameID       *datastore.Key
+	PhaseOrdinal int64
+	Events       PhaseEvents
+	// The summary sent in phase notifications, as seen by the nation of the viewing member.
+	Summary string
+}
+
+func (p *PhaseDiff) Item(r Request) *Item {
+	return NewItem(p).SetName("phase-diff").AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       PhaseDiffRoute,
+		RouteParams: []string{"game_id", p.GameID.Encode(), "phase_ordinal", fmt.Sprint(p.PhaseOrdinal)},
+	})).AddLink(r.NewLink(PhaseResource.Link("phase", Load, []string{"game_id", p.GameID.Encode(), "phase_ordinal", fmt.Sprint(p.PhaseOrdinal)})))
+}
+
+// NewPhaseDiff compares phase with the phase before it, using the orders and resolutions of the previous phase and the units and supply centers of both.
+// The first phase of a game has no events.
+func NewPhaseDiff(ctx context.Context, phase *Phase) (*PhaseDiff, error) {
+	diff := &PhaseDiff{
+		GameID:       phase.GameID,
+		PhaseOrdinal: phase.PhaseOrdinal,
+		Events:       PhaseEvents{},
+	}
+	if phase.PhaseOrdinal < 2 {
+		return diff, nil
+	}
+
+	prevID, err := PhaseID(ctx, phase.GameID, phase.PhaseOrdinal-1)
+	if err != nil {
+		return nil, err
+	}
+	prev := &Phase{}
+	if err := datastore.Get(ctx, prevID, prev); err != nil {
+		return nil, err
+	}
+	if !prev.Resolved {
+		return nil, fmt.Errorf("%v is not resolved, but %v exists", prevID, phase.PhaseOrdinal)
+	}
+
+	orders, err := prev.Orders(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resolutions := map[dip.Province]string{}
+	for _, res := range prev.Resolutions {
+		resolutions[res.Province] = res.Resolution
+	}
+	prevUnits := map[dip.Province]dip.Unit{}
+	for _, unit := range prev.Units {
+		prevUnits[unit.Province] = unit.Unit
+	}
+	units := map[dip.Province]dip.Unit{}
+	for _, unit := range phase.Units {
+		units[unit.Province] = unit.Unit
+	}
+
+	switch prev.Type {
+	case "Movement":
+		for nat, nationOrders := range orders {
+			for src, parts := range nationOrders {
+				if len(parts) < 2 || (parts[0] != "Move" && parts[0] != "MoveViaConvoy") {
+					continue
+				}
+				event := PhaseEvent{
+					Type:        MoveEvent,
+					Nation:      nat,
+					UnitType:    prevUnits[src].Type,
+					Province:    src,
+					Destination: dip.Province(parts[1]),
+				}
+				if res := resolutions[src]; res != "" && res != "OK" {
+					event.Type = BounceEvent
+					event.Detail = res
+				}
+				diff.Events = append(diff.Events, event)
+			}
+		}
+		dislodgers := map[dip.Province]dip.Province{}
+		for _, dislodger := range phase.Dislodgers {
+			dislodgers[dislodger.Dislodger] = dislodger.Province
+		}
+		for _, dislodged := range phase.Dislodgeds {
+			diff.Events = append(diff.Events, PhaseEvent{
+				Type:     DislodgedEvent,
+				Nation:   dislodged.Dislodged.Nation,
+				UnitType: dislodged.Dislodged.Type,
+				Province: dislodged.Province,
+				Detail:   string(dislodgers[dislodged.Province]),
+			})
+		}
+	case "Retreat":
+		// Dislodged units that didn't successfully retreat are disbanded, whether ordered to or not.
+		for _, dislodged := range prev.Dislodgeds {
+			event := PhaseEvent{
+				Type:     DisbandEvent,
+				Nation:   dislodged.Dislodged.Nation,
+				UnitType: dislodged.Dislodged.Type,
+				Province: dislodged.Province,
+			}
+			parts := orders[dislodged.Dislodged.Nation][dislodged.Province]
+			if len(parts) > 1 && parts[0] == "Move" {
+				if res := resolutions[dislodged.Province]; res == "" || res == "OK" {
+					event.Type = RetreatEvent
+					event.Destination = dip.Province(parts[1])
+				} else {
+					event.Detail = res
+				}
+			}
+			diff.Events = append(diff.Events, event)
+		}
+	case "Adjustment":
+		// Comparing unit positions also catches units disbanded in civil disorder.
+		for prov, unit := range prevUnits {
+			if found, ok := units[prov]; !ok || found != unit {
+				diff.Events = append(diff.Events, PhaseEvent{
+					Type:     DisbandEvent,
+					Nation:   unit.Nation,
+					UnitType: unit.Type,
+					Province: prov,
+				})
+			}
+		}
+		for prov, unit := range units {
+			if found, ok := prevUnits[prov]; !ok || found != unit {
+				diff.Events = append(diff.Events, PhaseEvent{
+					Type:     BuildEvent,
+					Nation:   unit.Nation,
+					UnitType: unit.Type,
+					Province: prov,
+				})
+			}
+		}
+	}
+
+	prevOwners := map[dip.Province]dip.Nation{}
+	for _, sc := range prev.SCs {
+		prevOwners[sc.Province] = sc.Owner
+	}
+	owners := map[dip.Province]dip.Nation{}
+	for _, sc := range phase.SCs {
+		owners[sc.Province] = sc.Owner
+		if prevOwner := prevOwners[sc.Province]; prevOwner != sc.Owner {
+			diff.Events = append(diff.Events, PhaseEvent{
+				Type:     SCCaptureEvent,
+				Nation:   sc.Owner,
+				Province: sc.Province,
+				Detail:   string(prevOwner),
+			})
+		}
+	}
+	for _, sc := range prev.SCs {
+		if owners[sc.Province] != sc.Owner {
+			diff.Events = append(diff.Events, PhaseEvent{
+				Type:     SCLossEvent,
+				Nation:   sc.Owner,
+				Province: sc.Province,
+			})
+		}
+	}
+
+	sort.Sort(diff.Events)
+
+	return diff, nil
+}
+
+// summarize describes the most interesting events of the diff in a sentence, addressing viewer as "you".
+// Movements of other nations are left out, since they are better seen on the map.
+func (p *PhaseDiff) summarize(variant string, viewer dip.Nation) string {
+	whose := func(nat dip.Nation) string {
+		if nat == viewer {
+			return "your"
+		}
+		return fmt.Sprintf("%s's", nat)
+	}
+	who := func(nat dip.Nation) string {
+		if nat == viewer {
+			return "you"
+		}
+		return string(nat)
+	}
+	name := func(prov dip.Province) string {
+		return provinceName(variant, prov)
+	}
+	unit := func(event PhaseEvent) string {
+		return fmt.Sprintf("%s %s in %s", whose(event.Nation), strings.ToLower(string(event.UnitType)), name(event.Province))
+	}
+
+	parts := []string{}
+	scDelta := 0
+	for _, event := range p.Events {
+		switch event.Type {
+		case BounceEvent:
+			if event.Nation == viewer {
+				parts = append(parts, fmt.Sprintf("%s failed to move to %s", unit(event), name(event.Destination)))
+			}
+		case DislodgedEvent:
+			parts = append(parts, fmt.Sprintf("%s was dislodged", unit(event)))
+		case RetreatEvent:
+			parts = append(parts, fmt.Sprintf("%s retreated to %s", unit(event), name(event.Destination)))
+		case DisbandEvent:
+			parts = append(parts, fmt.Sprintf("%s was disbanded", unit(event)))
+		case BuildEvent:
+			article := "a"
+			if event.UnitType == "Army" {
+				article = "an"
+			}
+			parts = append(parts, fmt.Sprintf("%s built %s %s in %s", who(event.Nation), article, strings.ToLower(string(event.UnitType)), name(event.Province)))
+		case SCCaptureEvent:
+			parts = append(parts, fmt.Sprintf("%s took %s", who(event.Nation), name(event.Province)))
+			if event.Nation == viewer {
+				scDelta++
+			}
+		case SCLossEvent:
+			if event.Nation == viewer {
+				scDelta--
+			}
+		}
+	}
+	if scDelta != 0 {
+		verb := "gained"
+		count := scDelta
+		if scDelta < 0 {
+			verb = "lost"
+			count = -scDelta
+		}
+		noun := "SC"
+		if count != 1 {
+			noun = "SCs"
+		}
+		parts = append(parts, fmt.Sprintf("you %s %d %s", verb, count, noun))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+
+	summary := strings.Join(parts, "; ")
+	return strings.ToUpper(summary[:1]) + summary[1:]
+}
+
+func loadPhaseDiff(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	gameID, err := datastore.DecodeKey(r.Vars()["game_id"])
+	if err != nil {
+		return err
+	}
+
+	phaseOrdinal, err := strconv.ParseInt(r.Vars()["phase_ordinal"], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
+	if err != nil {
+		return err
+	}
+
+	game := &Game{}
+	phase := &Phase{}
+	if err := datastore.GetMulti(ctx, []*datastore.Key{gameID, phaseID}, []interface{}{game, phase}); err != nil {
+		return err
+	}
+
+	diff, err := NewPhaseDiff(ctx, phase)
+	if err != nil {
+		return err
+	}
+
+	var viewer dip.Nation
+	if member, isMember := game.GetMember(user.Id); isMember {
+		viewer = member.Nation
+	}
+	diff.Summary = diff.summarize(game.Variant, viewer)
+
+	w.SetContent(diff.Item(r))
+	return nil
+}
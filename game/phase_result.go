@@ -26,7 +26,7 @@ type PhaseResult struct {
 }
 
 var PhaseResultResource = &Resource{
-	Load:     loadPhaseResult,
+	Load:     auth.Scoped(auth.ReadGamesScope, loadPhaseResult),
 	FullPath: "/Game/{game_id}/Phase/{phase_ordinal}/Result",
 }
 
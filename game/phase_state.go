@@ -23,13 +23,13 @@ var PhaseStateResource *Resource
 
 func init() {
 	PhaseStateResource = &Resource{
-		Update:   updatePhaseState,
+		Update:   auth.Scoped(auth.WriteOrdersScope, updatePhaseState),
 		FullPath: "/Game/{game_id}/Phase/{phase_ordinal}/PhaseState/{nation}",
 		Listers: []Lister{
 			{
 				Path:    "/Game/{game_id}/Phase/{phase_ordinal}/PhaseStates",
 				Route:   ListPhaseStatesRoute,
-				Handler: listPhaseStates,
+				Handler: auth.ScopedHandler(auth.ReadGamesScope, listPhaseStates),
 			},
 		},
 	}
@@ -188,6 +188,15 @@ func updatePhaseState(w ResponseWriter, r Request) (*PhaseState, error) {
 		if err := phaseState.Save(ctx); err != nil {
 			return err
 		}
+		if err := recordGameEvent(ctx, game, &GameEvent{
+			GameID:       gameID,
+			Type:         PhaseStateChangedEvent,
+			UserId:       user.Id,
+			Nation:       member.Nation,
+			PhaseOrdinal: phaseOrdinal,
+		}); err != nil {
+			return err
+		}
 		if err := game.Save(ctx); err != nil {
 			return err
 		}
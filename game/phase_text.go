@@ -0,0 +1,175 @@
+package game
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/zond/godip/variants"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+
+	. "github.com/zond/goaeoas"
+	dip "github.com/zond/godip/common"
+)
+
+// retreatOptions returns the long names of the provinces each dislodged unit of the phase may retreat to.
+// Only unresolved retreat phases have any retreat options.
+func (p *Phase) retreatOptions(ctx context.Context, variantName string) (map[dip.Province][]string, error) {
+	result := map[dip.Province][]string{}
+	if p.Resolved || p.Type != "Retreat" || len(p.Dislodgeds) == 0 {
+		return result, nil
+	}
+	variant, found := variants.Variants[variantName]
+	if !found {
+		return nil, fmt.Errorf("unknown variant %q", variantName)
+	}
+	s, err := p.State(ctx, variant, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, nat := range variant.Nations {
+		for src, srcOptions := range s.Phase().Options(s, nat) {
+			prov, ok := src.(dip.Province)
+			if !ok {
+				continue
+			}
+			dsts := []string{}
+			collectRetreatDestinations(srcOptions[dip.OrderType("Move")], &dsts)
+			sort.Strings(dsts)
+			result[prov] = dsts
+		}
+	}
+	return result, nil
+}
+
+func collectRetreatDestinations(options dip.Options, dsts *[]string) {
+	for value, next := range options {
+		if prov, ok := value.(dip.Province); ok && len(next) == 0 {
+			*dsts = append(*dsts, string(prov))
+		}
+		collectRetreatDestinations(next, dsts)
+	}
+}
+
+// Text renders the phase as plain text, listing units, supply centers and dislodged units per nation, followed by the resolutions.
+// It contains nothing that isn't visible on the map of the phase, so it is safe to show to anyone.
+func (p *Phase) Text(ctx context.Context, variantName string) (string, error) {
+	variant, found := variants.Variants[variantName]
+	if !found {
+		return "", fmt.Errorf("unknown variant %q", variantName)
+	}
+	name := func(prov dip.Province) string {
+		return provinceName(variantName, prov)
+	}
+
+	retreats, err := p.retreatOptions(ctx, variantName)
+	if err != nil {
+		return "", err
+	}
+
+	units := map[dip.Nation][]string{}
+	for _, unit := range p.Units {
+		units[unit.Unit.Nation] = append(units[unit.Unit.Nation], fmt.Sprintf("%s %s", unit.Unit.Type, name(unit.Province)))
+	}
+	scs := map[dip.Nation][]string{}
+	for _, sc := range p.SCs {
+		scs[sc.Owner] = append(scs[sc.Owner], name(sc.Province))
+	}
+	dislodgeds := map[dip.Nation][]string{}
+	for _, dislodged := range p.Dislodgeds {
+		line := fmt.Sprintf("%s %s", dislodged.Dislodged.Type, name(dislodged.Province))
+		if dsts, found := retreats[dislodged.Province]; found {
+			if len(dsts) == 0 {
+				line += ", must disband"
+			} else {
+				names := make([]string, len(dsts))
+				for i, dst := range dsts {
+					names[i] = name(dip.Province(dst))
+				}
+				line += fmt.Sprintf(", may retreat to %s", strings.Join(names, ", "))
+			}
+		}
+		dislodgeds[dislodged.Dislodged.Nation] = append(dislodgeds[dislodged.Dislodged.Nation], line)
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s %d, %s (%s)\n", p.Season, p.Year, p.Type, variantName)
+	for _, nat := range variant.Nations {
+		sort.Strings(units[nat])
+		sort.Strings(scs[nat])
+		sort.Strings(dislodgeds[nat])
+		fmt.Fprintf(buf, "\n%s: %d supply centers, %d units\n", nat, len(scs[nat]), len(units[nat]))
+		if len(scs[nat]) > 0 {
+			fmt.Fprintf(buf, "  Supply centers: %s\n", strings.Join(scs[nat], ", "))
+		}
+		for _, unit := range units[nat] {
+			fmt.Fprintf(buf, "  %s\n", unit)
+		}
+		for _, dislodged := range dislodgeds[nat] {
+			fmt.Fprintf(buf, "  Dislodged: %s\n", dislodged)
+		}
+	}
+
+	if p.Resolved {
+		failures := []string{}
+		for _, res := range p.Resolutions {
+			if suffix := resolutionSuffix(res.Resolution); suffix != "" {
+				failures = append(failures, fmt.Sprintf("  %s:%s\n", name(res.Province), suffix))
+			}
+		}
+		sort.Strings(failures)
+		fmt.Fprintf(buf, "\nResolutions: %d orders succeeded, %d failed\n", len(p.Resolutions)-len(failures), len(failures))
+		for _, failure := range failures {
+			buf.WriteString(failure)
+		}
+	}
+
+	return buf.String(), nil
+}
+
+// prefersPlainText returns whether the Accept header of the request prefers text/plain to every other content type.
+func prefersPlainText(req *http.Request, match *mux.RouteMatch) bool {
+	textQuality := 0.0
+	otherQuality := 0.0
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		parts := strings.Split(accepted, ";")
+		quality := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if strings.TrimSpace(parts[0]) == "text/plain" {
+			if quality > textQuality {
+				textQuality = quality
+			}
+		} else if quality > otherQuality {
+			otherQuality = quality
+		}
+	}
+	return textQuality > otherQuality
+}
+
+func renderPhaseText(w ResponseWriter, r Request) error {
+	game, phase, _, err := loadViewedPhase(r)
+	if err != nil {
+		return err
+	}
+
+	text, err := phase.Text(appengine.NewContext(r.Req()), game.Variant)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err = w.Write([]byte(text))
+	return err
+}
@@ -0,0 +1,53 @@
+package game
+
+import (
+	"github.com/zond/diplicity/auth"
+)
+
+// The quotas requests to the routes of this package count against. Routes not listed here count against the default quota.
+func init() {
+	auth.SetRouteClass(auth.WriteRouteClass,
+		"Game.Create",
+		"Member.Create",
+		"Member.Update",
+		"Member.Delete",
+		"Order.Create",
+		"Order.Update",
+		"Order.Delete",
+		"PhaseState.Update",
+		"GameState.Update",
+		"Ban.Create",
+		"Ban.Delete",
+	)
+	auth.SetRouteClass(auth.PressRouteClass,
+		"Message.Create",
+		"MessageFlag.Create",
+	)
+	// Game listers run a query, and then look up bans for every game found.
+	auth.SetRouteClass(auth.ExpensiveRouteClass,
+		ListOpenGamesRoute,
+		ListStartedGamesRoute,
+		ListFinishedGamesRoute,
+		ListMyStagingGamesRoute,
+		ListMyStartedGamesRoute,
+		ListMyFinishedGamesRoute,
+		ListOtherStagingGamesRoute,
+		ListOtherStartedGamesRoute,
+		ListOtherFinishedGamesRoute,
+		ListTopRatedPlayersRoute,
+		ListTopReliablePlayersRoute,
+		ListTopHatedPlayersRoute,
+		ListTopHaterPlayersRoute,
+		ListTopQuickPlayersRoute,
+		RenderPhaseMapPNGRoute,
+		RenderGameGIFRoute,
+		RenderGameSpritesRoute,
+		GameHistoryRoute,
+		ExportGameRoute,
+		ImportGameRoute,
+		"Versus.Load",
+		"VariantStats.Load",
+		"UserExport.Create",
+		DownloadUserExportRoute,
+	)
+}
@@ -0,0 +1,305 @@
+package game
+
+import (
+	"fmt"
+	"net/mail"
+	"sync"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/go-fcm"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+	"gopkg.in/sendgrid/sendgrid-go.v2"
+
+	. "github.com/zond/goaeoas"
+	dip "github.com/zond/godip/common"
+)
+
+const (
+	remindersKind = "Reminders"
+)
+
+var (
+	// DefaultReminders are used until other reminders are configured.
+	DefaultReminders = &Reminders{
+		MinutesBefore: []int{24 * 60, 2 * 60},
+	}
+
+	prodReminders     *Reminders
+	prodRemindersLock = sync.RWMutex{}
+
+	schedulePhaseRemindersFunc  *DelayFunc
+	sendPhaseRemindersFunc      *DelayFunc
+	sendPhaseReminderToUserFunc *DelayFunc
+)
+
+func init() {
+	schedulePhaseRemindersFunc = NewDelayFunc("game-schedulePhaseReminders", schedulePhaseReminders)
+	sendPhaseRemindersFunc = NewDelayFunc("game-sendPhaseReminders", sendPhaseReminders)
+	sendPhaseReminderToUserFunc = NewDelayFunc("game-sendPhaseReminderToUser", sendPhaseReminderToUser)
+}
+
+// Reminders defines how many minutes before phase deadlines members who haven't acted get reminded.
+type Reminders struct {
+	MinutesBefore []int
+}
+
+func getRemindersKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, remindersKind, prodKey, 0, nil)
+}
+
+func SetReminders(ctx context.Context, reminders *Reminders) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		currentReminders := &Reminders{}
+		if err := datastore.Get(ctx, getRemindersKey(ctx), currentReminders); err == nil {
+			return HTTPErr{"Reminders already configured", 400}
+		}
+		if _, err := datastore.Put(ctx, getRemindersKey(ctx), reminders); err != nil {
+			return err
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: false})
+}
+
+func GetReminders(ctx context.Context) (*Reminders, error) {
+	prodRemindersLock.RLock()
+	if prodReminders != nil {
+		defer prodRemindersLock.RUnlock()
+		return prodReminders, nil
+	}
+	prodRemindersLock.RUnlock()
+	prodRemindersLock.Lock()
+	defer prodRemindersLock.Unlock()
+	foundReminders := &Reminders{}
+	if err := datastore.Get(ctx, getRemindersKey(ctx), foundReminders); err == datastore.ErrNoSuchEntity {
+		foundReminders = DefaultReminders
+	} else if err != nil {
+		return nil, err
+	}
+	prodReminders = foundReminders
+	return prodReminders, nil
+}
+
+// ScheduleReminders enqueues a single task that schedules the reminders of the phase, since transactions can only enqueue a few tasks.
+func (p *Phase) ScheduleReminders(ctx context.Context) error {
+	return schedulePhaseRemindersFunc.EnqueueIn(ctx, 0, p.Host, p.Scheme, p.GameID, p.PhaseOrdinal, p.DeadlineAt)
+}
+
+func schedulePhaseReminders(ctx context.Context, host, scheme string, gameID *datastore.Key, phaseOrdinal int64, deadlineAt time.Time) error {
+	log.Infof(ctx, "schedulePhaseReminders(..., %q, %q, %v, %v, %v)", host, scheme, gameID, phaseOrdinal, deadlineAt)
+
+	reminders, err := GetReminders(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load reminder configuration: %v; hope datastore gets fixed", err)
+		return err
+	}
+
+	for _, minutes := range reminders.MinutesBefore {
+		remindAt := deadlineAt.Add(-time.Minute * time.Duration(minutes))
+		if remindAt.Before(time.Now()) {
+			continue
+		}
+		if err := sendPhaseRemindersFunc.EnqueueAt(ctx, remindAt, host, scheme, gameID, phaseOrdinal, deadlineAt); err != nil {
+			log.Errorf(ctx, "Unable to schedule reminder at %v: %v; hope datastore gets fixed", remindAt, err)
+			return err
+		}
+	}
+
+	log.Infof(ctx, "schedulePhaseReminders(..., %q, %q, %v, %v, %v) *** SUCCESS ***", host, scheme, gameID, phaseOrdinal, deadlineAt)
+
+	return nil
+}
+
+// deadlineMoved returns whether the deadline of the phase is another than deadlineAt, the deadline its reminders were scheduled for.
+// Deadlines are compared in seconds, since tasks get deadlines with nanoseconds while the datastore only keeps microseconds.
+func (p *Phase) deadlineMoved(deadlineAt time.Time) bool {
+	return p.DeadlineAt.Unix() != deadlineAt.Unix()
+}
+
+// membersToRemind returns the members of the game that have something to order, but haven't given any orders and aren't ready to resolve.
+func membersToRemind(game *Game, phaseStates PhaseStates, orders map[dip.Nation]map[dip.Province][]string) []Member {
+	phaseStateByNation := map[dip.Nation]PhaseState{}
+	for _, phaseState := range phaseStates {
+		phaseStateByNation[phaseState.Nation] = phaseState
+	}
+	result := []Member{}
+	for _, member := range game.Members {
+		phaseState := phaseStateByNation[member.Nation]
+		if phaseState.ReadyToResolve || phaseState.NoOrders || phaseState.Eliminated || len(orders[member.Nation]) > 0 {
+			continue
+		}
+		result = append(result, member)
+	}
+	return result
+}
+
+// sendPhaseReminders reminds the members that haven't given any orders and aren't ready to resolve,
+// unless the phase is resolved or the deadline it was scheduled for has moved.
+func sendPhaseReminders(ctx context.Context, host, scheme string, gameID *datastore.Key, phaseOrdinal int64, deadlineAt time.Time) error {
+	log.Infof(ctx, "sendPhaseReminders(..., %q, %q, %v, %v, %v)", host, scheme, gameID, phaseOrdinal, deadlineAt)
+
+	phaseID, err := PhaseID(ctx, gameID, phaseOrdinal)
+	if err != nil {
+		log.Errorf(ctx, "PhaseID(..., %v, %v): %v; fix the PhaseID func", gameID, phaseOrdinal, err)
+		return err
+	}
+
+	game := &Game{}
+	phase := &Phase{}
+	if err := datastore.GetMulti(ctx, []*datastore.Key{gameID, phaseID}, []interface{}{game, phase}); err != nil {
+		if merr, ok := err.(appengine.MultiError); ok && (merr[0] == datastore.ErrNoSuchEntity || merr[1] == datastore.ErrNoSuchEntity) {
+			log.Infof(ctx, "%v or %v doesn't exist anymore; skipping reminders", gameID, phaseID)
+			return nil
+		}
+		log.Errorf(ctx, "Unable to load game and phase: %v; hope datastore gets fixed", err)
+		return err
+	}
+
+	if phase.Resolved || game.Finished {
+		log.Infof(ctx, "%v already resolved; skipping reminders", PP(phase))
+		return nil
+	}
+	if phase.deadlineMoved(deadlineAt) {
+		log.Infof(ctx, "Deadline of %v moved from %v; skipping reminders", PP(phase), deadlineAt)
+		return nil
+	}
+
+	phaseStates := PhaseStates{}
+	if _, err := datastore.NewQuery(phaseStateKind).Ancestor(phaseID).GetAll(ctx, &phaseStates); err != nil {
+		log.Errorf(ctx, "Unable to load phase states of %v: %v; hope datastore gets fixed", phaseID, err)
+		return err
+	}
+	orders, err := phase.Orders(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load orders of %v: %v; hope datastore gets fixed", phaseID, err)
+		return err
+	}
+
+	for _, member := range membersToRemind(game, phaseStates, orders) {
+		if err := sendPhaseReminderToUserFunc.EnqueueIn(ctx, 0, host, scheme, gameID, phaseOrdinal, member.User.Id); err != nil {
+			log.Errorf(ctx, "Unable to enqueue reminder to %q: %v; hope datastore gets fixed", member.User.Id, err)
+			return err
+		}
+	}
+
+	log.Infof(ctx, "sendPhaseReminders(..., %q, %q, %v, %v, %v) *** SUCCESS ***", host, scheme, gameID, phaseOrdinal, deadlineAt)
+
+	return nil
+}
+
+func sendPhaseReminderToUser(ctx context.Context, host, scheme string, gameID *datastore.Key, phaseOrdinal int64, userId string) error {
+	log.Infof(ctx, "sendPhaseReminderToUser(..., %q, %q, %v, %v, %q)", host, scheme, gameID, phaseOrdinal, userId)
+
+	msgContext, err := getPhaseNotificationContext(ctx, host, scheme, gameID, phaseOrdinal, userId)
+	if err == noConfigError {
+		log.Infof(ctx, "%q has no configuration, will skip sending reminder", userId)
+		return nil
+	} else if err != nil {
+		log.Errorf(ctx, "Unable to get phase notification context: %v; fix getPhaseNotificationContext or hope datastore gets fixed", err)
+		return err
+	}
+
+	left := msgContext.phase.DeadlineAt.Sub(time.Now()) / time.Minute * time.Minute
+	title := fmt.Sprintf(
+		"%s: %s %d, %s resolves in %v",
+		msgContext.game.DescFor(msgContext.member.Nation),
+		msgContext.phase.Season,
+		msgContext.phase.Year,
+		msgContext.phase.Type,
+		left,
+	)
+	body := fmt.Sprintf("You haven't given any orders in %s, and the phase resolves in %v.", msgContext.game.Desc, left)
+	msgContext.mailData["deadlineAt"] = msgContext.phase.DeadlineAt
+	msgContext.fcmData["type"] = "reminder"
+	msgContext.fcmData["deadlineAt"] = msgContext.phase.DeadlineAt
+
+	dataPayload, err := NewFCMData(msgContext.fcmData)
+	if err != nil {
+		log.Errorf(ctx, "Unable to encode FCM data payload %v: %v; fix NewFCMData", msgContext.fcmData, err)
+		return err
+	}
+
+	for _, fcmToken := range msgContext.userConfig.FCMTokens {
+		if fcmToken.Disabled || fcmToken.Value == "" {
+			continue
+		}
+		notificationPayload := &fcm.NotificationPayload{
+			Title:       title,
+			Body:        body,
+			Tag:         "diplicity-engine-deadline-reminder",
+			ClickAction: msgContext.mapURL.String(),
+		}
+
+		fcmToken.ReminderConfig.Customize(ctx, notificationPayload, msgContext.mailData)
+
+		if err := FCMSendToTokensFunc.EnqueueIn(
+			ctx,
+			0,
+			time.Duration(0),
+			notificationPayload,
+			dataPayload,
+			map[string][]string{
+				userId: []string{fcmToken.Value},
+			},
+		); err != nil {
+			log.Errorf(ctx, "Unable to enqueue sending of reminder to %v/%v: %v; hope datastore gets fixed", userId, fcmToken.Value, err)
+			return err
+		}
+	}
+
+	if !msgContext.userConfig.MailConfig.Enabled {
+		log.Infof(ctx, "%q hasn't enabled mail notifications, will skip mailing reminder", userId)
+		return nil
+	}
+
+	sendGridConf, err := GetSendGrid(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load sendgrid API key: %v; upload one or hope datastore gets fixed", err)
+		return err
+	}
+
+	unsubscribeURL, err := auth.GetUnsubscribeURL(ctx, router, host, scheme, userId)
+	if err != nil {
+		log.Errorf(ctx, "Unable to create unsubscribe URL for %q: %v; fix auth.GetUnsubscribeURL", userId, err)
+		return err
+	}
+
+	msgContext.mailData["unsubscribeURL"] = unsubscribeURL.String()
+
+	msg := sendgrid.NewMail()
+	msg.SetText(fmt.Sprintf(
+		"%s\n\nVisit %s to see the current phase.\n\nVisit %s to stop receiving email like this.",
+		body,
+		msgContext.mapURL.String(),
+		unsubscribeURL.String()))
+	msg.SetSubject(title)
+	msg.AddHeader("List-Unsubscribe", fmt.Sprintf("<%s>", unsubscribeURL.String()))
+
+	msgContext.userConfig.MailConfig.ReminderConfig.Customize(ctx, msg, msgContext.mailData)
+
+	recipEmail, err := mail.ParseAddress(msgContext.user.Email)
+	if err != nil {
+		log.Errorf(ctx, "Unable to parse email address of %v: %v; unable to recover, exiting", PP(msgContext.user), err)
+		return nil
+	}
+	msg.AddRecipient(recipEmail)
+	msg.AddToName(string(msgContext.member.Nation))
+
+	msg.SetFrom(noreplyFromAddr)
+
+	client := sendgrid.NewSendGridClientWithApiKey(sendGridConf.APIKey)
+	client.Client = urlfetch.Client(ctx)
+	if err := client.Send(msg); err != nil {
+		log.Errorf(ctx, "Unable to send %v: %v; hope sendgrid gets fixed", msg, err)
+		return err
+	}
+	log.Infof(ctx, "Successfully sent %v", PP(msg))
+
+	log.Infof(ctx, "sendPhaseReminderToUser(..., %q, %q, %v, %v, %q) *** SUCCESS ***", host, scheme, gameID, phaseOrdinal, userId)
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package game
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+
+	dip "github.com/zond/godip/common"
+)
+
+func TestDeadlineMoved(t *testing.T) {
+	deadlineAt := time.Unix(1500000000, 123456789)
+	// The datastore only keeps microseconds.
+	phase := &Phase{DeadlineAt: deadlineAt.Truncate(time.Microsecond)}
+	if phase.deadlineMoved(deadlineAt) {
+		t.Errorf("deadline stored with microseconds was considered moved from %v", deadlineAt)
+	}
+	if !phase.deadlineMoved(deadlineAt.Add(time.Minute)) {
+		t.Errorf("deadline a minute later wasn't considered moved")
+	}
+}
+
+func TestMembersToRemind(t *testing.T) {
+	game := &Game{}
+	for _, nat := range []dip.Nation{"Austria", "England", "France", "Germany", "Italy"} {
+		game.Members = append(game.Members, Member{
+			User:   auth.User{Id: string(nat)},
+			Nation: nat,
+		})
+	}
+	phaseStates := PhaseStates{
+		{Nation: "England", ReadyToResolve: true},
+		{Nation: "Germany", NoOrders: true},
+		{Nation: "Italy", WantsDIAS: true},
+	}
+	orders := map[dip.Nation]map[dip.Province][]string{
+		"France": {"par": []string{"par", "Move", "bur"}},
+	}
+	members := membersToRemind(game, phaseStates, orders)
+	if len(members) != 2 || members[0].Nation != "Austria" || members[1].Nation != "Italy" {
+		t.Errorf("got %+v, wanted Austria and Italy reminded", members)
+	}
+}
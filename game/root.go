@@ -5,6 +5,7 @@ import (
 
 	"github.com/zond/diplicity/auth"
 	"github.com/zond/diplicity/variants"
+	"google.golang.org/appengine"
 
 	. "github.com/zond/goaeoas"
 )
@@ -44,6 +45,9 @@ func handleIndex(w ResponseWriter, r Request) error {
 	})).AddLink(r.NewLink(Link{
 		Rel:   "variants",
 		Route: variants.ListVariantsRoute,
+	})).AddLink(r.NewLink(Link{
+		Rel:   "login-providers",
+		Route: auth.ListLoginProvidersRoute,
 	}))
 
 	if user == nil {
@@ -114,7 +118,49 @@ func handleIndex(w ResponseWriter, r Request) error {
 			Rel:         "bans",
 			Route:       ListBansRoute,
 			RouteParams: []string{"user_id", user.Id},
-		})).AddLink(r.NewLink(UserStatsResource.Link("user-stats", Load, []string{"user_id", user.Id})))
+		})).AddLink(r.NewLink(UserStatsResource.Link("user-stats", Load, []string{"user_id", user.Id}))).
+			AddLink(r.NewLink(auth.ProfileResource.Link("profile", Load, []string{"user_id", user.Id}))).
+			AddLink(r.NewLink(Link{
+			Rel:         "identities",
+			Route:       auth.ListIdentitiesRoute,
+			RouteParams: []string{"user_id", user.Id},
+		})).AddLink(r.NewLink(Link{
+			Rel:         "sessions",
+			Route:       auth.ListSessionsRoute,
+			RouteParams: []string{"user_id", user.Id},
+		})).AddLink(r.NewLink(Link{
+			Rel:         "oauth-clients",
+			Route:       auth.ListOAuthClientsRoute,
+			RouteParams: []string{"user_id", user.Id},
+		})).AddLink(r.NewLink(Link{
+			Rel:         "oauth-grants",
+			Route:       auth.ListOAuthGrantsRoute,
+			RouteParams: []string{"user_id", user.Id},
+		})).AddLink(r.NewLink(Link{
+			Rel:         "exports",
+			Route:       ListUserExportsRoute,
+			RouteParams: []string{"user_id", user.Id},
+		})).AddLink(r.NewLink(Link{
+			Rel:         "updates",
+			Route:       ListUserUpdatesRoute,
+			RouteParams: []string{"user_id", user.Id},
+		})).AddLink(r.NewLink(Link{
+			Rel:         "delete-user",
+			Route:       DeleteUserRoute,
+			RouteParams: []string{"user_id", user.Id},
+			Method:      "DELETE",
+		}))
+		canImport, err := canImportGames(appengine.NewContext(r.Req()), user)
+		if err != nil {
+			return err
+		}
+		if canImport {
+			index.AddLink(r.NewLink(Link{
+				Rel:    "import-game",
+				Route:  ImportGameRoute,
+				Method: "POST",
+			}))
+		}
 	}
 	w.SetContent(index)
 	return nil
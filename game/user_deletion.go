@@ -0,0 +1,239 @@
+package game
+
+import (
+	"fmt"
+
+	"github.com/zond/diplicity/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	deletedUserName = "Deleted user"
+)
+
+var (
+	deleteUserDataFunc *DelayFunc
+)
+
+func init() {
+	deleteUserDataFunc = NewDelayFunc("game-deleteUserData", deleteUserData)
+}
+
+// anonymizeUserId replaces userId with anonId in the users of the result.
+func (g *GameResult) anonymizeUserId(userId, anonId string) {
+	replace := func(ids []string) {
+		for i := range ids {
+			if ids[i] == userId {
+				ids[i] = anonId
+			}
+		}
+	}
+	if g.SoloWinnerUser == userId {
+		g.SoloWinnerUser = anonId
+	}
+	replace(g.DIASUsers)
+	replace(g.NMRUsers)
+	replace(g.EliminatedUsers)
+	replace(g.AllUsers)
+	for i := range g.Scores {
+		if g.Scores[i].UserId == userId {
+			g.Scores[i].UserId = anonId
+		}
+	}
+}
+
+// removeUserFromGame anonymizes the member of userId in started games, along with the glickos and the result if there are any,
+// and removes it from games that haven't started.
+func removeUserFromGame(ctx context.Context, gameID *datastore.Key, userId, anonId string) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		game := &Game{}
+		if err := datastore.Get(ctx, gameID, game); err != nil {
+			return err
+		}
+		game.ID = gameID
+		member, isMember := game.GetMember(userId)
+		if !isMember {
+			return nil
+		}
+		if !game.Started {
+			newMembers := []Member{}
+			for _, oldMember := range game.Members {
+				if oldMember.User.Id != userId {
+					newMembers = append(newMembers, oldMember)
+				}
+			}
+			if len(newMembers) == 0 {
+				return datastore.Delete(ctx, gameID)
+			}
+			if err := recordGameEvent(ctx, game, &GameEvent{
+				GameID: gameID,
+				Type:   MemberLeftEvent,
+				UserId: userId,
+			}); err != nil {
+				return err
+			}
+			game.Members = newMembers
+			return game.Save(ctx)
+		}
+		member.User = auth.User{
+			Id:   anonId,
+			Name: deletedUserName,
+		}
+		member.GameAlias = ""
+		// Glickos are named after their users, so they are moved to the anonymous user to keep the ratings of the game intact.
+		glickos := []Glicko{}
+		glickoIDs, err := datastore.NewQuery(glickoKind).Ancestor(gameID).Filter("UserId=", userId).GetAll(ctx, &glickos)
+		if err != nil {
+			return err
+		}
+		newGlickoIDs := make([]*datastore.Key, len(glickos))
+		for i := range glickos {
+			glickos[i].UserId = anonId
+			if newGlickoIDs[i], err = glickos[i].ID(ctx); err != nil {
+				return err
+			}
+		}
+		if len(glickos) > 0 {
+			if err := datastore.DeleteMulti(ctx, glickoIDs); err != nil {
+				return err
+			}
+			if _, err := datastore.PutMulti(ctx, newGlickoIDs, glickos); err != nil {
+				return err
+			}
+		}
+		if game.Finished {
+			gameResult := &GameResult{}
+			gameResultID := GameResultID(ctx, gameID)
+			if err := datastore.Get(ctx, gameResultID, gameResult); err == nil {
+				gameResult.anonymizeUserId(userId, anonId)
+				if _, err := datastore.Put(ctx, gameResultID, gameResult); err != nil {
+					return err
+				}
+			} else if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+		return game.Save(ctx)
+	}, &datastore.TransactionOptions{XG: false})
+}
+
+// deleteUserData removes the user from all games, anonymizes what has to remain for the games to make sense,
+// and deletes everything else stored about the user.
+func deleteUserData(ctx context.Context, userId string) error {
+	log.Infof(ctx, "deleteUserData(..., %q)", userId)
+
+	anonId, err := auth.AnonymousUserId(ctx, userId)
+	if err != nil {
+		log.Errorf(ctx, "Unable to create anonymous id for %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+
+	gameIDs, err := datastore.NewQuery(gameKind).Filter("Members.User.Id=", userId).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load games of %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+	for _, gameID := range gameIDs {
+		if err := removeUserFromGame(ctx, gameID, userId, anonId); err != nil {
+			log.Errorf(ctx, "Unable to remove %q from %v: %v; hope datastore gets fixed", userId, gameID, err)
+			return err
+		}
+	}
+
+	flagged := FlaggedMessagess{}
+	flaggedIDs, err := datastore.NewQuery(flaggedMessagesKind).Filter("Messages.AuthorId=", userId).GetAll(ctx, &flagged)
+	if err != nil {
+		log.Errorf(ctx, "Unable to load messages by %q flagged by others: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+	for i := range flagged {
+		for j := range flagged[i].Messages {
+			if flagged[i].Messages[j].AuthorId == userId {
+				flagged[i].Messages[j].AuthorId = anonId
+			}
+		}
+	}
+	for len(flaggedIDs) > 0 {
+		batch := len(flaggedIDs)
+		if batch > maxPutMulti {
+			batch = maxPutMulti
+		}
+		if _, err := datastore.PutMulti(ctx, flaggedIDs[:batch], flagged[:batch]); err != nil {
+			log.Errorf(ctx, "Unable to anonymize messages by %q flagged by others: %v; hope datastore gets fixed", userId, err)
+			return err
+		}
+		flaggedIDs, flagged = flaggedIDs[batch:], flagged[batch:]
+	}
+
+	ids := []*datastore.Key{UserStatsID(ctx, userId)}
+	for _, kind := range []string{banKind, flaggedMessagesKind, pendingNotificationKind} {
+		filter := "UserId="
+		if kind == banKind {
+			filter = "UserIds="
+		}
+		kindIDs, err := datastore.NewQuery(kind).Filter(filter, userId).KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			log.Errorf(ctx, "Unable to load %v of %q: %v; hope datastore gets fixed", kind, userId, err)
+			return err
+		}
+		ids = append(ids, kindIDs...)
+	}
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > maxPutMulti {
+			batch = batch[:maxPutMulti]
+		}
+		if err := datastore.DeleteMulti(ctx, batch); err != nil {
+			log.Errorf(ctx, "Unable to delete data of %q: %v; hope datastore gets fixed", userId, err)
+			return err
+		}
+		ids = ids[len(batch):]
+	}
+
+	if err := auth.DeletePersonalData(ctx, userId); err != nil {
+		log.Errorf(ctx, "Unable to delete personal data of %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+
+	log.Infof(ctx, "deleteUserData(..., %q) *** SUCCESS ***", userId)
+
+	return nil
+}
+
+// deleteUser disables the user, which revokes all sessions, and deletes the user in the background.
+// Users can't be deleted while playing, since the other members of their games depend on them.
+func deleteUser(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only delete yourself", 403}
+	}
+
+	playing, err := datastore.NewQuery(gameKind).Filter("Members.User.Id=", user.Id).Filter("Started=", true).Filter("Finished=", false).Count(ctx)
+	if err != nil {
+		return err
+	}
+	if playing > 0 {
+		return HTTPErr{fmt.Sprintf("can't delete users playing games, wait until your %d started games have finished", playing), 412}
+	}
+
+	if err := auth.DisableUser(ctx, &auth.DisabledUser{
+		UserId:     user.Id,
+		Reason:     "deleted",
+		DisabledBy: user.Id,
+	}); err != nil {
+		return err
+	}
+
+	return deleteUserDataFunc.EnqueueIn(ctx, 0, user.Id)
+}
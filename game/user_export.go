@@ -0,0 +1,393 @@
+package game
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	userExportKind      = "UserExport"
+	userExportChunkKind = "UserExportChunk"
+
+	// Archives are stored in chunks, since entities can't be larger than a megabyte.
+	userExportChunkSize = 1 << 19
+)
+
+var (
+	UserExportResource *Resource
+	exportUserDataFunc *DelayFunc
+)
+
+func init() {
+	exportUserDataFunc = NewDelayFunc("game-exportUserData", exportUserData)
+	UserExportResource = &Resource{
+		Load:       auth.Scoped(auth.ManageConfigScope, loadUserExport),
+		Create:     auth.Scoped(auth.ManageConfigScope, createUserExport),
+		CreatePath: "/User/{user_id}/Export",
+		FullPath:   "/User/{user_id}/Export/{export_id}",
+		Listers: []Lister{
+			{
+				Path:    "/User/{user_id}/Exports",
+				Route:   ListUserExportsRoute,
+				Handler: auth.ScopedHandler(auth.ManageConfigScope, listUserExports),
+			},
+		},
+	}
+}
+
+// UserExport is an archive of everything stored about a user, built in the background.
+type UserExport struct {
+	ID         *datastore.Key `datastore:"-"`
+	UserId     string
+	Finished   bool
+	Size       int
+	NChunks    int
+	CreatedAt  time.Time
+	FinishedAt time.Time
+}
+
+// UserExportChunk is a part of the archive of a user export, with the ordinal of the part as ID.
+type UserExportChunk struct {
+	Data []byte `datastore:",noindex"`
+}
+
+func UserExportID(ctx context.Context, userId string, exportId int64) *datastore.Key {
+	return datastore.NewKey(ctx, userExportKind, "", exportId, auth.UserID(ctx, userId))
+}
+
+func (u *UserExport) Item(r Request) *Item {
+	exportId := fmt.Sprint(u.ID.IntID())
+	exportItem := NewItem(u).SetName("user-export").
+		AddLink(r.NewLink(UserExportResource.Link("self", Load, []string{"user_id", u.UserId, "export_id", exportId})))
+	if u.Finished {
+		exportItem.AddLink(r.NewLink(Link{
+			Rel:         "download",
+			Route:       DownloadUserExportRoute,
+			RouteParams: []string{"user_id", u.UserId, "export_id", exportId},
+		}))
+	}
+	return exportItem
+}
+
+type UserExports []UserExport
+
+func (u UserExports) Item(r Request, userId string) *Item {
+	exportItems := make(List, len(u))
+	for i := range u {
+		exportItems[i] = u[i].Item(r)
+	}
+	return NewItem(exportItems).SetName("user-exports").AddLink(r.NewLink(Link{
+		Rel:         "self",
+		Route:       ListUserExportsRoute,
+		RouteParams: []string{"user_id", userId},
+	})).AddLink(r.NewLink(UserExportResource.Link("create", Create, []string{"user_id", userId}))).SetDesc([][]string{
+		[]string{
+			"Personal data exports",
+			"An export is a zip archive of everything diplicity stores about you: your account, configuration, game memberships, the press you sent, your bans, your flagged messages, your ratings and your stats.",
+			"Exports are built in the background. When an export is finished, it gets a 'download' link.",
+		},
+	})
+}
+
+// MembershipRecord is a game membership of the exporting user.
+type MembershipRecord struct {
+	GameID   string
+	Desc     string
+	Variant  string
+	Started  bool
+	Finished bool
+	Member   Member
+}
+
+// BanRecord is the side of a ban of the exporting user.
+// The other user of the ban is left out, since its details are someone else's personal data.
+type BanRecord struct {
+	User auth.User
+	// Signed is whether the exporting user signed the ban, and SignedByOther whether the other user did.
+	Signed        bool
+	SignedByOther bool
+}
+
+// buildUserArchive returns a zip archive with everything stored about the user.
+func buildUserArchive(ctx context.Context, userId string) ([]byte, error) {
+	files := map[string]interface{}{}
+
+	personalData, err := auth.LoadPersonalData(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	files["account.json"] = personalData
+
+	games := Games{}
+	gameIDs, err := datastore.NewQuery(gameKind).Filter("Members.User.Id=", userId).GetAll(ctx, &games)
+	if err != nil {
+		return nil, err
+	}
+	memberships := []MembershipRecord{}
+	messages := Messages{}
+	for i := range games {
+		member, found := games[i].GetMember(userId)
+		if !found {
+			continue
+		}
+		memberships = append(memberships, MembershipRecord{
+			GameID:   gameIDs[i].Encode(),
+			Desc:     games[i].Desc,
+			Variant:  games[i].Variant,
+			Started:  games[i].Started,
+			Finished: games[i].Finished,
+			Member:   *member,
+		})
+		if member.Nation == "" {
+			continue
+		}
+		sent := Messages{}
+		if _, err := datastore.NewQuery(messageKind).Filter("GameID=", gameIDs[i]).Filter("Sender=", member.Nation).GetAll(ctx, &sent); err != nil {
+			return nil, err
+		}
+		messages = append(messages, sent...)
+	}
+	files["memberships.json"] = memberships
+	files["messages.json"] = messages
+
+	bans := Bans{}
+	if _, err := datastore.NewQuery(banKind).Filter("UserIds=", userId).GetAll(ctx, &bans); err != nil {
+		return nil, err
+	}
+	banRecords := []BanRecord{}
+	for _, ban := range bans {
+		record := BanRecord{}
+		for _, user := range ban.Users {
+			if user.Id == userId {
+				record.User = user
+			}
+		}
+		for _, ownerId := range ban.OwnerIds {
+			if ownerId == userId {
+				record.Signed = true
+			} else {
+				record.SignedByOther = true
+			}
+		}
+		banRecords = append(banRecords, record)
+	}
+	files["bans.json"] = banRecords
+
+	flags := FlaggedMessagess{}
+	if _, err := datastore.NewQuery(flaggedMessagesKind).Filter("UserId=", userId).GetAll(ctx, &flags); err != nil {
+		return nil, err
+	}
+	files["flagged_messages.json"] = flags
+
+	glickos := []Glicko{}
+	if _, err := datastore.NewQuery(glickoKind).Filter("UserId=", userId).GetAll(ctx, &glickos); err != nil {
+		return nil, err
+	}
+	files["glickos.json"] = glickos
+
+	userStats := &UserStats{}
+	if err := datastore.Get(ctx, UserStatsID(ctx, userId), userStats); err == datastore.ErrNoSuchEntity {
+		userStats = nil
+	} else if err != nil {
+		return nil, err
+	}
+	files["user_stats.json"] = userStats
+
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+	for name, content := range files {
+		b, err := json.MarshalIndent(content, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		f, err := archive.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(b); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func exportUserData(ctx context.Context, exportID *datastore.Key) error {
+	log.Infof(ctx, "exportUserData(..., %v)", exportID)
+
+	userExport := &UserExport{}
+	if err := datastore.Get(ctx, exportID, userExport); err == datastore.ErrNoSuchEntity {
+		log.Infof(ctx, "%v doesn't exist anymore; skipping", exportID)
+		return nil
+	} else if err != nil {
+		log.Errorf(ctx, "Unable to load %v: %v; hope datastore gets fixed", exportID, err)
+		return err
+	}
+	if userExport.Finished {
+		log.Infof(ctx, "%v already finished; skipping", exportID)
+		return nil
+	}
+
+	archive, err := buildUserArchive(ctx, userExport.UserId)
+	if err != nil {
+		log.Errorf(ctx, "Unable to build archive for %q: %v; hope datastore gets fixed", userExport.UserId, err)
+		return err
+	}
+
+	nChunks := 0
+	for len(archive) > 0 {
+		chunk := &UserExportChunk{Data: archive}
+		if len(chunk.Data) > userExportChunkSize {
+			chunk.Data = chunk.Data[:userExportChunkSize]
+		}
+		nChunks++
+		if _, err := datastore.Put(ctx, datastore.NewKey(ctx, userExportChunkKind, "", int64(nChunks), exportID), chunk); err != nil {
+			log.Errorf(ctx, "Unable to store chunk %v of %v: %v; hope datastore gets fixed", nChunks, exportID, err)
+			return err
+		}
+		userExport.Size += len(chunk.Data)
+		archive = archive[len(chunk.Data):]
+	}
+
+	userExport.NChunks = nChunks
+	userExport.Finished = true
+	userExport.FinishedAt = time.Now()
+	if _, err := datastore.Put(ctx, exportID, userExport); err != nil {
+		log.Errorf(ctx, "Unable to save %v: %v; hope datastore gets fixed", exportID, err)
+		return err
+	}
+
+	log.Infof(ctx, "exportUserData(..., %v) *** SUCCESS ***", exportID)
+
+	return nil
+}
+
+func createUserExport(w ResponseWriter, r Request) (*UserExport, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthorized", 401}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return nil, HTTPErr{"can only export your own data", 403}
+	}
+
+	userExport := &UserExport{
+		UserId:    user.Id,
+		CreatedAt: time.Now(),
+	}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		if userExport.ID, err = datastore.Put(ctx, datastore.NewIncompleteKey(ctx, userExportKind, auth.UserID(ctx, user.Id)), userExport); err != nil {
+			return err
+		}
+		return exportUserDataFunc.EnqueueIn(ctx, 0, userExport.ID)
+	}, &datastore.TransactionOptions{XG: false}); err != nil {
+		return nil, err
+	}
+
+	return userExport, nil
+}
+
+func loadUserExportRequest(r Request) (*UserExport, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthorized", 401}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return nil, HTTPErr{"can only load your own exports", 403}
+	}
+
+	exportId, err := strconv.ParseInt(r.Vars()["export_id"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	userExport := &UserExport{}
+	userExport.ID = UserExportID(ctx, user.Id, exportId)
+	if err := datastore.Get(ctx, userExport.ID, userExport); err == datastore.ErrNoSuchEntity {
+		return nil, HTTPErr{"non existing export", 404}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return userExport, nil
+}
+
+func loadUserExport(w ResponseWriter, r Request) (*UserExport, error) {
+	return loadUserExportRequest(r)
+}
+
+func listUserExports(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only list your own exports", 403}
+	}
+
+	userExports := UserExports{}
+	ids, err := datastore.NewQuery(userExportKind).Ancestor(auth.UserID(ctx, user.Id)).GetAll(ctx, &userExports)
+	if err != nil {
+		return err
+	}
+	for i := range userExports {
+		userExports[i].ID = ids[i]
+	}
+
+	w.SetContent(userExports.Item(r, user.Id))
+	return nil
+}
+
+func downloadUserExport(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	userExport, err := loadUserExportRequest(r)
+	if err != nil {
+		return err
+	}
+	if !userExport.Finished {
+		return HTTPErr{"export not finished yet", 412}
+	}
+
+	chunkIDs := make([]*datastore.Key, userExport.NChunks)
+	for i := range chunkIDs {
+		chunkIDs[i] = datastore.NewKey(ctx, userExportChunkKind, "", int64(i+1), userExport.ID)
+	}
+	chunks := make([]UserExportChunk, len(chunkIDs))
+	if err := datastore.GetMulti(ctx, chunkIDs, chunks); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"diplicity-%s-%d.zip\"", userExport.UserId, userExport.ID.IntID()))
+	for _, chunk := range chunks {
+		if _, err := w.Write(chunk.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
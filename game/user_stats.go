@@ -33,37 +33,37 @@ func init() {
 
 	userStatsListerParams := []string{"limit", "cursor"}
 	UserStatsResource = &Resource{
-		Load:     loadUserStats,
+		Load:     auth.Scoped(auth.ReadGamesScope, loadUserStats),
 		FullPath: "/User/{user_id}/Stats",
 		Listers: []Lister{
 			{
 				Path:        "/Users/TopRated",
 				Route:       ListTopRatedPlayersRoute,
-				Handler:     topRatedPlayersHandler.handle,
+				Handler:     auth.ScopedHandler(auth.ReadGamesScope, topRatedPlayersHandler.handle),
 				QueryParams: userStatsListerParams,
 			},
 			{
 				Path:        "/Users/TopReliable",
 				Route:       ListTopReliablePlayersRoute,
-				Handler:     topReliablePlayersHandler.handle,
+				Handler:     auth.ScopedHandler(auth.ReadGamesScope, topReliablePlayersHandler.handle),
 				QueryParams: userStatsListerParams,
 			},
 			{
 				Path:        "/Users/TopHated",
 				Route:       ListTopHatedPlayersRoute,
-				Handler:     topHatedPlayersHandler.handle,
+				Handler:     auth.ScopedHandler(auth.ReadGamesScope, topHatedPlayersHandler.handle),
 				QueryParams: userStatsListerParams,
 			},
 			{
 				Path:        "/Users/TopHater",
 				Route:       ListTopHaterPlayersRoute,
-				Handler:     topHaterPlayersHandler.handle,
+				Handler:     auth.ScopedHandler(auth.ReadGamesScope, topHaterPlayersHandler.handle),
 				QueryParams: userStatsListerParams,
 			},
 			{
 				Path:        "/Users/TopQuick",
 				Route:       ListTopQuickPlayersRoute,
-				Handler:     topQuickPlayersHandler.handle,
+				Handler:     auth.ScopedHandler(auth.ReadGamesScope, topQuickPlayersHandler.handle),
 				QueryParams: userStatsListerParams,
 			},
 		},
@@ -199,6 +199,10 @@ func devUserStatsUpdate(w ResponseWriter, r Request) error {
 		return err
 	}
 
+	if err := auth.Audit(ctx, r, "dev-user-stats-update", userStats, UserStatsID(ctx, r.Vars()["user_id"])); err != nil {
+		return err
+	}
+
 	if _, err := datastore.Put(ctx, UserStatsID(ctx, r.Vars()["user_id"]), userStats); err != nil {
 		return err
 	}
@@ -221,14 +225,21 @@ func loadUserStats(w ResponseWriter, r Request) (*UserStats, error) {
 		return nil, err
 	}
 
+	if userStats.User.Id != "" {
+		if err := auth.ApplyProfiles(ctx, []*auth.User{&userStats.User}); err != nil {
+			return nil, err
+		}
+	}
+
 	return userStats, nil
 }
 
 func (u *UserStats) Item(r Request) *Item {
 	u.User.Email = ""
 	log.Infof(appengine.NewContext(r.Req()), "*** %v", spew.Sdump(u))
-	return NewItem(u).SetName("user-stats").
+	statsItem := NewItem(u).SetName("user-stats").
 		AddLink(r.NewLink(UserStatsResource.Link("self", Load, []string{"user_id", u.UserId}))).
+		AddLink(r.NewLink(auth.ProfileResource.Link("profile", Load, []string{"user_id", u.UserId}))).
 		AddLink(r.NewLink(Link{
 			Rel:         "finished-games",
 			Route:       ListOtherFinishedGamesRoute,
@@ -244,6 +255,10 @@ func (u *UserStats) Item(r Request) *Item {
 			Route:       ListOtherStartedGamesRoute,
 			RouteParams: []string{"user_id", u.UserId},
 		}))
+	if user, ok := r.Values()["user"].(*auth.User); ok && user.Id != u.UserId {
+		statsItem.AddLink(r.NewLink(VersusResource.Link("versus", Load, []string{"user_id", user.Id, "other_id", u.UserId})))
+	}
+	return statsItem
 }
 
 func (u *UserStats) Recalculate(ctx context.Context) error {
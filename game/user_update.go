@@ -0,0 +1,241 @@
+package game
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+
+	. "github.com/zond/goaeoas"
+	dip "github.com/zond/godip/common"
+)
+
+const (
+	userUpdateKind        = "UserUpdate"
+	userUpdateCounterKind = "UserUpdateCounter"
+
+	// Updates older than this are deleted when new updates are recorded.
+	userUpdateTTL = 24 * time.Hour
+
+	defaultUserUpdateTimeout = 30 * time.Second
+	// App Engine gives requests a minute, so leave some slack.
+	maxUserUpdateTimeout = 50 * time.Second
+	// How often the memcache signal is checked while waiting.
+	userUpdatePollInterval = time.Second
+	// How often the datastore is checked while waiting, in case memcache lost the signal.
+	userUpdateFallbackInterval = 10 * time.Second
+)
+
+// Types of user updates.
+const (
+	MessageUserUpdate = "message"
+	PhaseUserUpdate   = "phase"
+)
+
+// UserUpdate is something live clients of a user should know about: a message posted to the user or a new phase in one of the games of the user.
+// The ID is its sequence number among the updates of the user, and doubles as cursor.
+type UserUpdate struct {
+	ID             string `datastore:"-"`
+	Type           string
+	GameID         *datastore.Key
+	CreatedAt      time.Time
+	PhaseOrdinal   int64
+	DeadlineAt     time.Time
+	NextDeadlineIn time.Duration `datastore:"-" ticker:"true"`
+	MessageID      *datastore.Key
+	ChannelMembers Nations
+	Sender         dip.Nation
+	Body           string `datastore:",noindex"`
+}
+
+// UserUpdateCounter numbers the updates of a user. It lives in the entity group of the user, so that it is incremented in the transaction recording each update.
+type UserUpdateCounter struct {
+	NUpdates int64
+}
+
+func UserUpdateCounterID(ctx context.Context, userId string) *datastore.Key {
+	return datastore.NewKey(ctx, userUpdateCounterKind, userId, 0, auth.UserID(ctx, userId))
+}
+
+func getUserUpdateCounter(ctx context.Context, userId string) (*UserUpdateCounter, error) {
+	counter := &UserUpdateCounter{}
+	if err := datastore.Get(ctx, UserUpdateCounterID(ctx, userId), counter); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	return counter, nil
+}
+
+func UserUpdateID(ctx context.Context, userId string, id int64) *datastore.Key {
+	return datastore.NewKey(ctx, userUpdateKind, "", id, auth.UserID(ctx, userId))
+}
+
+func (u *UserUpdate) Refresh() {
+	if !u.DeadlineAt.IsZero() {
+		u.NextDeadlineIn = u.DeadlineAt.Sub(time.Now())
+	}
+}
+
+func (u *UserUpdate) Item(r Request) *Item {
+	return NewItem(u).SetName(u.Type)
+}
+
+type UserUpdates []UserUpdate
+
+func (u UserUpdates) Item(r Request, userId, after string) *Item {
+	updateItems := make(List, len(u))
+	for i := range u {
+		updateItems[i] = u[i].Item(r)
+	}
+	if len(u) > 0 {
+		after = u[len(u)-1].ID
+	}
+	return NewItem(updateItems).SetName("user-updates").AddLink(r.NewLink(Link{
+		Rel:         "next",
+		Route:       ListUserUpdatesRoute,
+		RouteParams: []string{"user_id", userId},
+		QueryParams: url.Values{"after": []string{after}},
+	})).SetDesc([][]string{
+		[]string{
+			"Live updates",
+			"Updates are the messages posted to you and the new phases of your games, for clients that want to show them as they happen.",
+			"Message updates contain the game, channel, sender and body of the message. Phase updates contain the game, phase ordinal and deadline of the new phase.",
+		},
+		[]string{
+			"Long polling",
+			"Without an 'after' query parameter, no updates are listed, but the 'next' link will point to updates after now.",
+			"With an 'after' query parameter, the request waits until there are updates newer than 'after', or until the timeout passes.",
+			fmt.Sprintf("The timeout is %v by default, and can be set in seconds with a 'timeout' query parameter up to %v.", defaultUserUpdateTimeout, maxUserUpdateTimeout),
+			"Follow the 'next' link to wait for the updates after the listed ones.",
+			fmt.Sprintf("Updates are kept for %v.", userUpdateTTL),
+		},
+	})
+}
+
+func userUpdateSignalKey(userId string) string {
+	return fmt.Sprintf("user-updates/%s", userId)
+}
+
+// recordUserUpdate stores the update for the user, numbered by the update counter of the user, and deletes updates that are too old.
+// Call it in a transaction, at most once per user, and call signalUserUpdate when the update is committed, to wake up waiting clients.
+func recordUserUpdate(ctx context.Context, userId string, update *UserUpdate) error {
+	counter, err := getUserUpdateCounter(ctx, userId)
+	if err != nil {
+		return err
+	}
+	counter.NUpdates++
+	update.ID = fmt.Sprint(counter.NUpdates)
+	update.CreatedAt = time.Now()
+	if _, err := datastore.PutMulti(ctx, []*datastore.Key{
+		UserUpdateCounterID(ctx, userId),
+		UserUpdateID(ctx, userId, counter.NUpdates),
+	}, []interface{}{
+		counter,
+		update,
+	}); err != nil {
+		return err
+	}
+	oldIDs, err := datastore.NewQuery(userUpdateKind).Ancestor(auth.UserID(ctx, userId)).Filter("CreatedAt <", time.Now().Add(-userUpdateTTL)).KeysOnly().Limit(maxPutMulti).GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	return datastore.DeleteMulti(ctx, oldIDs)
+}
+
+func signalUserUpdate(ctx context.Context, userId string) {
+	if _, err := memcache.Increment(ctx, userUpdateSignalKey(userId), 1, 0); err != nil {
+		log.Warningf(ctx, "Unable to signal update to %q: %v; clients will find it without signal", userId, err)
+	}
+}
+
+func userUpdateSignal(ctx context.Context, userId string) string {
+	if item, err := memcache.Get(ctx, userUpdateSignalKey(userId)); err == nil {
+		return string(item.Value)
+	}
+	return ""
+}
+
+func loadUserUpdates(ctx context.Context, userId string, after int64) (UserUpdates, error) {
+	updates := UserUpdates{}
+	q := datastore.NewQuery(userUpdateKind).Ancestor(auth.UserID(ctx, userId))
+	if after > 0 {
+		q = q.Filter("__key__ >", UserUpdateID(ctx, userId, after))
+	}
+	ids, err := q.Order("__key__").GetAll(ctx, &updates)
+	if err != nil {
+		return nil, err
+	}
+	for i := range updates {
+		updates[i].ID = fmt.Sprint(ids[i].IntID())
+		updates[i].Refresh()
+	}
+	return updates, nil
+}
+
+func listUserUpdates(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	user, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return HTTPErr{"unauthorized", 401}
+	}
+
+	if r.Vars()["user_id"] != user.Id {
+		return HTTPErr{"can only list your own updates", 403}
+	}
+
+	afterParam := r.Req().URL.Query().Get("after")
+	if afterParam == "" {
+		counter, err := getUserUpdateCounter(ctx, user.Id)
+		if err != nil {
+			return err
+		}
+		w.SetContent(UserUpdates{}.Item(r, user.Id, fmt.Sprint(counter.NUpdates)))
+		return nil
+	}
+	after, err := strconv.ParseInt(afterParam, 10, 64)
+	if err != nil || after < 0 {
+		return HTTPErr{fmt.Sprintf("unparseable cursor %q", afterParam), 400}
+	}
+
+	timeout := defaultUserUpdateTimeout
+	if timeoutParam := r.Req().URL.Query().Get("timeout"); timeoutParam != "" {
+		seconds, err := strconv.Atoi(timeoutParam)
+		if err != nil || seconds < 0 {
+			return HTTPErr{fmt.Sprintf("timeout must be a non negative number of seconds, not %q", timeoutParam), 400}
+		}
+		timeout = time.Duration(seconds) * time.Second
+		if timeout > maxUserUpdateTimeout {
+			timeout = maxUserUpdateTimeout
+		}
+	}
+	deadline := time.Now().Add(timeout)
+
+	var updates UserUpdates
+	lastSignal := ""
+	var lastLoad time.Time
+	for {
+		// Read the signal before loading, so that updates recorded while loading change the signal.
+		signal := userUpdateSignal(ctx, user.Id)
+		if lastLoad.IsZero() || signal != lastSignal || time.Now().Sub(lastLoad) > userUpdateFallbackInterval {
+			if updates, err = loadUserUpdates(ctx, user.Id, after); err != nil {
+				return err
+			}
+			lastSignal = signal
+			lastLoad = time.Now()
+		}
+		if len(updates) > 0 || !time.Now().Add(userUpdatePollInterval).Before(deadline) {
+			break
+		}
+		time.Sleep(userUpdatePollInterval)
+	}
+
+	w.SetContent(updates.Item(r, user.Id, afterParam))
+	return nil
+}
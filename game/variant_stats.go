@@ -0,0 +1,259 @@
+package game
+
+import (
+	"fmt"
+
+	"github.com/zond/diplicity/auth"
+	"github.com/zond/godip/variants"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	. "github.com/zond/goaeoas"
+	dip "github.com/zond/godip/common"
+)
+
+const (
+	variantStatsKind = "VariantStats"
+)
+
+var (
+	aggregateVariantStatsFunc *DelayFunc
+)
+
+func init() {
+	aggregateVariantStatsFunc = NewDelayFunc("game-aggregateVariantStats", aggregateVariantStats)
+}
+
+var VariantStatsResource = &Resource{
+	Load:     auth.Scoped(auth.ReadGamesScope, loadVariantStats),
+	FullPath: "/Variant/{name}/Stats",
+}
+
+// NationStats counts how games ended for one nation of a variant.
+// Each game counts as exactly one of solo, draw, survival or elimination.
+type NationStats struct {
+	Nation       dip.Nation
+	Games        int
+	Solos        int
+	Draws        int
+	Survivals    int
+	Eliminations int
+	SCSum        int
+
+	SoloPercentage        float64 `datastore:"-"`
+	DrawPercentage        float64 `datastore:"-"`
+	SurvivalPercentage    float64 `datastore:"-"`
+	EliminationPercentage float64 `datastore:"-"`
+	AverageSCs            float64 `datastore:"-"`
+}
+
+func percentage(part, whole int) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(whole)
+}
+
+func average(sum, count int) float64 {
+	if count == 0 {
+		return 0
+	}
+	return float64(sum) / float64(count)
+}
+
+func (n *NationStats) Refresh() {
+	n.SoloPercentage = percentage(n.Solos, n.Games)
+	n.DrawPercentage = percentage(n.Draws, n.Games)
+	n.SurvivalPercentage = percentage(n.Survivals, n.Games)
+	n.EliminationPercentage = percentage(n.Eliminations, n.Games)
+	n.AverageSCs = average(n.SCSum, n.Games)
+}
+
+// VariantStats aggregates the results of all finished games of a variant.
+// It is updated once per game result, by a task enqueued when the result gets rated.
+// The task runs outside the rating transaction, so that contention on the single entity per variant
+// only retries the task instead of the rating.
+type VariantStats struct {
+	Variant   string
+	Games     int
+	SoloGames int
+	DrawGames int
+	PhaseSum  int
+	YearSum   int
+	Nations   []NationStats
+
+	SoloPercentage float64 `datastore:"-"`
+	DrawPercentage float64 `datastore:"-"`
+	AveragePhases  float64 `datastore:"-"`
+	AverageYears   float64 `datastore:"-"`
+}
+
+func VariantStatsID(ctx context.Context, variant string) *datastore.Key {
+	return datastore.NewKey(ctx, variantStatsKind, variant, 0, nil)
+}
+
+func (v *VariantStats) ID(ctx context.Context) *datastore.Key {
+	return VariantStatsID(ctx, v.Variant)
+}
+
+func (v *VariantStats) Refresh() {
+	v.SoloPercentage = percentage(v.SoloGames, v.Games)
+	v.DrawPercentage = percentage(v.DrawGames, v.Games)
+	v.AveragePhases = average(v.PhaseSum, v.Games)
+	v.AverageYears = average(v.YearSum, v.Games)
+	for i := range v.Nations {
+		v.Nations[i].Refresh()
+	}
+}
+
+func (v *VariantStats) nation(nat dip.Nation) *NationStats {
+	for i := range v.Nations {
+		if v.Nations[i].Nation == nat {
+			return &v.Nations[i]
+		}
+	}
+	v.Nations = append(v.Nations, NationStats{
+		Nation: nat,
+	})
+	return &v.Nations[len(v.Nations)-1]
+}
+
+// Add counts the result of game into the stats.
+func (v *VariantStats) Add(game *Game, gameResult *GameResult) error {
+	variant, found := variants.Variants[game.Variant]
+	if !found {
+		return fmt.Errorf("unknown variant %q", game.Variant)
+	}
+	s, err := variant.Start()
+	if err != nil {
+		return err
+	}
+
+	v.Games++
+	if gameResult.SoloWinnerMember != "" {
+		v.SoloGames++
+	} else if len(gameResult.DIASMembers) > 0 {
+		v.DrawGames++
+	}
+	if len(game.NewestPhaseMeta) > 0 {
+		v.PhaseSum += int(game.NewestPhaseMeta[0].PhaseOrdinal)
+		v.YearSum += game.NewestPhaseMeta[0].Year - s.Phase().Year() + 1
+	}
+
+	draws := Nations(gameResult.DIASMembers)
+	eliminations := Nations(gameResult.EliminatedMembers)
+	for _, score := range gameResult.Scores {
+		nationStats := v.nation(score.Member)
+		nationStats.Games++
+		nationStats.SCSum += score.SCs
+		switch {
+		case score.Member == gameResult.SoloWinnerMember:
+			nationStats.Solos++
+		case draws.Includes(score.Member):
+			nationStats.Draws++
+		case eliminations.Includes(score.Member):
+			nationStats.Eliminations++
+		default:
+			nationStats.Survivals++
+		}
+	}
+
+	return nil
+}
+
+// aggregateVariantStats adds the result of the game to the stats of its variant, unless that is already done.
+func aggregateVariantStats(ctx context.Context, gameID *datastore.Key) error {
+	log.Infof(ctx, "aggregateVariantStats(..., %v)", gameID)
+
+	game := &Game{}
+	if err := datastore.Get(ctx, gameID, game); err == datastore.ErrNoSuchEntity {
+		log.Infof(ctx, "%v doesn't exist anymore, exiting", gameID)
+		return nil
+	} else if err != nil {
+		log.Errorf(ctx, "Unable to load game %v: %v; hope datastore gets fixed", gameID, err)
+		return err
+	}
+	game.ID = gameID
+
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		gameResultID := GameResultID(ctx, gameID)
+		variantStatsID := VariantStatsID(ctx, game.Variant)
+
+		gameResult := &GameResult{}
+		variantStats := &VariantStats{}
+		err := datastore.GetMulti(ctx, []*datastore.Key{gameResultID, variantStatsID}, []interface{}{gameResult, variantStats})
+		if merr, ok := err.(appengine.MultiError); ok {
+			if merr[0] != nil {
+				log.Errorf(ctx, "Unable to load game result %v: %v; hope datastore gets fixed", gameResultID, merr[0])
+				return merr[0]
+			}
+			if merr[1] == datastore.ErrNoSuchEntity {
+				variantStats.Variant = game.Variant
+			} else if merr[1] != nil {
+				log.Errorf(ctx, "Unable to load variant stats %v: %v; hope datastore gets fixed", variantStatsID, merr[1])
+				return merr[1]
+			}
+		} else if err != nil {
+			log.Errorf(ctx, "Unable to load game result %v and variant stats %v: %v; hope datastore gets fixed", gameResultID, variantStatsID, err)
+			return err
+		}
+		if gameResult.StatsAggregated {
+			log.Infof(ctx, "%v is already aggregated, exiting", PP(gameResult))
+			return nil
+		}
+
+		if err := variantStats.Add(game, gameResult); err != nil {
+			log.Errorf(ctx, "Unable to add %v to %v: %v; fix VariantStats#Add", PP(gameResult), PP(variantStats), err)
+			return err
+		}
+		gameResult.StatsAggregated = true
+		if _, err := datastore.PutMulti(ctx, []*datastore.Key{gameResultID, variantStatsID}, []interface{}{gameResult, variantStats}); err != nil {
+			log.Errorf(ctx, "Unable to save %v and %v: %v; hope datastore gets fixed", PP(gameResult), PP(variantStats), err)
+			return err
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		log.Errorf(ctx, "Unable to commit variant stats tx: %v", err)
+		return err
+	}
+
+	log.Infof(ctx, "aggregateVariantStats(..., %v) *** SUCCESS ***", gameID)
+
+	return nil
+}
+
+func loadVariantStats(w ResponseWriter, r Request) (*VariantStats, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	_, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthorized", 401}
+	}
+
+	variantName := r.Vars()["name"]
+	variant, found := variants.Variants[variantName]
+	if !found {
+		return nil, HTTPErr{fmt.Sprintf("unknown variant %q", variantName), 404}
+	}
+
+	variantStats := &VariantStats{}
+	if err := datastore.Get(ctx, VariantStatsID(ctx, variantName), variantStats); err == datastore.ErrNoSuchEntity {
+		variantStats.Variant = variantName
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Present all nations, even the ones that haven't finished any games yet.
+	for _, nat := range variant.Nations {
+		variantStats.nation(nat)
+	}
+	variantStats.Refresh()
+
+	return variantStats, nil
+}
+
+func (v *VariantStats) Item(r Request) *Item {
+	return NewItem(v).SetName("variant-stats").AddLink(r.NewLink(VariantStatsResource.Link("self", Load, []string{"name", v.Variant})))
+}
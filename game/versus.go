@@ -0,0 +1,159 @@
+package game
+
+import (
+	"github.com/Kashomon/goglicko"
+	"github.com/zond/diplicity/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+var VersusResource = &Resource{
+	Load:     auth.Scoped(auth.ReadGamesScope, loadVersus),
+	FullPath: "/User/{user_id}/Versus/{other_id}",
+}
+
+// Versus summarizes the finished games two users played together, from the perspective of UserId.
+type Versus struct {
+	UserId  string
+	OtherId string
+
+	Games int
+
+	// Games where one of the users got a higher score than the other.
+	UserOutranked  int
+	OtherOutranked int
+	Ties           int
+
+	UserSolos         int
+	OtherSolos        int
+	SharedDraws       int
+	UserEliminations  int
+	OtherEliminations int
+
+	// The sum of the rating changes of the users in the shared games.
+	UserGlickoDelta  float64
+	OtherGlickoDelta float64
+}
+
+func (v *Versus) Item(r Request) *Item {
+	return NewItem(v).SetName("versus").
+		AddLink(r.NewLink(VersusResource.Link("self", Load, []string{"user_id", v.UserId, "other_id", v.OtherId}))).
+		AddLink(r.NewLink(UserStatsResource.Link("user-stats", Load, []string{"user_id", v.UserId}))).
+		AddLink(r.NewLink(UserStatsResource.Link("other-stats", Load, []string{"user_id", v.OtherId})))
+}
+
+// glickoDelta returns how much the rating of userId changed because of the game with gameID, or zero if the game isn't rated yet.
+func glickoDelta(ctx context.Context, userId string, gameID *datastore.Key) (float64, error) {
+	after := &Glicko{}
+	if err := datastore.Get(ctx, datastore.NewKey(ctx, glickoKind, userId, 0, gameID), after); err == datastore.ErrNoSuchEntity {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	befores := []Glicko{}
+	if _, err := datastore.NewQuery(glickoKind).Filter("UserId=", userId).Filter("CreatedAt<", after.CreatedAt).Order("-CreatedAt").Limit(1).GetAll(ctx, &befores); err != nil {
+		return 0, err
+	}
+	if len(befores) == 0 {
+		return after.Rating - goglicko.DefaultRat, nil
+	}
+	return after.Rating - befores[0].Rating, nil
+}
+
+// Add counts gameResult into the summary.
+func (v *Versus) Add(ctx context.Context, gameResult *GameResult) error {
+	var userScore, otherScore *GameScore
+	for i := range gameResult.Scores {
+		switch gameResult.Scores[i].UserId {
+		case v.UserId:
+			userScore = &gameResult.Scores[i]
+		case v.OtherId:
+			otherScore = &gameResult.Scores[i]
+		}
+	}
+	if userScore == nil || otherScore == nil {
+		return nil
+	}
+
+	v.Games++
+	switch {
+	case userScore.Score > otherScore.Score:
+		v.UserOutranked++
+	case userScore.Score < otherScore.Score:
+		v.OtherOutranked++
+	default:
+		v.Ties++
+	}
+
+	switch gameResult.SoloWinnerUser {
+	case v.UserId:
+		v.UserSolos++
+	case v.OtherId:
+		v.OtherSolos++
+	}
+
+	userDrew, otherDrew := false, false
+	for _, uid := range gameResult.DIASUsers {
+		userDrew = userDrew || uid == v.UserId
+		otherDrew = otherDrew || uid == v.OtherId
+	}
+	if userDrew && otherDrew {
+		v.SharedDraws++
+	}
+
+	for _, uid := range gameResult.EliminatedUsers {
+		switch uid {
+		case v.UserId:
+			v.UserEliminations++
+		case v.OtherId:
+			v.OtherEliminations++
+		}
+	}
+
+	userDelta, err := glickoDelta(ctx, v.UserId, gameResult.GameID)
+	if err != nil {
+		return err
+	}
+	v.UserGlickoDelta += userDelta
+	otherDelta, err := glickoDelta(ctx, v.OtherId, gameResult.GameID)
+	if err != nil {
+		return err
+	}
+	v.OtherGlickoDelta += otherDelta
+
+	return nil
+}
+
+func loadVersus(w ResponseWriter, r Request) (*Versus, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	_, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthorized", 401}
+	}
+
+	versus := &Versus{
+		UserId:  r.Vars()["user_id"],
+		OtherId: r.Vars()["other_id"],
+	}
+	if versus.UserId == versus.OtherId {
+		return nil, HTTPErr{"can't compare a user with itself", 400}
+	}
+
+	gameResults := GameResults{}
+	if _, err := datastore.NewQuery(gameResultKind).Filter("AllUsers=", versus.UserId).Filter("AllUsers=", versus.OtherId).GetAll(ctx, &gameResults); err != nil {
+		return nil, err
+	}
+
+	for i := range gameResults {
+		if err := versus.Add(ctx, &gameResults[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return versus, nil
+}
@@ -0,0 +1,305 @@
+package game
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	// A delivery is given up after this many attempts.
+	webhookMaxAttempts = 8
+	// A webhook is disabled after this many given up deliveries in a row.
+	webhookMaxFailures = 5
+	webhookMinDelay    = 10 * time.Second
+	// Retry-After headers asking for longer delays are capped to this.
+	webhookMaxDelay = time.Hour
+)
+
+var (
+	webhookSendFunc       *DelayFunc
+	sendPhaseWebhooksFunc *DelayFunc
+	sendMsgWebhooksFunc   *DelayFunc
+)
+
+func init() {
+	webhookSendFunc = NewDelayFunc("game-webhookSend", webhookSend)
+	sendPhaseWebhooksFunc = NewDelayFunc("game-sendPhaseWebhooks", sendPhaseWebhooks)
+	sendMsgWebhooksFunc = NewDelayFunc("game-sendMsgWebhooks", sendMsgWebhooks)
+}
+
+// WebhookPayload is the body posted to webhooks.
+type WebhookPayload struct {
+	Type      string
+	UserId    string
+	CreatedAt time.Time
+	Data      interface{}
+}
+
+// enqueueWebhooks enqueues delivery of the event to all enabled webhooks of the user that want it.
+func enqueueWebhooks(ctx context.Context, userConfig *auth.UserConfig, event string, data interface{}) error {
+	var payload []byte
+	for _, webhook := range userConfig.Webhooks {
+		if webhook.Disabled || !webhook.Wants(event) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(WebhookPayload{
+				Type:      event,
+				UserId:    userConfig.UserId,
+				CreatedAt: time.Now(),
+				Data:      data,
+			}); err != nil {
+				return err
+			}
+		}
+		if err := webhookSendFunc.EnqueueIn(ctx, 0, time.Duration(0), 1, userConfig.UserId, webhook.URL, event, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mutateWebhook applies the mutator to the webhook with the URL, if the user still has it.
+func mutateWebhook(ctx context.Context, userId, webhookURL string, mutator func(*auth.Webhook)) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		userConfig := &auth.UserConfig{}
+		userConfigID := auth.UserConfigID(ctx, auth.UserID(ctx, userId))
+		if err := datastore.Get(ctx, userConfigID, userConfig); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for i := range userConfig.Webhooks {
+			if userConfig.Webhooks[i].URL == webhookURL {
+				mutator(&userConfig.Webhooks[i])
+				_, err := datastore.Put(ctx, userConfigID, userConfig)
+				return err
+			}
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: false})
+}
+
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil)))
+}
+
+// webhookRetryDelay returns how long to wait before retrying a delivery that failed after waiting lastDelay,
+// honoring the Retry-After header of the response as long as it's between webhookMinDelay and webhookMaxDelay.
+func webhookRetryDelay(lastDelay time.Duration, retryAfter string) time.Duration {
+	// First, assume we just double the old delay.
+	delay := lastDelay * 2
+	// Then, try to honor the Retry-After header.
+	if n, err := strconv.ParseInt(retryAfter, 10, 64); err == nil {
+		if n > int64(webhookMaxDelay/time.Second) {
+			n = int64(webhookMaxDelay / time.Second)
+		}
+		delay = time.Duration(n) * time.Second
+	} else if at, err := time.Parse(time.RFC1123, retryAfter); err == nil {
+		delay = at.Sub(time.Now())
+	}
+	if delay < webhookMinDelay {
+		delay = webhookMinDelay
+	} else if delay > webhookMaxDelay {
+		delay = webhookMaxDelay
+	}
+	return delay
+}
+
+// retryableWebhookStatus returns whether a delivery answered with status may succeed if retried.
+func retryableWebhookStatus(status int) bool {
+	return status > 499 || status == 408 || status == 429
+}
+
+// failWebhook records a given up delivery to the webhook, and disables it after webhookMaxFailures given up deliveries in a row.
+func failWebhook(hook *auth.Webhook, failure string) {
+	hook.Failures++
+	if hook.Failures >= webhookMaxFailures {
+		hook.Disabled = true
+		hook.Note = fmt.Sprintf("Disabled at %v after %v failed deliveries in a row, the last one due to: %v", time.Now(), hook.Failures, failure)
+	} else {
+		hook.Note = fmt.Sprintf("Delivery failed at %v due to: %v", time.Now(), failure)
+	}
+}
+
+func webhookSend(ctx context.Context, lastDelay time.Duration, attempt int, userId, webhookURL, event string, payload []byte) error {
+	log.Infof(ctx, "webhookSend(..., %v, %v, %q, %q, %q, ...)", lastDelay, attempt, userId, webhookURL, event)
+
+	userConfig := &auth.UserConfig{}
+	if err := datastore.Get(ctx, auth.UserConfigID(ctx, auth.UserID(ctx, userId)), userConfig); err == datastore.ErrNoSuchEntity {
+		log.Infof(ctx, "%q has no configuration anymore, exiting", userId)
+		return nil
+	} else if err != nil {
+		log.Errorf(ctx, "Unable to load configuration of %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+	var webhook *auth.Webhook
+	for i := range userConfig.Webhooks {
+		if userConfig.Webhooks[i].URL == webhookURL {
+			webhook = &userConfig.Webhooks[i]
+		}
+	}
+	if webhook == nil || webhook.Disabled {
+		log.Infof(ctx, "%q has removed or disabled %q, exiting", userId, webhookURL)
+		return nil
+	}
+
+	req, err := http.NewRequest("POST", webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		// Can't retry, the URL is fucked up.
+		log.Errorf(ctx, "Unable to create request to %q: %v; unable to recover", webhookURL, err)
+		return nil
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Diplicity-Event", event)
+	req.Header.Set("X-Diplicity-Signature", signWebhookPayload(webhook.Secret, payload))
+
+	retry := false
+	failure := ""
+	retryAfter := ""
+	resp, err := urlfetch.Client(ctx).Do(req)
+	if err != nil {
+		// Safe to retry, nothing got delivered probably.
+		retry = true
+		failure = err.Error()
+	} else {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		retryAfter = resp.Header.Get("Retry-After")
+		if resp.StatusCode > 199 && resp.StatusCode < 300 {
+			log.Infof(ctx, "%q accepted the %q event with %v", webhookURL, event, resp.Status)
+		} else {
+			retry = retryableWebhookStatus(resp.StatusCode)
+			failure = fmt.Sprintf("%q responded %v", webhookURL, resp.Status)
+		}
+	}
+
+	if failure == "" {
+		if webhook.Failures > 0 {
+			if err := mutateWebhook(ctx, userId, webhookURL, func(hook *auth.Webhook) {
+				hook.Failures = 0
+			}); err != nil {
+				log.Errorf(ctx, "Unable to reset failures of %q: %v; hope datastore gets fixed", webhookURL, err)
+			}
+		}
+		log.Infof(ctx, "webhookSend(..., %v, %v, %q, %q, %q, ...) *** SUCCESS ***", lastDelay, attempt, userId, webhookURL, event)
+		return nil
+	}
+
+	if retry && attempt < webhookMaxAttempts {
+		delay := webhookRetryDelay(lastDelay, retryAfter)
+		log.Warningf(ctx, "Attempt %v to deliver to %q failed: %v; retrying in %v", attempt, webhookURL, failure, delay)
+		if err := webhookSendFunc.EnqueueIn(ctx, delay, delay, attempt+1, userId, webhookURL, event, payload); err != nil {
+			log.Errorf(ctx, "Unable to schedule retry of delivery to %q in %v: %v", webhookURL, delay, err)
+			return err
+		}
+		return nil
+	}
+
+	log.Errorf(ctx, "Giving up delivering to %q after %v attempts: %v", webhookURL, attempt, failure)
+	if err := mutateWebhook(ctx, userId, webhookURL, func(hook *auth.Webhook) {
+		failWebhook(hook, failure)
+	}); err != nil {
+		log.Errorf(ctx, "Unable to record failure of %q: %v; hope datastore gets fixed", webhookURL, err)
+		return err
+	}
+
+	return nil
+}
+
+// sendPhaseWebhooks delivers the new phase to the webhooks of the user, along with the start or end of the game if the phase is the first or the last.
+func sendPhaseWebhooks(ctx context.Context, host, scheme string, gameID *datastore.Key, phaseOrdinal int64, userId string) error {
+	log.Infof(ctx, "sendPhaseWebhooks(..., %q, %q, %v, %v, %q)", host, scheme, gameID, phaseOrdinal, userId)
+
+	msgContext, err := getPhaseNotificationContext(ctx, host, scheme, gameID, phaseOrdinal, userId)
+	if err == noConfigError {
+		log.Infof(ctx, "%q has no configuration, will skip sending webhooks", userId)
+		return nil
+	} else if err != nil {
+		log.Errorf(ctx, "Unable to get phase notification context: %v; fix getPhaseNotificationContext or hope datastore gets fixed", err)
+		return err
+	}
+
+	if len(msgContext.userConfig.Webhooks) == 0 {
+		log.Infof(ctx, "%q hasn't registered any webhooks, will skip sending webhooks", userId)
+		return nil
+	}
+
+	msgContext.game.Redact(msgContext.user)
+	gameData := map[string]interface{}{
+		"gameID": msgContext.game.ID,
+		"game":   msgContext.game,
+	}
+
+	if msgContext.phase.PhaseOrdinal == 1 {
+		if err := enqueueWebhooks(ctx, msgContext.userConfig, auth.GameStartWebhookEvent, gameData); err != nil {
+			log.Errorf(ctx, "Unable to enqueue game start webhooks to %q: %v; hope datastore gets fixed", userId, err)
+			return err
+		}
+	}
+
+	if msgContext.gameState.MutePhaseNotifications {
+		log.Infof(ctx, "%q has muted phase notifications for %v, will skip sending phase webhooks", userId, gameID)
+	} else if err := enqueueWebhooks(ctx, msgContext.userConfig, auth.PhaseWebhookEvent, msgContext.fcmData); err != nil {
+		log.Errorf(ctx, "Unable to enqueue phase webhooks to %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+
+	if msgContext.game.Finished && msgContext.phase.Resolved {
+		if err := enqueueWebhooks(ctx, msgContext.userConfig, auth.GameEndWebhookEvent, gameData); err != nil {
+			log.Errorf(ctx, "Unable to enqueue game end webhooks to %q: %v; hope datastore gets fixed", userId, err)
+			return err
+		}
+	}
+
+	log.Infof(ctx, "sendPhaseWebhooks(..., %q, %q, %v, %v, %q) *** SUCCESS ***", host, scheme, gameID, phaseOrdinal, userId)
+
+	return nil
+}
+
+func sendMsgWebhooks(ctx context.Context, host, scheme string, gameID *datastore.Key, channelMembers Nations, messageID *datastore.Key, userId string) error {
+	log.Infof(ctx, "sendMsgWebhooks(..., %q, %q, %v, %+v, %v, %q)", host, scheme, gameID, channelMembers, messageID, userId)
+
+	msgContext, err := getMsgNotificationContext(ctx, host, scheme, gameID, channelMembers, messageID, userId)
+	if err == noConfigError {
+		log.Infof(ctx, "%q has no configuration, will skip sending webhooks", userId)
+		return nil
+	} else if err != nil {
+		log.Errorf(ctx, "Unable to get msg notification context: %v; fix getMsgNotificationContext or hope datastore gets fixed", err)
+		return err
+	}
+
+	if msgContext.gameState.MutesMessageNotifications(channelMembers) {
+		log.Infof(ctx, "%q has muted message notifications for %v in %v, will skip sending webhooks", userId, channelMembers, gameID)
+		return nil
+	}
+
+	if err := enqueueWebhooks(ctx, msgContext.userConfig, auth.MessageWebhookEvent, msgContext.fcmData); err != nil {
+		log.Errorf(ctx, "Unable to enqueue message webhooks to %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+
+	log.Infof(ctx, "sendMsgWebhooks(..., %q, %q, %v, %+v, %v, %q) *** SUCCESS ***", host, scheme, gameID, channelMembers, messageID, userId)
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package game
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+)
+
+func TestSignWebhookPayload(t *testing.T) {
+	if sig := signWebhookPayload("key", []byte("The quick brown fox jumps over the lazy dog")); sig != "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8" {
+		t.Errorf("got signature %q", sig)
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	for _, tc := range []struct {
+		lastDelay  time.Duration
+		retryAfter string
+		want       time.Duration
+	}{
+		{0, "", webhookMinDelay},
+		{webhookMinDelay, "", 2 * webhookMinDelay},
+		{webhookMaxDelay, "", webhookMaxDelay},
+		{0, "120", 2 * time.Minute},
+		{0, "-5", webhookMinDelay},
+		{0, "0", webhookMinDelay},
+		{0, "9223372036854775807", webhookMaxDelay},
+		{0, time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), webhookMinDelay},
+		{0, time.Now().Add(365 * 24 * time.Hour).UTC().Format(http.TimeFormat), webhookMaxDelay},
+	} {
+		if got := webhookRetryDelay(tc.lastDelay, tc.retryAfter); got != tc.want {
+			t.Errorf("got %v after %v with Retry-After %q, wanted %v", got, tc.lastDelay, tc.retryAfter, tc.want)
+		}
+	}
+}
+
+func TestRetryableWebhookStatus(t *testing.T) {
+	for status, want := range map[int]bool{
+		400: false,
+		404: false,
+		408: true,
+		429: true,
+		500: true,
+		503: true,
+	} {
+		if got := retryableWebhookStatus(status); got != want {
+			t.Errorf("got %v for %v, wanted %v", got, status, want)
+		}
+	}
+}
+
+func TestFailWebhook(t *testing.T) {
+	hook := &auth.Webhook{}
+	for i := 1; i < webhookMaxFailures; i++ {
+		failWebhook(hook, "gone")
+		if hook.Disabled {
+			t.Fatalf("disabled after %v failures, wanted %v", i, webhookMaxFailures)
+		}
+	}
+	failWebhook(hook, "gone")
+	if !hook.Disabled || hook.Failures != webhookMaxFailures {
+		t.Errorf("got %+v after %v failures, wanted it disabled", hook, webhookMaxFailures)
+	}
+}
@@ -0,0 +1,44 @@
+package variants
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+// RasterizeSVG renders an SVG document to an image the size of its view box.
+func RasterizeSVG(b []byte) (*image.RGBA, error) {
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(b), oksvg.WarnErrorMode)
+	if err != nil {
+		return nil, err
+	}
+	w, h := int(icon.ViewBox.W), int(icon.ViewBox.H)
+	if w < 1 || h < 1 {
+		return nil, fmt.Errorf("SVG has empty view box %+v", icon.ViewBox)
+	}
+	icon.SetTarget(0, 0, float64(w), float64(h))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	icon.Draw(rasterx.NewDasher(w, h, rasterx.NewScannerGV(w, h, img, img.Bounds())), 1)
+	return img, nil
+}
+
+// PhaseMapPNG renders the phase as a PNG image.
+func PhaseMapPNG(phase *Phase) ([]byte, error) {
+	svg, err := PhaseMapSVG(phase)
+	if err != nil {
+		return nil, err
+	}
+	img, err := RasterizeSVG(svg)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
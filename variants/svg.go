@@ -0,0 +1,631 @@
+package variants
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zond/godip/variants"
+
+	dip "github.com/zond/godip/common"
+	vrt "github.com/zond/godip/variants/common"
+)
+
+// Contrasts are the nation colors, in variant nation order. Kept in sync with dippymap.js.
+var Contrasts = []string{
+	"#e90068",
+	"#00a057",
+	"#ff57c3",
+	"#a1d656",
+	"#026fe7",
+	"#d2ae00",
+	"#00b4dd",
+	"#ca3803",
+	"#fcb1cf",
+	"#6f5400",
+}
+
+var (
+	textEscaper  = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	centerReg    = regexp.MustCompile(`^m\s+([\d.-]+),([\d.-]+)\s+`)
+	translateReg = regexp.MustCompile(`^translate\(([\d.-]+),\s*([\d.-]+)\)$`)
+)
+
+// svgNode is a minimal XML DOM, just enough to manipulate the variant maps
+// without losing the namespaced (inkscape, sodipodi etc) attributes on the way.
+type svgNode struct {
+	name     xml.Name
+	attrs    []xml.Attr
+	children []interface{}
+	parent   *svgNode
+}
+
+func parseSVG(b []byte) (*svgNode, error) {
+	root := &svgNode{}
+	current := root
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			child := &svgNode{
+				name:   t.Name,
+				attrs:  append([]xml.Attr{}, t.Attr...),
+				parent: current,
+			}
+			current.children = append(current.children, child)
+			current = child
+		case xml.EndElement:
+			if current.parent == nil {
+				return nil, fmt.Errorf("unbalanced end element %v", t.Name)
+			}
+			current = current.parent
+		case xml.CharData:
+			current.children = append(current.children, t.Copy())
+		case xml.Comment:
+			current.children = append(current.children, t.Copy())
+		case xml.ProcInst:
+			current.children = append(current.children, t.Copy())
+		case xml.Directive:
+			current.children = append(current.children, t.Copy())
+		}
+	}
+	return root, nil
+}
+
+func qualifiedName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+func (n *svgNode) write(buf *bytes.Buffer) {
+	if n.name.Local != "" {
+		buf.WriteString("<")
+		buf.WriteString(qualifiedName(n.name))
+		for _, attr := range n.attrs {
+			buf.WriteString(" ")
+			buf.WriteString(qualifiedName(attr.Name))
+			buf.WriteString(`="`)
+			xml.EscapeText(buf, []byte(attr.Value))
+			buf.WriteString(`"`)
+		}
+		if len(n.children) == 0 {
+			buf.WriteString("/>")
+			return
+		}
+		buf.WriteString(">")
+	}
+	for _, child := range n.children {
+		switch c := child.(type) {
+		case *svgNode:
+			c.write(buf)
+		case xml.CharData:
+			// xml.EscapeText would escape newlines as well, which bloats the pretty printed maps.
+			buf.WriteString(textEscaper.Replace(string(c)))
+		case xml.Comment:
+			buf.WriteString("<!--")
+			buf.Write(c)
+			buf.WriteString("-->")
+		case xml.ProcInst:
+			buf.WriteString("<?")
+			buf.WriteString(c.Target)
+			if len(c.Inst) > 0 {
+				buf.WriteString(" ")
+				buf.Write(c.Inst)
+			}
+			buf.WriteString("?>")
+		case xml.Directive:
+			buf.WriteString("<!")
+			buf.Write(c)
+			buf.WriteString(">")
+		}
+	}
+	if n.name.Local != "" {
+		buf.WriteString("</")
+		buf.WriteString(qualifiedName(n.name))
+		buf.WriteString(">")
+	}
+}
+
+func (n *svgNode) attr(name string) (string, bool) {
+	for _, attr := range n.attrs {
+		if qualifiedName(attr.Name) == name {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+func (n *svgNode) setAttr(name, value string) {
+	for i := range n.attrs {
+		if qualifiedName(n.attrs[i].Name) == name {
+			n.attrs[i].Value = value
+			return
+		}
+	}
+	n.attrs = append(n.attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+func (n *svgNode) removeAttr(name string) {
+	for i := range n.attrs {
+		if qualifiedName(n.attrs[i].Name) == name {
+			n.attrs = append(n.attrs[:i], n.attrs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (n *svgNode) find(id string) *svgNode {
+	if found, ok := n.attr("id"); ok && found == id {
+		return n
+	}
+	for _, child := range n.children {
+		if node, ok := child.(*svgNode); ok {
+			if found := node.find(id); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+func (n *svgNode) clone() *svgNode {
+	cpy := &svgNode{
+		name:  n.name,
+		attrs: append([]xml.Attr{}, n.attrs...),
+	}
+	for _, child := range n.children {
+		if node, ok := child.(*svgNode); ok {
+			childCopy := node.clone()
+			childCopy.parent = cpy
+			cpy.children = append(cpy.children, childCopy)
+		} else {
+			cpy.children = append(cpy.children, child)
+		}
+	}
+	return cpy
+}
+
+func (n *svgNode) appendChild(child *svgNode) {
+	child.parent = n
+	n.children = append(n.children, child)
+}
+
+type poi struct {
+	x, y float64
+}
+
+func (p poi) add(o poi) poi {
+	return poi{p.x + o.x, p.y + o.y}
+}
+
+func (p poi) sub(o poi) poi {
+	return poi{p.x - o.x, p.y - o.y}
+}
+
+func (p poi) mul(f float64) poi {
+	return poi{p.x * f, p.y * f}
+}
+
+func (p poi) div(f float64) poi {
+	return poi{p.x / f, p.y / f}
+}
+
+func (p poi) len() float64 {
+	return math.Sqrt(p.x*p.x + p.y*p.y)
+}
+
+func (p poi) orth() poi {
+	return poi{-p.y, p.x}
+}
+
+func (p poi) String() string {
+	return num(p.x) + "," + num(p.y)
+}
+
+func dir(from, to poi) poi {
+	return to.sub(from).div(to.sub(from).len())
+}
+
+func orthDir(from, to poi) poi {
+	return dir(from, to).orth()
+}
+
+func num(f float64) string {
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
+
+func parseNum(s string) float64 {
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+func pathStyle(color, fillOpacity string) string {
+	return "fill:" + color + ";stroke:#000000;stroke-width:0.5;stroke-miterlimit:4;stroke-opacity:1.0;fill-opacity:" + fillOpacity + ";"
+}
+
+// svgMap mirrors the dippyMap object in dippymap.js, but works on a parsed SVG instead of a browser DOM.
+type svgMap struct {
+	variant vrt.Variant
+	root    *svgNode
+	units   map[dip.UnitType]*svgNode
+	colors  map[dip.Nation]string
+}
+
+func newSVGMap(variant vrt.Variant) (*svgMap, error) {
+	mapBytes, err := variant.SVGMap()
+	if err != nil {
+		return nil, err
+	}
+	root, err := parseSVG(mapBytes)
+	if err != nil {
+		return nil, err
+	}
+	m := &svgMap{
+		variant: variant,
+		root:    root,
+		units:   map[dip.UnitType]*svgNode{},
+		colors:  map[dip.Nation]string{},
+	}
+	for _, typ := range variant.UnitTypes {
+		unitBytes, err := variant.SVGUnits[typ]()
+		if err != nil {
+			return nil, err
+		}
+		if m.units[typ], err = parseSVG(unitBytes); err != nil {
+			return nil, err
+		}
+	}
+	for i, nat := range variant.Nations {
+		m.colors[nat] = Contrasts[i%len(Contrasts)]
+	}
+	return m, nil
+}
+
+func (m *svgMap) layer(id string) *svgNode {
+	if found := m.root.find(id); found != nil {
+		return found
+	}
+	// Some maps lack some layers, so just add them on top.
+	layer := &svgNode{name: xml.Name{Local: "g"}, attrs: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: id}}}
+	if svg := m.svg(); svg != nil {
+		svg.appendChild(layer)
+	}
+	return layer
+}
+
+func (m *svgMap) svg() *svgNode {
+	for _, child := range m.root.children {
+		if node, ok := child.(*svgNode); ok && node.name.Local == "svg" {
+			return node
+		}
+	}
+	return nil
+}
+
+func (m *svgMap) centerOf(prov dip.Province) (poi, bool) {
+	center := m.root.find(string(prov) + "Center")
+	if center == nil {
+		return poi{}, false
+	}
+	d, _ := center.attr("d")
+	match := centerReg.FindStringSubmatch(d)
+	if match == nil {
+		return poi{}, false
+	}
+	result := poi{parseNum(match[1]), parseNum(match[2])}
+	if center.parent != nil {
+		if transform, found := center.parent.attr("transform"); found {
+			if transMatch := translateReg.FindStringSubmatch(transform); transMatch != nil {
+				result.x += parseNum(transMatch[1]) - 1.5
+				result.y += parseNum(transMatch[2]) - 2
+			}
+		}
+	}
+	return result, true
+}
+
+func (m *svgMap) showProvinces() {
+	if provinces := m.root.find("provinces"); provinces != nil {
+		provinces.removeAttr("style")
+	}
+}
+
+func (m *svgMap) colorProvince(prov dip.Province, color, opacity string) {
+	if path := m.root.find(string(prov)); path != nil {
+		path.removeAttr("style")
+		path.setAttr("fill", color)
+		path.setAttr("fill-opacity", opacity)
+	}
+}
+
+func (m *svgMap) addPath(layer, style, d string) {
+	m.layer(layer).appendChild(&svgNode{
+		name: xml.Name{Local: "path"},
+		attrs: []xml.Attr{
+			{Name: xml.Name{Local: "style"}, Value: style},
+			{Name: xml.Name{Local: "d"}, Value: d},
+		},
+	})
+}
+
+func (m *svgMap) addBox(prov dip.Province, corners int, color string) {
+	loc, found := m.centerOf(prov)
+	if !found {
+		return
+	}
+	loc = loc.sub(poi{3, 3})
+	step := math.Pi * 2 / float64(corners)
+	angle := math.Pi * 1.5
+	if corners%2 == 0 {
+		angle += step / 2
+	}
+	d := []string{}
+	for _, bound := range []float64{27, 20} {
+		d = append(d, "M "+loc.add(poi{math.Cos(angle) * bound, math.Sin(angle) * bound}).String())
+		for i := 1; i < corners; i++ {
+			angle += step
+			d = append(d, "L "+loc.add(poi{math.Cos(angle) * bound, math.Sin(angle) * bound}).String())
+		}
+		d = append(d, "z")
+	}
+	m.addPath("orders", "fill-rule:evenodd;"+pathStyle(color, "0.9"), strings.Join(d, " "))
+}
+
+func (m *svgMap) addArrow(provs []dip.Province, color string) {
+	if len(provs) == 3 && provs[1] == provs[2] {
+		provs = provs[:2]
+	}
+	points := []poi{}
+	for _, prov := range provs {
+		p, found := m.centerOf(prov)
+		if !found {
+			return
+		}
+		points = append(points, p)
+	}
+	var start, middle, end poi
+	if len(points) == 2 {
+		start, end = points[0], points[1]
+		middle = start.add(end.sub(start).div(2))
+	} else {
+		start, middle, end = points[0], points[1], points[2]
+	}
+	if start == middle || middle == end {
+		return
+	}
+	boundF := 3.0
+	headF1 := boundF * 3
+	headF2 := boundF * 6
+	spacer := boundF * 2
+	start0 := start.add(dir(start, middle).mul(spacer)).add(orthDir(start, middle).mul(boundF))
+	start1 := start.add(dir(start, middle).mul(spacer)).sub(orthDir(start, middle).mul(boundF))
+	sumOrth := orthDir(start, middle).add(orthDir(middle, end))
+	avgOrth := sumOrth
+	if l := sumOrth.len(); l > 0 {
+		avgOrth = sumOrth.div(l)
+	}
+	control0 := middle.add(avgOrth.mul(boundF))
+	control1 := middle.sub(avgOrth.mul(boundF))
+	end0 := end.sub(dir(middle, end).mul(spacer + headF2)).add(orthDir(middle, end).mul(boundF))
+	end1 := end.sub(dir(middle, end).mul(spacer + headF2)).sub(orthDir(middle, end).mul(boundF))
+	end3 := end.sub(dir(middle, end).mul(spacer))
+	head0 := end0.add(orthDir(middle, end).mul(headF1))
+	head1 := end1.sub(orthDir(middle, end).mul(headF1))
+	d := fmt.Sprintf(
+		"M %s C %s,%s,%s L %s L %s L %s L %s C %s,%s,%s z",
+		start0, control0, control0, end0, head0, end3, head1, end1, control1, control1, start1)
+	m.addPath("orders", pathStyle(color, "0.7"), d)
+}
+
+func (m *svgMap) addCross(prov dip.Province, color string) {
+	loc, found := m.centerOf(prov)
+	if !found {
+		return
+	}
+	loc = loc.sub(poi{3, 3})
+	bound := 14.0
+	width := 4.0
+	corners := []poi{
+		{0, width},
+		{bound, bound + width},
+		{bound + width, bound},
+		{width, 0},
+		{bound + width, -bound},
+		{bound, -bound - width},
+		{0, -width},
+		{-bound, -bound - width},
+		{-bound - width, -bound},
+		{-width, 0},
+		{-bound - width, bound},
+		{-bound, bound + width},
+	}
+	d := []string{}
+	for i, corner := range corners {
+		if i == 0 {
+			d = append(d, "M "+loc.add(corner).String())
+		} else {
+			d = append(d, "L "+loc.add(corner).String())
+		}
+	}
+	d = append(d, "z")
+	m.addPath("orders", pathStyle(color, "0.9"), strings.Join(d, " "))
+}
+
+func (m *svgMap) addUnit(typ dip.UnitType, prov dip.Province, color string, dislodged, build bool, layer string) {
+	source, found := m.units[typ]
+	if !found {
+		return
+	}
+	loc, found := m.centerOf(prov)
+	if !found {
+		return
+	}
+	opacity := "1"
+	if dislodged {
+		loc = loc.add(poi{5, 5})
+		opacity = "0.73"
+	}
+	loc.y -= 11
+	var unit *svgNode
+	if hull := source.find("hull"); hull != nil {
+		unit = hull.clone()
+		loc = loc.sub(poi{65, 15})
+	} else if body := source.find("body"); body != nil {
+		unit = body.clone()
+		loc = loc.sub(poi{40, 5})
+	} else {
+		return
+	}
+	transform := fmt.Sprintf("translate(%s, %s)", num(loc.x), num(loc.y))
+	if shadow := source.find("shadow"); shadow != nil {
+		shadow = shadow.clone()
+		shadow.setAttr("transform", transform)
+		m.layer(layer).appendChild(shadow)
+	}
+	if build {
+		color = "#000000"
+	}
+	unit.setAttr("transform", transform)
+	unit.setAttr("style", "fill:"+color+";fill-opacity:"+opacity+";stroke:#000000;stroke-width:1;stroke-miterlimit:4;stroke-opacity:1;stroke-dasharray:none")
+	m.layer(layer).appendChild(unit)
+}
+
+func (m *svgMap) addOrder(prov dip.Province, order []string, color string) {
+	if len(order) == 0 {
+		return
+	}
+	switch order[0] {
+	case "Hold":
+		m.addBox(prov, 4, color)
+	case "Move":
+		if len(order) > 1 {
+			m.addArrow([]dip.Province{prov, dip.Province(order[1])}, color)
+		}
+	case "MoveViaConvoy":
+		if len(order) > 1 {
+			m.addArrow([]dip.Province{prov, dip.Province(order[1])}, color)
+			m.addBox(prov, 5, color)
+		}
+	case "Build":
+		if len(order) > 1 {
+			m.addUnit(dip.UnitType(order[1]), prov, color, false, true, "orders")
+		}
+	case "Disband":
+		m.addCross(prov, color)
+	case "Convoy":
+		if len(order) > 2 {
+			m.addBox(prov, 5, color)
+			m.addArrow([]dip.Province{dip.Province(order[1]), prov, dip.Province(order[2])}, color)
+		}
+	case "Support":
+		m.addBox(prov, 3, color)
+		if len(order) == 2 {
+			m.addArrow([]dip.Province{prov, dip.Province(order[1])}, color)
+		} else if len(order) > 2 {
+			m.addArrow([]dip.Province{prov, dip.Province(order[1]), dip.Province(order[2])}, color)
+		}
+	}
+}
+
+type provinces []dip.Province
+
+func (p provinces) Len() int {
+	return len(p)
+}
+
+func (p provinces) Less(i, j int) bool {
+	return p[i] < p[j]
+}
+
+func (p provinces) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+
+func sortedProvinces(provs []dip.Province) []dip.Province {
+	sort.Sort(provinces(provs))
+	return provs
+}
+
+// PhaseMapSVG renders the phase as a standalone SVG document, the same way dippymap.js does in the browser.
+func PhaseMapSVG(phase *Phase) ([]byte, error) {
+	variant, found := variants.Variants[phase.Variant]
+	if !found {
+		return nil, fmt.Errorf("unknown variant %q", phase.Variant)
+	}
+
+	m, err := newSVGMap(variant)
+	if err != nil {
+		return nil, err
+	}
+
+	gr := variant.Graph()
+	for _, prov := range sortedProvinces(gr.Provinces()) {
+		if prov.Super() != prov {
+			continue
+		}
+		if gr.SC(prov) != nil {
+			if nat, found := phase.SupplyCenters[prov]; found {
+				m.colorProvince(prov, m.colors[nat], "0.8")
+				continue
+			}
+		}
+		m.colorProvince(prov, "#ffffff", "0")
+	}
+	m.showProvinces()
+
+	provs := []dip.Province{}
+	for prov := range phase.Units {
+		provs = append(provs, prov)
+	}
+	for _, prov := range sortedProvinces(provs) {
+		unit := phase.Units[prov]
+		m.addUnit(unit.Type, prov, m.colors[unit.Nation], false, false, "units")
+	}
+
+	provs = []dip.Province{}
+	for prov := range phase.Dislodgeds {
+		provs = append(provs, prov)
+	}
+	for _, prov := range sortedProvinces(provs) {
+		unit := phase.Dislodgeds[prov]
+		m.addUnit(unit.Type, prov, m.colors[unit.Nation], true, false, "units")
+	}
+
+	for _, nat := range variant.Nations {
+		provs = []dip.Province{}
+		for prov := range phase.Orders[nat] {
+			provs = append(provs, prov)
+		}
+		for _, prov := range sortedProvinces(provs) {
+			m.addOrder(prov, phase.Orders[nat][prov], m.colors[nat])
+		}
+	}
+
+	provs = []dip.Province{}
+	for prov, res := range phase.Resolutions {
+		if res != "OK" {
+			provs = append(provs, prov)
+		}
+	}
+	for _, prov := range sortedProvinces(provs) {
+		m.addCross(prov, "#ff0000")
+	}
+
+	buf := &bytes.Buffer{}
+	m.root.write(buf)
+	return buf.Bytes(), nil
+}